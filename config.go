@@ -4,21 +4,35 @@ import (
 	"bytes"
 	"encoding/json"
 	"os"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ansel1/merry/v2"
 )
 
 var defaultConfig = Config{
-	History:           ConfigChatFilterType{Type: ChatUser},
-	Stories:           ConfigChatFilterNone{},
-	Media:             ConfigChatFilterNone{},
-	RequestIntervalMS: 1000,
-	SessionFilePath:   "tg.session",
-	OutDirPath:        "history",
-	DoAccountDump:     "off",
-	DoContactsDump:    "off",
-	DoSessionsDump:    "off",
+	History:             ConfigChatFilterType{Type: ChatUser},
+	Stories:             ConfigChatFilterNone{},
+	Media:               ConfigChatFilterNone{},
+	FullInfo:            ConfigChatFilterNone{},
+	Participants:        ConfigChatFilterNone{},
+	AdminLog:            ConfigChatFilterNone{},
+	ProfilePhotos:       ConfigChatFilterNone{},
+	StickerSets:         ConfigChatFilterNone{},
+	RequestIntervalMS:   1000,
+	Concurrency:         1,
+	DownloadConcurrency: 1,
+	AccountsConcurrency: 1,
+	SessionFilePath:     "tg.session",
+	LoginMethod:         "interactive",
+	OutDirPath:          "history",
+	Storage:             "json",
+	DoAccountDump:       "off",
+	DoContactsDump:      "off",
+	DoSessionsDump:      "off",
 }
 
 type Config struct {
@@ -26,17 +40,45 @@ type Config struct {
 	AppHash             string
 	History             ConfigChatFilter
 	Stories             ConfigChatFilter
-	HistoryLimit        ConfigChatHistoryLimit
+	HistoryLimit        ConfigChatHistoryLimits
+	EditsRescan         ConfigChatMessagesWindows
+	MetricsSnapshots    ConfigChatHistoryLimit
 	Media               ConfigChatFilter
+	FullInfo            ConfigChatFilter
+	Participants        ConfigChatFilter
+	AdminLog            ConfigChatFilter
+	ProfilePhotos       ConfigChatFilter
+	StickerSets         ConfigChatFilter
 	Socks5ProxyAddr     string
 	Socks5ProxyUser     string
 	Socks5ProxyPassword string
+	LoginMethod         string
+	LoginPhone          string
+	LoginPassword       string
+	LoginCode           string
 	RequestIntervalMS   int64
+	Concurrency         int64
+	DownloadConcurrency int64
 	SessionFilePath     string
+	SessionPassphrase   string
 	OutDirPath          string
+	Storage             string
 	DoAccountDump       string
 	DoContactsDump      string
 	DoSessionsDump      string
+	// only in config.accounts entries
+	Name string
+	// only in top-level config
+	Accounts            []*Config
+	AccountsConcurrency int64
+}
+
+// AccountConfigs returns configs of all accounts (or the config itself if there is no config.accounts).
+func (c *Config) AccountConfigs() []*Config {
+	if len(c.Accounts) > 0 {
+		return c.Accounts
+	}
+	return []*Config{c}
 }
 
 type SuffixedSize int64
@@ -142,12 +184,19 @@ type ConfigChatFilterExclude struct {
 }
 
 func (f ConfigChatFilterExclude) Match(chat *Chat, file *TGFileInfo) MatchResult {
+	if chat.TopicID == nil {
+		// matching the whole chat: excluding some of its topics must not exclude the chat itself
+		chat = chat.WithTopic(noForumTopicID)
+	}
 	if f.Inner.Match(chat, file) == MatchTrue {
 		return MatchFalse
 	}
 	return MatchUndefined
 }
 
+// topic IDs start from 1 (the "General" topic)
+const noForumTopicID = int32(0)
+
 type ConfigChatFilterType struct{ Type ChatType }
 
 func (f ConfigChatFilterType) Match(chat *Chat, file *TGFileInfo) MatchResult {
@@ -163,13 +212,20 @@ type ConfigChatFilterAttrs struct {
 	Username     *string       `json:"username,omitempty"`
 	Type         *ChatType     `json:"type,omitempty"`
 	MediaMaxSize *SuffixedSize `json:"media_max_size,omitempty"`
+	Comments     *bool         `json:"comments,omitempty"`
+	Topic        *int32        `json:"topic,omitempty"`
+	Folder       *string       `json:"folder,omitempty"`
+	Archived     *bool         `json:"archived,omitempty"`
 }
 
 func (f ConfigChatFilterAttrs) Match(chat *Chat, file *TGFileInfo) MatchResult {
 	mc := (f.ID == nil || chat.ID == *f.ID) &&
 		(f.Title == nil || chat.Title == *f.Title) &&
 		(f.Username == nil || chat.Username == *f.Username) &&
-		(f.Type == nil || chat.Type == *f.Type)
+		(f.Type == nil || chat.Type == *f.Type) &&
+		(f.Topic == nil || chat.TopicID == nil || *chat.TopicID == *f.Topic) &&
+		(f.Folder == nil || slices.Contains(chat.Folders, *f.Folder)) &&
+		(f.Archived == nil || chat.Archived == *f.Archived)
 	mf := file == nil ||
 		(f.MediaMaxSize == nil || int64(file.Size) <= int64(*f.MediaMaxSize))
 	if mc && mf {
@@ -178,6 +234,38 @@ func (f ConfigChatFilterAttrs) Match(chat *Chat, file *TGFileInfo) MatchResult {
 	return MatchUndefined
 }
 
+// MatchComments checks whether channel post comments should be dumped for the chat.
+// Comments are enabled only by attributes rules with "comments":true,
+// they also may be disabled by "comments":false and excluded along with the chat.
+func MatchComments(root ConfigChatFilter, chat *Chat) MatchResult {
+	switch f := root.(type) {
+	case ConfigChatFilterNone:
+		return MatchFalse
+	case ConfigChatFilterAttrs:
+		if f.Comments != nil && f.Match(chat, nil) == MatchTrue {
+			if *f.Comments {
+				return MatchTrue
+			}
+			return MatchFalse
+		}
+	case ConfigChatFilterMulti:
+		res := MatchUndefined
+		for _, inner := range f.Inner {
+			if m := MatchComments(inner, chat); m != MatchUndefined {
+				res = m
+			}
+		}
+		return res
+	case ConfigChatFilterExclude:
+		return f.Match(chat, nil)
+	case ConfigChatFilterOnly:
+		if f.Only.Match(chat, nil) == MatchTrue {
+			return MatchComments(f.With, chat)
+		}
+	}
+	return MatchUndefined
+}
+
 func (f ConfigChatFilterAttrs) String() string {
 	buf, _ := json.Marshal(f)
 	return string(buf)
@@ -197,22 +285,147 @@ func (l ConfigChatHistoryLimit) For(chat *Chat) int32 {
 	return minLimit
 }
 
+// ConfigMessagesWindow describes a range of most recent chat messages:
+// last Count messages and/or messages sent during last Days days.
+type ConfigMessagesWindow struct {
+	Count int32
+	Days  int32
+}
+
+func (w ConfigMessagesWindow) IsEmpty() bool {
+	return w.Count <= 0 && w.Days <= 0
+}
+
+// "500" -> last 500 messages, "7d" -> messages of last 7 days
+func parseConfigMessagesWindow(str string) (ConfigMessagesWindow, error) {
+	if daysStr, ok := strings.CutSuffix(str, "d"); ok {
+		days, err := strconv.ParseInt(daysStr, 10, 32)
+		if err != nil {
+			return ConfigMessagesWindow{}, merry.Prependf(err, "messages window '%s'", str)
+		}
+		return ConfigMessagesWindow{Days: int32(days)}, nil
+	}
+	count, err := strconv.ParseInt(str, 10, 32)
+	if err != nil {
+		return ConfigMessagesWindow{}, merry.Prependf(err, "messages window '%s'", str)
+	}
+	return ConfigMessagesWindow{Count: int32(count)}, nil
+}
+
+// ConfigHistoryLimit describes the start of history of a new chat:
+// last Count messages, messages of last Days days and/or messages sent since Since date.
+type ConfigHistoryLimit struct {
+	Count int32
+	Days  int32
+	Since int64 //unix time
+}
+
+func (l ConfigHistoryLimit) IsEmpty() bool {
+	return l.Count <= 0 && l.Days <= 0 && l.Since <= 0
+}
+
+// StartDate returns the latest of limit dates (or zero time if limit has no dates).
+func (l ConfigHistoryLimit) StartDate(now time.Time) time.Time {
+	var res time.Time
+	if l.Days > 0 {
+		res = now.AddDate(0, 0, -int(l.Days))
+	}
+	if l.Since > 0 {
+		if since := time.Unix(l.Since, 0); since.After(res) {
+			res = since
+		}
+	}
+	return res
+}
+
+// "5000" -> last 5000 messages, "90d" -> messages of last 90 days,
+// "2023-01-01" -> messages sent since 2023-01-01 (local time)
+func parseConfigHistoryLimit(str string) (ConfigHistoryLimit, error) {
+	if date, err := time.ParseInLocation("2006-01-02", str, time.Local); err == nil {
+		return ConfigHistoryLimit{Since: date.Unix()}, nil
+	}
+	window, err := parseConfigMessagesWindow(str)
+	if err != nil {
+		return ConfigHistoryLimit{}, merry.Prependf(err, "history limit")
+	}
+	return ConfigHistoryLimit{Count: window.Count, Days: window.Days}, nil
+}
+
+type ConfigChatHistoryLimits map[ConfigHistoryLimit]ConfigChatFilter
+
+// For returns the smallest count, the smallest days count and the latest date of matched rules.
+func (l ConfigChatHistoryLimits) For(chat *Chat) ConfigHistoryLimit {
+	res := ConfigHistoryLimit{}
+	for limit, filter := range l {
+		if filter.Match(chat, nil) != MatchTrue {
+			continue
+		}
+		if limit.Count > 0 && (res.Count == 0 || limit.Count < res.Count) {
+			res.Count = limit.Count
+		}
+		if limit.Days > 0 && (res.Days == 0 || limit.Days < res.Days) {
+			res.Days = limit.Days
+		}
+		if limit.Since > res.Since {
+			res.Since = limit.Since
+		}
+	}
+	return res
+}
+
+type ConfigChatMessagesWindows map[ConfigMessagesWindow]ConfigChatFilter
+
+// For returns the smallest count-window and the smallest days-window of matched rules.
+func (l ConfigChatMessagesWindows) For(chat *Chat) ConfigMessagesWindow {
+	res := ConfigMessagesWindow{}
+	for window, filter := range l {
+		if filter.Match(chat, nil) != MatchTrue {
+			continue
+		}
+		if window.Count > 0 && (res.Count == 0 || window.Count < res.Count) {
+			res.Count = window.Count
+		}
+		if window.Days > 0 && (res.Days == 0 || window.Days < res.Days) {
+			res.Days = window.Days
+		}
+	}
+	return res
+}
+
 type ConfigRaw struct {
-	AppID               int32                     `json:"app_id"`
-	AppHash             string                    `json:"app_hash"`
-	History             json.RawMessage           `json:"history"`
-	Stories             json.RawMessage           `json:"stories"`
-	HistoryLimit        map[int32]json.RawMessage `json:"history_limit"`
-	Media               json.RawMessage           `json:"media"`
-	Socks5ProxyAddr     string                    `json:"socks5_proxy_addr"`
-	Socks5ProxyUser     string                    `json:"socks5_proxy_user"`
-	Socks5ProxyPassword string                    `json:"socks5_proxy_password"`
-	RequestIntervalMS   int64                     `json:"request_interval_ms"`
-	SessionFilePath     string                    `json:"session_file_path"`
-	OutDirPath          string                    `json:"out_dir_path"`
-	DoAccountDump       string                    `json:"dump_account"`
-	DoContactsDump      string                    `json:"dump_contacts"`
-	DoSessionsDump      string                    `json:"dump_sessions"`
+	AppID               int32                      `json:"app_id"`
+	AppHash             string                     `json:"app_hash"`
+	History             json.RawMessage            `json:"history"`
+	Stories             json.RawMessage            `json:"stories"`
+	HistoryLimit        map[string]json.RawMessage `json:"history_limit"`
+	EditsRescan         map[string]json.RawMessage `json:"edits_rescan"`
+	MetricsSnapshots    map[int32]json.RawMessage  `json:"metrics_snapshots"`
+	Media               json.RawMessage            `json:"media"`
+	FullInfo            json.RawMessage            `json:"full_info"`
+	Participants        json.RawMessage            `json:"participants"`
+	AdminLog            json.RawMessage            `json:"admin_log"`
+	ProfilePhotos       json.RawMessage            `json:"profile_photos"`
+	StickerSets         json.RawMessage            `json:"sticker_sets"`
+	Socks5ProxyAddr     string                     `json:"socks5_proxy_addr"`
+	Socks5ProxyUser     string                     `json:"socks5_proxy_user"`
+	Socks5ProxyPassword string                     `json:"socks5_proxy_password"`
+	LoginMethod         string                     `json:"login_method"`
+	LoginPhone          string                     `json:"login_phone"`
+	LoginPassword       string                     `json:"login_password"`
+	LoginCode           string                     `json:"login_code"`
+	RequestIntervalMS   int64                      `json:"request_interval_ms"`
+	Concurrency         int64                      `json:"concurrency"`
+	DownloadConcurrency int64                      `json:"download_concurrency"`
+	SessionFilePath     string                     `json:"session_file_path"`
+	SessionPassphrase   string                     `json:"session_passphrase"`
+	OutDirPath          string                     `json:"out_dir_path"`
+	Storage             string                     `json:"storage"`
+	DoAccountDump       string                     `json:"dump_account"`
+	DoContactsDump      string                     `json:"dump_contacts"`
+	DoSessionsDump      string                     `json:"dump_sessions"`
+	Name                string                     `json:"name"`
+	Accounts            []json.RawMessage          `json:"accounts"`
+	AccountsConcurrency int64                      `json:"accounts_concurrency"`
 }
 
 var silentParseTestMode = false
@@ -235,24 +448,170 @@ func ParseConfig(fpath string) (*Config, error) {
 	}
 
 	cfg := defaultConfig // copying default
-	cfg.AppID = raw.AppID
-	cfg.AppHash = raw.AppHash
-	cfg.Socks5ProxyAddr = raw.Socks5ProxyAddr
-	cfg.Socks5ProxyUser = raw.Socks5ProxyUser
-	cfg.Socks5ProxyPassword = raw.Socks5ProxyPassword
+	if err := applyConfigRaw(&cfg, raw); err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if raw.AccountsConcurrency > 0 {
+		cfg.AccountsConcurrency = raw.AccountsConcurrency
+	}
+
+	// accounts inherit all top-level params (and override some of them)
+	names := make(map[string]int)
+	outDirPaths := make(map[string]string)
+	sessionFilePaths := make(map[string]string)
+	for i, rawAccountBuf := range raw.Accounts {
+		rawAccount, nullParams, err := parseAccountConfigRaw(rawAccountBuf)
+		if err != nil {
+			return nil, merry.Prependf(err, "account #%d", i)
+		}
+		if len(rawAccount.Accounts) > 0 || rawAccount.AccountsConcurrency != 0 {
+			return nil, merry.Errorf("account #%d: 'accounts' and 'accounts_concurrency' are allowed only at top level", i)
+		}
+		account := cfg // copying top-level config
+		account.Accounts = nil
+		account.AccountsConcurrency = 0
+		resetConfigParams(&account, nullParams)
+		if err := applyConfigRaw(&account, rawAccount); err != nil {
+			return nil, merry.Prependf(err, "account #%d", i)
+		}
+		if account.Name == "" {
+			account.Name = account.OutDirPath
+		}
+		if j, ok := names[account.Name]; ok {
+			return nil, merry.Errorf("accounts #%d and #%d have the same name '%s'", j, i, account.Name)
+		}
+		if name, ok := outDirPaths[account.OutDirPath]; ok {
+			return nil, merry.Errorf("accounts '%s' and '%s' have the same out_dir_path '%s'", name, account.Name, account.OutDirPath)
+		}
+		if name, ok := sessionFilePaths[account.SessionFilePath]; ok {
+			return nil, merry.Errorf("accounts '%s' and '%s' have the same session_file_path '%s'", name, account.Name, account.SessionFilePath)
+		}
+		names[account.Name] = i
+		outDirPaths[account.OutDirPath] = account.Name
+		sessionFilePaths[account.SessionFilePath] = account.Name
+		cfg.Accounts = append(cfg.Accounts, &account)
+	}
+	return &cfg, nil
+}
+
+// parseAccountConfigRaw parses config.accounts entry. Params explicitly set to null
+// are removed from the raw config and returned separately (as JSON keys).
+func parseAccountConfigRaw(buf []byte) (*ConfigRaw, []string, error) {
+	var params map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &params); err != nil {
+		return nil, nil, merry.Wrap(err)
+	}
+	var nullParams []string
+	for key, value := range params {
+		if bytes.Equal(value, []byte("null")) {
+			nullParams = append(nullParams, key)
+			delete(params, key)
+		}
+	}
+	buf, err := json.Marshal(params)
+	if err != nil {
+		return nil, nil, merry.Wrap(err)
+	}
+	raw := &ConfigRaw{}
+	if err := json.Unmarshal(buf, raw); err != nil {
+		return nil, nil, merry.Wrap(err)
+	}
+	return raw, nullParams, nil
+}
+
+// resetConfigParams sets params (specified by JSON keys of ConfigRaw) to their default values,
+// so account may, for example, disable proxy inherited from the top-level config.
+// Unknown keys are ignored (like unknown params in config itself).
+func resetConfigParams(cfg *Config, keys []string) {
+	rawType := reflect.TypeOf(ConfigRaw{})
+	cfgValue := reflect.ValueOf(cfg).Elem()
+	defaultValue := reflect.ValueOf(defaultConfig)
+	for _, key := range keys {
+		for i := 0; i < rawType.NumField(); i++ {
+			field := rawType.Field(i)
+			if field.Tag.Get("json") != key {
+				continue
+			}
+			if cfgField := cfgValue.FieldByName(field.Name); cfgField.IsValid() {
+				cfgField.Set(defaultValue.FieldByName(field.Name))
+			}
+		}
+	}
+}
+
+// applyConfigRaw overrides config params that are set in raw config.
+func applyConfigRaw(cfg *Config, raw *ConfigRaw) error {
+	var err error
+
+	if raw.AppID != 0 {
+		cfg.AppID = raw.AppID
+	}
+
+	if raw.AppHash != "" {
+		cfg.AppHash = raw.AppHash
+	}
+
+	if raw.Socks5ProxyAddr != "" {
+		cfg.Socks5ProxyAddr = raw.Socks5ProxyAddr
+	}
+
+	if raw.Socks5ProxyUser != "" {
+		cfg.Socks5ProxyUser = raw.Socks5ProxyUser
+	}
+
+	if raw.Socks5ProxyPassword != "" {
+		cfg.Socks5ProxyPassword = raw.Socks5ProxyPassword
+	}
+
+	if raw.LoginMethod != "" {
+		cfg.LoginMethod = raw.LoginMethod
+	}
+
+	if raw.LoginPhone != "" {
+		cfg.LoginPhone = raw.LoginPhone
+	}
+
+	if raw.LoginPassword != "" {
+		cfg.LoginPassword = raw.LoginPassword
+	}
+
+	if raw.LoginCode != "" {
+		cfg.LoginCode = raw.LoginCode
+	}
+
+	if raw.Name != "" {
+		cfg.Name = raw.Name
+	}
 
 	if raw.RequestIntervalMS > 0 {
 		cfg.RequestIntervalMS = raw.RequestIntervalMS
 	}
 
+	if raw.Concurrency > 0 {
+		cfg.Concurrency = raw.Concurrency
+	}
+
+	if raw.DownloadConcurrency > 0 {
+		cfg.DownloadConcurrency = raw.DownloadConcurrency
+	}
+
 	if raw.SessionFilePath != "" {
 		cfg.SessionFilePath = raw.SessionFilePath
 	}
 
+	if raw.SessionPassphrase != "" {
+		cfg.SessionPassphrase = raw.SessionPassphrase
+	}
+
 	if raw.OutDirPath != "" {
 		cfg.OutDirPath = raw.OutDirPath
 	}
 
+	if raw.Storage != "" {
+		cfg.Storage = raw.Storage
+	}
+
 	if raw.DoAccountDump != "" {
 		cfg.DoAccountDump = raw.DoAccountDump
 	}
@@ -268,34 +627,97 @@ func ParseConfig(fpath string) (*Config, error) {
 	if len(raw.History) > 0 {
 		cfg.History, err = parseConfigFilters(raw.History)
 		if err != nil {
-			return nil, merry.Wrap(err)
+			return merry.Wrap(err)
 		}
 	}
 
 	if len(raw.Stories) > 0 {
 		cfg.Stories, err = parseConfigFilters(raw.Stories)
 		if err != nil {
-			return nil, merry.Wrap(err)
+			return merry.Wrap(err)
 		}
 	}
 
 	if len(raw.Media) > 0 {
 		cfg.Media, err = parseConfigFilters(raw.Media)
 		if err != nil {
-			return nil, merry.Wrap(err)
+			return merry.Wrap(err)
+		}
+	}
+
+	if len(raw.FullInfo) > 0 {
+		cfg.FullInfo, err = parseConfigFilters(raw.FullInfo)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+	}
+
+	if len(raw.Participants) > 0 {
+		cfg.Participants, err = parseConfigFilters(raw.Participants)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+	}
+
+	if len(raw.AdminLog) > 0 {
+		cfg.AdminLog, err = parseConfigFilters(raw.AdminLog)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+	}
+
+	if len(raw.ProfilePhotos) > 0 {
+		cfg.ProfilePhotos, err = parseConfigFilters(raw.ProfilePhotos)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+	}
+
+	if len(raw.StickerSets) > 0 {
+		cfg.StickerSets, err = parseConfigFilters(raw.StickerSets)
+		if err != nil {
+			return merry.Wrap(err)
 		}
 	}
 
 	if len(raw.HistoryLimit) > 0 {
-		cfg.HistoryLimit = make(map[int32]ConfigChatFilter, len(raw.HistoryLimit))
-		for limit, rawFilter := range raw.HistoryLimit {
+		cfg.HistoryLimit = make(map[ConfigHistoryLimit]ConfigChatFilter, len(raw.HistoryLimit))
+		for limitStr, rawFilter := range raw.HistoryLimit {
+			limit, err := parseConfigHistoryLimit(limitStr)
+			if err != nil {
+				return merry.Wrap(err)
+			}
 			cfg.HistoryLimit[limit], err = parseConfigFilters(rawFilter)
 			if err != nil {
-				return nil, merry.Wrap(err)
+				return merry.Wrap(err)
 			}
 		}
 	}
-	return &cfg, nil
+
+	if len(raw.EditsRescan) > 0 {
+		cfg.EditsRescan = make(map[ConfigMessagesWindow]ConfigChatFilter, len(raw.EditsRescan))
+		for windowStr, rawFilter := range raw.EditsRescan {
+			window, err := parseConfigMessagesWindow(windowStr)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			cfg.EditsRescan[window], err = parseConfigFilters(rawFilter)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+	}
+
+	if len(raw.MetricsSnapshots) > 0 {
+		cfg.MetricsSnapshots = make(map[int32]ConfigChatFilter, len(raw.MetricsSnapshots))
+		for count, rawFilter := range raw.MetricsSnapshots {
+			cfg.MetricsSnapshots[count], err = parseConfigFilters(rawFilter)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+	}
+	return nil
 }
 
 func parseConfigFilters(buf []byte) (ConfigChatFilter, error) {
@@ -392,6 +814,13 @@ func FindUnusedChatAttrsFilters(root ConfigChatFilter, chats []*Chat, f func(Con
 	})
 }
 
+// CommentsEnabledFor checks whether comments should be dumped for chat (it must be a channel matched by config.history).
+func (c *Config) CommentsEnabledFor(chat *Chat) bool {
+	return chat.Type == ChatChannel &&
+		c.History.Match(chat, nil) == MatchTrue &&
+		MatchComments(c.History, chat) == MatchTrue
+}
+
 func CheckConfig(config *Config, chats []*Chat) {
 	FindUnusedChatAttrsFilters(config.History, chats, func(attrs ConfigChatFilterAttrs) {
 		log.Warn("no chats match history filter %v", attrs)
@@ -405,16 +834,48 @@ func CheckConfig(config *Config, chats []*Chat) {
 			log.Warn("'media_max_size' have no effect in 'config.history'")
 		}
 	})
-	TraverseConfigChatFilter(config.Stories, func(filter ConfigChatFilter) {
+	warnIneffectiveChatFilterAttrs(config.Stories, "stories")
+	TraverseConfigChatFilter(config.Media, func(filter ConfigChatFilter) {
+		if attrs, ok := filter.(ConfigChatFilterAttrs); ok && attrs.Comments != nil {
+			log.Warn("'comments' have no effect in 'config.media'")
+		}
+	})
+	warnIneffectiveChatFilterAttrs(config.FullInfo, "full_info")
+	warnIneffectiveChatFilterAttrs(config.Participants, "participants")
+	warnIneffectiveChatFilterAttrs(config.AdminLog, "admin_log")
+	warnIneffectiveChatFilterAttrs(config.ProfilePhotos, "profile_photos")
+	TraverseConfigChatFilter(config.StickerSets, func(filter ConfigChatFilter) {
 		if attrs, ok := filter.(ConfigChatFilterAttrs); ok && attrs.MediaMaxSize != nil {
-			log.Warn("'media_max_size' have no effect in 'config.stories'")
+			log.Warn("'media_max_size' have no effect in 'config.sticker_sets'")
 		}
 	})
 	for _, filter := range config.HistoryLimit {
-		TraverseConfigChatFilter(filter, func(filter ConfigChatFilter) {
-			if attrs, ok := filter.(ConfigChatFilterAttrs); ok && attrs.MediaMaxSize != nil {
-				log.Warn("'media_max_size' have no effect in 'config.history_limit'")
-			}
-		})
+		warnIneffectiveChatFilterAttrs(filter, "history_limit")
+	}
+	for _, filter := range config.EditsRescan {
+		warnIneffectiveChatFilterAttrs(filter, "edits_rescan")
+	}
+	for _, filter := range config.MetricsSnapshots {
+		warnIneffectiveChatFilterAttrs(filter, "metrics_snapshots")
 	}
 }
+
+// warnIneffectiveChatFilterAttrs warns about messages-related attrs (they are used only by history and media filters)
+// found in the `name` config section filter.
+func warnIneffectiveChatFilterAttrs(root ConfigChatFilter, name string) {
+	TraverseConfigChatFilter(root, func(filter ConfigChatFilter) {
+		attrs, ok := filter.(ConfigChatFilterAttrs)
+		if !ok {
+			return
+		}
+		if attrs.MediaMaxSize != nil {
+			log.Warn("'media_max_size' have no effect in 'config.%s'", name)
+		}
+		if attrs.Comments != nil {
+			log.Warn("'comments' have no effect in 'config.%s'", name)
+		}
+		if attrs.Topic != nil {
+			log.Warn("'topic' have no effect in 'config.%s'", name)
+		}
+	})
+}
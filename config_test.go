@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 )
@@ -42,15 +43,25 @@ func Test__ParseConfig__NoFile(t *testing.T) {
 	cfg, err := ParseConfig("blablafile")
 	assertOk(t, err)
 	assertEqual(t, cfg, &Config{
-		OutDirPath:        "history",
-		SessionFilePath:   "tg.session",
-		RequestIntervalMS: int64(1000),
-		History:           ConfigChatFilterType{Type: ChatUser},
-		Stories:           ConfigChatFilterNone{},
-		Media:             ConfigChatFilterNone{},
-		DoAccountDump:     "off",
-		DoContactsDump:    "off",
-		DoSessionsDump:    "off",
+		OutDirPath:          "history",
+		Storage:             "json",
+		SessionFilePath:     "tg.session",
+		LoginMethod:         "interactive",
+		RequestIntervalMS:   int64(1000),
+		Concurrency:         1,
+		DownloadConcurrency: 1,
+		AccountsConcurrency: 1,
+		History:             ConfigChatFilterType{Type: ChatUser},
+		Stories:             ConfigChatFilterNone{},
+		Media:               ConfigChatFilterNone{},
+		FullInfo:            ConfigChatFilterNone{},
+		Participants:        ConfigChatFilterNone{},
+		AdminLog:            ConfigChatFilterNone{},
+		ProfilePhotos:       ConfigChatFilterNone{},
+		StickerSets:         ConfigChatFilterNone{},
+		DoAccountDump:       "off",
+		DoContactsDump:      "off",
+		DoSessionsDump:      "off",
 	})
 }
 
@@ -62,22 +73,34 @@ func Test__ParseConfig__Empty(t *testing.T) {
 	cfg, err := ParseConfig(file.Name())
 	assertOk(t, err)
 	assertEqual(t, cfg, &Config{
-		OutDirPath:        "history",
-		SessionFilePath:   "tg.session",
-		RequestIntervalMS: int64(1000),
-		History:           ConfigChatFilterType{Type: ChatUser},
-		Stories:           ConfigChatFilterNone{},
-		Media:             ConfigChatFilterNone{},
-		DoAccountDump:     "off",
-		DoContactsDump:    "off",
-		DoSessionsDump:    "off",
+		OutDirPath:          "history",
+		Storage:             "json",
+		SessionFilePath:     "tg.session",
+		LoginMethod:         "interactive",
+		RequestIntervalMS:   int64(1000),
+		Concurrency:         1,
+		DownloadConcurrency: 1,
+		AccountsConcurrency: 1,
+		History:             ConfigChatFilterType{Type: ChatUser},
+		Stories:             ConfigChatFilterNone{},
+		Media:               ConfigChatFilterNone{},
+		FullInfo:            ConfigChatFilterNone{},
+		Participants:        ConfigChatFilterNone{},
+		AdminLog:            ConfigChatFilterNone{},
+		ProfilePhotos:       ConfigChatFilterNone{},
+		StickerSets:         ConfigChatFilterNone{},
+		DoAccountDump:       "off",
+		DoContactsDump:      "off",
+		DoSessionsDump:      "off",
 	})
 }
 
 func Test__ParseConfig__Some(t *testing.T) {
 	file, err := writeTestConfig(`{
 		"out_dir_path": "out",
+		"storage": "sqlite",
 		"session_file_path": "sessfile",
+		"session_passphrase": "env:TG_SESSION_PASSPHRASE",
 		"request_interval_ms": 500,
 		"history": [
 			"none",
@@ -103,9 +126,15 @@ func Test__ParseConfig__Some(t *testing.T) {
 	userType := ChatUser
 	channelType := ChatChannel
 	assertEqual(t, cfg, &Config{
-		OutDirPath:        "out",
-		SessionFilePath:   "sessfile",
-		RequestIntervalMS: 500,
+		OutDirPath:          "out",
+		Storage:             "sqlite",
+		SessionFilePath:     "sessfile",
+		SessionPassphrase:   "env:TG_SESSION_PASSPHRASE",
+		LoginMethod:         "interactive",
+		RequestIntervalMS:   500,
+		Concurrency:         1,
+		DownloadConcurrency: 1,
+		AccountsConcurrency: 1,
 		History: ConfigChatFilterMulti{Inner: []ConfigChatFilter{
 			ConfigChatFilterNone{},
 			ConfigChatFilterAttrs{ID: &id123},
@@ -121,6 +150,11 @@ func Test__ParseConfig__Some(t *testing.T) {
 		}},
 		Stories:        ConfigChatFilterNone{},
 		Media:          ConfigChatFilterNone{},
+		FullInfo:       ConfigChatFilterNone{},
+		Participants:   ConfigChatFilterNone{},
+		AdminLog:       ConfigChatFilterNone{},
+		ProfilePhotos:  ConfigChatFilterNone{},
+		StickerSets:    ConfigChatFilterNone{},
 		DoAccountDump:  "off",
 		DoContactsDump: "yes",
 		DoSessionsDump: "off",
@@ -147,6 +181,99 @@ func Test__ParseConfig__Int64ID(t *testing.T) {
 	}})
 }
 
+func Test__ParseConfig__Accounts(t *testing.T) {
+	file, err := writeTestConfig(`{
+		"app_id": 123,
+		"app_hash": "abc",
+		"history": "all",
+		"request_interval_ms": 500,
+		"accounts_concurrency": 2,
+		"accounts": [
+			{"name": "work", "session_file_path": "work.session", "out_dir_path": "history_work"},
+			{"session_file_path": "home.session", "out_dir_path": "history_home", "history": "none", "socks5_proxy_addr": "127.0.0.1:1080"}
+		]
+	}`)
+	defer removeTestConfig(file)
+	assertOk(t, err)
+
+	cfg, err := ParseConfig(file.Name())
+	assertOk(t, err)
+	assertEqual(t, cfg.AccountsConcurrency, int64(2))
+	accounts := cfg.AccountConfigs()
+	assertEqual(t, len(accounts), 2)
+
+	assertEqual(t, accounts[0].Name, "work")
+	assertEqual(t, accounts[0].AppID, int32(123))
+	assertEqual(t, accounts[0].AppHash, "abc")
+	assertEqual(t, accounts[0].RequestIntervalMS, int64(500))
+	assertEqual(t, accounts[0].SessionFilePath, "work.session")
+	assertEqual(t, accounts[0].OutDirPath, "history_work")
+	assertEqual(t, accounts[0].History, ConfigChatFilter(ConfigChatFilterAll{}))
+	assertEqual(t, accounts[0].Socks5ProxyAddr, "")
+
+	assertEqual(t, accounts[1].Name, "history_home")
+	assertEqual(t, accounts[1].AppID, int32(123))
+	assertEqual(t, accounts[1].History, ConfigChatFilter(ConfigChatFilterNone{}))
+	assertEqual(t, accounts[1].Socks5ProxyAddr, "127.0.0.1:1080")
+}
+
+func Test__ParseConfig__AccountsSameOutDir(t *testing.T) {
+	file, err := writeTestConfig(`{
+		"accounts": [
+			{"name": "a", "session_file_path": "a.session"},
+			{"name": "b", "session_file_path": "b.session"}
+		]
+	}`)
+	defer removeTestConfig(file)
+	assertOk(t, err)
+
+	_, err = ParseConfig(file.Name())
+	if err == nil {
+		t.Fatal("expected error for accounts with the same out_dir_path")
+	}
+}
+
+func Test__ParseConfig__AccountsSameName(t *testing.T) {
+	file, err := writeTestConfig(`{
+		"accounts": [
+			{"name": "a", "session_file_path": "a.session", "out_dir_path": "history_a"},
+			{"name": "a", "session_file_path": "b.session", "out_dir_path": "history_b"}
+		]
+	}`)
+	defer removeTestConfig(file)
+	assertOk(t, err)
+
+	_, err = ParseConfig(file.Name())
+	if err == nil {
+		t.Fatal("expected error for accounts with the same name")
+	}
+}
+
+func Test__ParseConfig__AccountsNullParams(t *testing.T) {
+	file, err := writeTestConfig(`{
+		"socks5_proxy_addr": "127.0.0.1:1080",
+		"login_method": "qr",
+		"media": "all",
+		"accounts": [
+			{"name": "a", "session_file_path": "a.session", "out_dir_path": "history_a"},
+			{"name": "b", "session_file_path": "b.session", "out_dir_path": "history_b",
+				"socks5_proxy_addr": null, "login_method": null, "media": null}
+		]
+	}`)
+	defer removeTestConfig(file)
+	assertOk(t, err)
+
+	cfg, err := ParseConfig(file.Name())
+	assertOk(t, err)
+	accounts := cfg.AccountConfigs()
+	assertEqual(t, accounts[0].Socks5ProxyAddr, "127.0.0.1:1080")
+	assertEqual(t, accounts[0].LoginMethod, "qr")
+	assertEqual(t, accounts[0].Media, ConfigChatFilter(ConfigChatFilterAll{}))
+	assertEqual(t, accounts[1].Socks5ProxyAddr, "")
+	assertEqual(t, accounts[1].LoginMethod, "interactive")
+	assertEqual(t, accounts[1].Media, ConfigChatFilter(ConfigChatFilterNone{}))
+}
+
 func Test__ConfigChatFilter(t *testing.T) {
 	var f ConfigChatFilter
 	id123 := int64(123)
@@ -193,6 +320,69 @@ func Test__ConfigChatFilter(t *testing.T) {
 	assertEqual(t, f.Match(&Chat{ID: 12}, &TGFileInfo{Size: 512 * 1024}), MatchUndefined)
 }
 
+func Test__MatchComments(t *testing.T) {
+	id1 := int64(1)
+	id2 := int64(2)
+	yes := true
+	no := false
+	channelType := ChatChannel
+
+	f := ConfigChatFilterMulti{[]ConfigChatFilter{
+		ConfigChatFilterAll{},
+		ConfigChatFilterAttrs{Type: &channelType, Comments: &yes},
+		ConfigChatFilterAttrs{ID: &id1, Comments: &no},
+		ConfigChatFilterExclude{ConfigChatFilterAttrs{ID: &id2}},
+	}}
+	assertEqual(t, MatchComments(f, &Chat{ID: 3, Type: ChatChannel}), MatchTrue)
+	assertEqual(t, MatchComments(f, &Chat{ID: 3, Type: ChatGroup}), MatchUndefined)
+	assertEqual(t, MatchComments(f, &Chat{ID: 1, Type: ChatChannel}), MatchFalse)
+	assertEqual(t, MatchComments(f, &Chat{ID: 2, Type: ChatChannel}), MatchFalse)
+
+	cfg := &Config{History: f}
+	assertEqual(t, cfg.CommentsEnabledFor(&Chat{ID: 3, Type: ChatChannel}), true)
+	assertEqual(t, cfg.CommentsEnabledFor(&Chat{ID: 2, Type: ChatChannel}), false)
+	assertEqual(t, cfg.CommentsEnabledFor(&Chat{ID: 3, Type: ChatGroup}), false)
+}
+
+func Test__ConfigChatFilter__Topic(t *testing.T) {
+	id1 := int64(1)
+	topic5 := int32(5)
+	topic7 := int32(7)
+
+	f := ConfigChatFilterMulti{[]ConfigChatFilter{
+		ConfigChatFilterAttrs{ID: &id1},
+		ConfigChatFilterExclude{ConfigChatFilterAttrs{ID: &id1, Topic: &topic7}},
+	}}
+	assertEqual(t, f.Match(&Chat{ID: 1}, nil), MatchTrue)
+	assertEqual(t, f.Match((&Chat{ID: 1}).WithTopic(5), nil), MatchTrue)
+	assertEqual(t, f.Match((&Chat{ID: 1}).WithTopic(7), nil), MatchFalse)
+
+	f = ConfigChatFilterMulti{[]ConfigChatFilter{
+		ConfigChatFilterAttrs{ID: &id1, Topic: &topic5},
+	}}
+	assertEqual(t, f.Match(&Chat{ID: 1}, nil), MatchTrue)
+	assertEqual(t, f.Match((&Chat{ID: 1}).WithTopic(5), nil), MatchTrue)
+	assertEqual(t, f.Match((&Chat{ID: 1}).WithTopic(7), nil), MatchUndefined)
+}
+
+func Test__ConfigChatFilter__FolderArchived(t *testing.T) {
+	file, err := writeTestConfig(`{
+		"history": [
+			{"folder": "Work"},
+			{"exclude": {"archived": true}}
+		]
+	}`)
+	defer removeTestConfig(file)
+	assertOk(t, err)
+
+	cfg, err := ParseConfig(file.Name())
+	assertOk(t, err)
+	assertEqual(t, cfg.History.Match(&Chat{Folders: []string{"Personal", "Work"}}, nil), MatchTrue)
+	assertEqual(t, cfg.History.Match(&Chat{Folders: []string{"Work"}, Archived: true}, nil), MatchFalse)
+	assertEqual(t, cfg.History.Match(&Chat{Folders: []string{"Personal"}}, nil), MatchUndefined)
+	assertEqual(t, cfg.History.Match(&Chat{}, nil), MatchUndefined)
+}
+
 func Test__ConfigChatHistoryLimit__For(t *testing.T) {
 	id1 := int64(1)
 	id2 := int64(2)
@@ -208,3 +398,83 @@ func Test__ConfigChatHistoryLimit__For(t *testing.T) {
 	assertEqual(t, l.For(&Chat{ID: 2}), int32(2000))
 	assertEqual(t, l.For(&Chat{ID: 3}), int32(0))
 }
+
+func Test__ParseConfig__HistoryLimit(t *testing.T) {
+	file, err := writeTestConfig(`{
+		"history_limit": {
+			"5000": {"type": "group"},
+			"90d": {"type": "channel"},
+			"2023-01-01": {"type": "user"}
+		}
+	}`)
+	defer removeTestConfig(file)
+	assertOk(t, err)
+
+	cfg, err := ParseConfig(file.Name())
+	assertOk(t, err)
+	groupType := ChatGroup
+	channelType := ChatChannel
+	userType := ChatUser
+	since := time.Date(2023, 1, 1, 0, 0, 0, 0, time.Local).Unix()
+	assertEqual(t, cfg.HistoryLimit, ConfigChatHistoryLimits{
+		{Count: 5000}:  ConfigChatFilterAttrs{Type: &groupType},
+		{Days: 90}:     ConfigChatFilterAttrs{Type: &channelType},
+		{Since: since}: ConfigChatFilterAttrs{Type: &userType},
+	})
+}
+
+func Test__ConfigChatHistoryLimits__For(t *testing.T) {
+	id1 := int64(1)
+	id2 := int64(2)
+	since1 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	since2 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+	var l ConfigChatHistoryLimits = map[ConfigHistoryLimit]ConfigChatFilter{
+		{Count: 1000}:   ConfigChatFilterAttrs{ID: &id1},
+		{Days: 30}:      ConfigChatFilterAttrs{ID: &id2},
+		{Since: since1}: ConfigChatFilterAttrs{ID: &id2},
+		{Since: since2}: ConfigChatFilterAttrs{ID: &id2},
+	}
+	assertEqual(t, l.For(&Chat{ID: 1}), ConfigHistoryLimit{Count: 1000})
+	assertEqual(t, l.For(&Chat{ID: 2}), ConfigHistoryLimit{Days: 30, Since: since2})
+	assertEqual(t, l.For(&Chat{ID: 3}).IsEmpty(), true)
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	assertEqual(t, l.For(&Chat{ID: 1}).StartDate(now).IsZero(), true)
+	assertEqual(t, l.For(&Chat{ID: 2}).StartDate(now), now.AddDate(0, 0, -30))
+	assertEqual(t, ConfigHistoryLimit{Days: 365, Since: since2}.StartDate(now).Unix(), since2)
+}
+
+func Test__ParseConfig__EditsRescan(t *testing.T) {
+	file, err := writeTestConfig(`{
+		"edits_rescan": {
+			"500": {"type": "group"},
+			"7d": {"type": "channel"}
+		}
+	}`)
+	defer removeTestConfig(file)
+	assertOk(t, err)
+
+	cfg, err := ParseConfig(file.Name())
+	assertOk(t, err)
+	groupType := ChatGroup
+	channelType := ChatChannel
+	assertEqual(t, cfg.EditsRescan, ConfigChatMessagesWindows{
+		{Count: 500}: ConfigChatFilterAttrs{Type: &groupType},
+		{Days: 7}:    ConfigChatFilterAttrs{Type: &channelType},
+	})
+}
+
+func Test__ConfigChatMessagesWindows__For(t *testing.T) {
+	id1 := int64(1)
+	id2 := int64(2)
+
+	var l ConfigChatMessagesWindows = map[ConfigMessagesWindow]ConfigChatFilter{
+		{Count: 100}: ConfigChatFilterAttrs{ID: &id1},
+		{Count: 500}: ConfigChatFilterAll{},
+		{Days: 7}:    ConfigChatFilterAttrs{ID: &id2},
+	}
+	assertEqual(t, l.For(&Chat{ID: 1}), ConfigMessagesWindow{Count: 100})
+	assertEqual(t, l.For(&Chat{ID: 2}), ConfigMessagesWindow{Count: 500, Days: 7})
+	assertEqual(t, ConfigChatMessagesWindows(nil).For(&Chat{ID: 3}).IsEmpty(), true)
+}
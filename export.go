@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/ansel1/merry/v2"
+)
+
+const ExportTDesktop = "tdesktop"
+
+// text used by Telegram Desktop for media files that were not downloaded
+const tdesktopFileNotIncluded = "(File not included. Change data exporting settings to download.)"
+
+// TDesktopMessage is a message in Telegram Desktop export format (result.json).
+type TDesktopMessage struct {
+	ID               int32                `json:"id"`
+	Type             string               `json:"type"`
+	Date             string               `json:"date"`
+	DateUnixtime     string               `json:"date_unixtime"`
+	Edited           string               `json:"edited,omitempty"`
+	EditedUnixtime   string               `json:"edited_unixtime,omitempty"`
+	Actor            string               `json:"actor,omitempty"`
+	ActorID          string               `json:"actor_id,omitempty"`
+	Action           string               `json:"action,omitempty"`
+	Title            string               `json:"title,omitempty"`
+	Members          []string             `json:"members,omitempty"`
+	MessageID        int32                `json:"message_id,omitempty"`
+	DiscardReason    string               `json:"discard_reason,omitempty"`
+	From             *string              `json:"from,omitempty"`
+	FromID           string               `json:"from_id,omitempty"`
+	ForwardedFrom    string               `json:"forwarded_from,omitempty"`
+	ReplyToMessageID int32                `json:"reply_to_message_id,omitempty"`
+	Photo            string               `json:"photo,omitempty"`
+	Width            int32                `json:"width,omitempty"`
+	Height           int32                `json:"height,omitempty"`
+	File             string               `json:"file,omitempty"`
+	FileName         string               `json:"file_name,omitempty"`
+	MediaType        string               `json:"media_type,omitempty"`
+	StickerEmoji     string               `json:"sticker_emoji,omitempty"`
+	MimeType         string               `json:"mime_type,omitempty"`
+	DurationSeconds  int32                `json:"duration_seconds,omitempty"`
+	Text             interface{}          `json:"text"`
+	TextEntities     []TDesktopTextEntity `json:"text_entities"`
+}
+
+type TDesktopTextEntity struct {
+	Type       string `json:"type"`
+	Text       string `json:"text"`
+	Href       string `json:"href,omitempty"`
+	UserID     int64  `json:"user_id,omitempty"`
+	Language   string `json:"language,omitempty"`
+	DocumentID string `json:"document_id,omitempty"`
+	Collapsed  bool   `json:"collapsed,omitempty"`
+}
+
+// TDesktopExporter converts saved chats to Telegram Desktop export format:
+// <out_dir_path>/export/tdesktop/<id>_<title>/result.json (with media paths pointing to <out_dir_path>/files).
+type TDesktopExporter struct {
+	saver      *JSONFilesHistorySaver
+	userReader *ChatCachedReader[UserData]
+	chatReader *ChatCachedReader[ChatData]
+}
+
+func NewTDesktopExporter(saver *JSONFilesHistorySaver) *TDesktopExporter {
+	return &TDesktopExporter{
+		saver:      saver,
+		userReader: &ChatCachedReader[UserData]{reader: NewChatSyncReader[UserData](saver.usersFPath())},
+		chatReader: &ChatCachedReader[ChatData]{reader: NewChatSyncReader[ChatData](saver.chatsFPath())},
+	}
+}
+
+func (e *TDesktopExporter) exportDirpath() string {
+	return e.saver.Dirpath + "/export/" + ExportTDesktop
+}
+
+func (e *TDesktopExporter) ExportAll() error {
+	if err := e.userReader.reader.UpdateOffsets(); err != nil {
+		return merry.Wrap(err)
+	}
+	if err := e.chatReader.reader.UpdateOffsets(); err != nil {
+		return merry.Wrap(err)
+	}
+
+	chatEntries, err := e.saver.ReadSavedChatsList()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	for _, chatEntry := range chatEntries {
+		if err := checkInterrupted(); err != nil {
+			return merry.Wrap(err)
+		}
+		if err := e.ExportChat(chatEntry); err != nil {
+			return merry.Prependf(err, "chat #%d", chatEntry.ID)
+		}
+	}
+	log.Info("exported %d chat(s) to %s", len(chatEntries), e.exportDirpath())
+	return nil
+}
+
+func (e *TDesktopExporter) ExportChat(chatEntry SavedChatEntry) error {
+	user, err := e.userReader.ReadOpt(chatEntry.ID)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	chat, err := e.chatReader.ReadOpt(chatEntry.ID)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	dirpath := e.exportDirpath() + "/" + chatEntry.FName
+	if err := os.MkdirAll(dirpath, 0700); err != nil {
+		return merry.Wrap(err)
+	}
+	files, err := e.saver.ReadSavedChatFilesList(chatEntry.ID, MessageMediaFile)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	filesByID := make(map[int64][]SavedFilesEntry)
+	for _, file := range files {
+		filesByID[file.MessageID] = append(filesByID[file.MessageID], file)
+	}
+	for _, files := range filesByID {
+		sort.Slice(files, func(i, j int) bool { return files[i].IndexInMessage < files[j].IndexInMessage })
+	}
+
+	reader := NewJSONMessageReader(chatEntry.FPath)
+	const chunkSize = 1000
+	messages, hasMore, err := reader.Read(0, chunkSize)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	file, err := os.Create(dirpath + "/result.json.temp")
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+
+	name := chatEntry.FSTitle
+	if user != nil {
+		name = tdesktopUserName(user)
+	} else if chat != nil {
+		name = chat.Title
+	}
+	nameJSON, err := json.Marshal(name)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	// "messages" are written in chunks, so the header is written manually
+	fmt.Fprintf(w, "{\n \"name\": %s,\n \"type\": \"%s\",\n \"id\": %d,\n \"messages\": [",
+		nameJSON, tdesktopChatType(user, chat, messages), chatEntry.ID)
+
+	count := 0
+	offset := 0
+	for {
+		for _, msg := range messages {
+			if msg["_"] == "TL_messageEmpty" {
+				continue //placeholder of deleted or skipped message
+			}
+			tdMsg, err := e.convertMessage(msg, chatEntry, user, chat, filesByID, dirpath)
+			if err != nil {
+				return merry.Prependf(err, "message #%v", msg["ID"])
+			}
+			buf, err := json.MarshalIndent(tdMsg, "  ", " ")
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			if count > 0 {
+				w.WriteString(",")
+			}
+			w.WriteString("\n  ")
+			w.Write(buf)
+			count += 1
+		}
+		if !hasMore {
+			break
+		}
+		offset += len(messages)
+		messages, hasMore, err = reader.Read(offset, chunkSize)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	w.WriteString("\n ]\n}\n")
+
+	if err := w.Flush(); err != nil {
+		return merry.Wrap(err)
+	}
+	if err := file.Close(); err != nil {
+		return merry.Wrap(err)
+	}
+	if err := os.Rename(dirpath+"/result.json.temp", dirpath+"/result.json"); err != nil {
+		return merry.Wrap(err)
+	}
+	log.Debug("exported %s: %d message(s)", chatEntry.FName, count)
+	return nil
+}
+
+func (e *TDesktopExporter) convertMessage(
+	msg map[string]interface{}, chatEntry SavedChatEntry, user *UserData, chat *ChatData,
+	filesByID map[int64][]SavedFilesEntry, dirpath string,
+) (*TDesktopMessage, error) {
+	res := &TDesktopMessage{ID: int32(mapInt64(msg["ID"])), TextEntities: []TDesktopTextEntity{}, Text: ""}
+	res.Date, res.DateUnixtime = tdesktopDate(msg["Date"])
+	if editDate, ok := msg["EditDate"]; ok && editDate != nil && mapInt64(editDate) != 0 {
+		res.Edited, res.EditedUnixtime = tdesktopDate(editDate)
+	}
+
+	fromName, fromID, err := e.messageSender(msg, chatEntry, user, chat)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	if msg["_"] == "TL_messageService" {
+		res.Type = "service"
+		res.Actor, res.ActorID = fromName, fromID
+		action, _ := msg["Action"].(map[string]interface{})
+		if err := e.convertAction(res, msg, action); err != nil {
+			return nil, merry.Wrap(err)
+		}
+		return res, nil
+	}
+
+	res.Type = "message"
+	res.From, res.FromID = &fromName, fromID
+	if fwdFrom, ok := msg["FwdFrom"].(map[string]interface{}); ok {
+		if name, ok := fwdFrom["FromName"].(string); ok {
+			res.ForwardedFrom = name
+		} else if peer, ok := fwdFrom["FromID"].(map[string]interface{}); ok {
+			res.ForwardedFrom, _, err = e.peerName(peer)
+			if err != nil {
+				return nil, merry.Wrap(err)
+			}
+		}
+	}
+	if replyTo, ok := msg["ReplyTo"].(map[string]interface{}); ok && replyTo["ReplyToMsgID"] != nil {
+		res.ReplyToMessageID = int32(mapInt64(replyTo["ReplyToMsgID"]))
+	}
+	if media, ok := msg["Media"].(map[string]interface{}); ok {
+		e.convertMedia(res, media, filesByID[int64(res.ID)], dirpath)
+	}
+	if text, ok := msg["Message"].(string); ok {
+		entities, _ := msg["Entities"].([]interface{})
+		res.TextEntities = tdesktopTextEntities(text, entities)
+		res.Text = tdesktopText(res.TextEntities)
+	}
+	return res, nil
+}
+
+func (e *TDesktopExporter) convertMedia(res *TDesktopMessage, media map[string]interface{}, files []SavedFilesEntry, dirpath string) {
+	var fpath string
+	for _, file := range files {
+		if !strings.HasSuffix(file.FName, videoCoverFileSuffix) {
+			rel, err := filepath.Rel(dirpath, file.FPath)
+			if err == nil {
+				fpath = filepath.ToSlash(rel)
+				break
+			}
+		}
+	}
+	if fpath == "" {
+		fpath = tdesktopFileNotIncluded
+	}
+
+	switch media["_"] {
+	case "TL_messageMediaPhoto":
+		photo, ok := media["Photo"].(map[string]interface{})
+		if !ok || photo["_"] != "TL_photo" {
+			return
+		}
+		res.Photo = fpath
+		sizes, _ := photo["Sizes"].([]interface{})
+		for _, sizeAny := range sizes {
+			if size, ok := sizeAny.(map[string]interface{}); ok && size["W"] != nil {
+				w, h := int32(mapInt64(size["W"])), int32(mapInt64(size["H"]))
+				if w*h > res.Width*res.Height {
+					res.Width, res.Height = w, h
+				}
+			}
+		}
+	case "TL_messageMediaDocument":
+		doc, ok := media["Document"].(map[string]interface{})
+		if !ok || doc["_"] != "TL_document" {
+			return
+		}
+		res.File = fpath
+		res.MimeType, _ = doc["MIMEType"].(string)
+		isAnimated := false
+		attrs, _ := doc["Attributes"].([]interface{})
+		for _, attrAny := range attrs {
+			attr, ok := attrAny.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch attr["_"] {
+			case "TL_documentAttributeFilename":
+				res.FileName, _ = attr["FileName"].(string)
+			case "TL_documentAttributeSticker":
+				res.MediaType = "sticker"
+				res.StickerEmoji, _ = attr["Alt"].(string)
+			case "TL_documentAttributeAnimated":
+				isAnimated = true
+			case "TL_documentAttributeVideo":
+				if res.MediaType == "" {
+					res.MediaType = "video_file"
+					if attr["RoundMessage"] == true {
+						res.MediaType = "video_message"
+					}
+				}
+				res.DurationSeconds = int32(mapFloat64(attr["Duration"]))
+				res.Width, res.Height = int32(mapInt64(attr["W"])), int32(mapInt64(attr["H"]))
+			case "TL_documentAttributeAudio":
+				if res.MediaType == "" {
+					res.MediaType = "audio_file"
+					if attr["Voice"] == true {
+						res.MediaType = "voice_message"
+					}
+				}
+				res.DurationSeconds = int32(mapInt64(attr["Duration"]))
+			case "TL_documentAttributeImageSize":
+				res.Width, res.Height = int32(mapInt64(attr["W"])), int32(mapInt64(attr["H"]))
+			}
+		}
+		// GIFs are sent as videos with an extra "animated" attribute
+		if isAnimated && (res.MediaType == "" || res.MediaType == "video_file") {
+			res.MediaType = "animation"
+		}
+	}
+}
+
+func (e *TDesktopExporter) convertAction(res *TDesktopMessage, msg map[string]interface{}, action map[string]interface{}) error {
+	actionType, _ := action["_"].(string)
+	usersNames := func(ids []interface{}) ([]string, error) {
+		names := make([]string, 0, len(ids))
+		for _, id := range ids {
+			name, _, err := e.peerName(map[string]interface{}{"_": "TL_peerUser", "UserID": id})
+			if err != nil {
+				return nil, merry.Wrap(err)
+			}
+			names = append(names, name)
+		}
+		return names, nil
+	}
+
+	var err error
+	switch actionType {
+	case "TL_messageActionChatCreate":
+		res.Action = "create_group"
+		res.Title, _ = action["Title"].(string)
+		users, _ := action["Users"].([]interface{})
+		res.Members, err = usersNames(users)
+	case "TL_messageActionChannelCreate":
+		res.Action = "create_channel"
+		res.Title, _ = action["Title"].(string)
+	case "TL_messageActionChatEditTitle":
+		res.Action = "edit_group_title"
+		res.Title, _ = action["Title"].(string)
+	case "TL_messageActionChatEditPhoto":
+		res.Action = "edit_group_photo"
+	case "TL_messageActionChatDeletePhoto":
+		res.Action = "delete_group_photo"
+	case "TL_messageActionChatAddUser":
+		res.Action = "invite_members"
+		users, _ := action["Users"].([]interface{})
+		res.Members, err = usersNames(users)
+	case "TL_messageActionChatDeleteUser":
+		res.Action = "remove_members"
+		res.Members, err = usersNames([]interface{}{action["UserID"]})
+	case "TL_messageActionChatJoinedByLink", "TL_messageActionChatJoinedByRequest":
+		res.Action = "join_group_by_link"
+	case "TL_messageActionChatMigrateTo":
+		res.Action = "migrate_to_supergroup"
+	case "TL_messageActionChannelMigrateFrom":
+		res.Action = "migrate_from_group"
+		res.Title, _ = action["Title"].(string)
+	case "TL_messageActionPinMessage":
+		res.Action = "pin_message"
+		if replyTo, ok := msg["ReplyTo"].(map[string]interface{}); ok && replyTo["ReplyToMsgID"] != nil {
+			res.MessageID = int32(mapInt64(replyTo["ReplyToMsgID"]))
+		}
+	case "TL_messageActionHistoryClear":
+		res.Action = "clear_history"
+	case "TL_messageActionPhoneCall":
+		res.Action = "phone_call"
+		if action["Duration"] != nil {
+			res.DurationSeconds = int32(mapInt64(action["Duration"]))
+		}
+		if reason, ok := action["Reason"].(map[string]interface{}); ok {
+			// TL_phoneCallDiscardReasonMissed -> "missed"
+			res.DiscardReason = strings.ToLower(strings.TrimPrefix(reason["_"].(string), "TL_phoneCallDiscardReason"))
+		}
+	case "TL_messageActionGroupCall":
+		res.Action = "group_call"
+		if action["Duration"] != nil {
+			res.DurationSeconds = int32(mapInt64(action["Duration"]))
+		}
+	case "TL_messageActionScreenshotTaken":
+		res.Action = "take_screenshot"
+	case "TL_messageActionContactSignUp":
+		res.Action = "joined_telegram"
+	case "TL_messageActionTopicCreate":
+		res.Action = "topic_created"
+		res.Title, _ = action["Title"].(string)
+	default:
+		// TL_messageActionSomeThing -> "some_thing"
+		res.Action = toSnakeCase(strings.TrimPrefix(actionType, "TL_messageAction"))
+	}
+	return merry.Wrap(err)
+}
+
+// messageSender returns sender name and Desktop-style ID ("user123", "channel123").
+func (e *TDesktopExporter) messageSender(msg map[string]interface{}, chatEntry SavedChatEntry, user *UserData, chat *ChatData) (string, string, error) {
+	if user != nil && msg["Out"] != true {
+		// other's message in a dialog
+		return tdesktopUserName(user), "user" + strconv.FormatInt(user.ID, 10), nil
+	}
+	if fromID, ok := msg["FromID"].(map[string]interface{}); ok {
+		return e.peerName(fromID)
+	}
+	if chat != nil {
+		// channel post
+		prefix := "chat"
+		if chat.IsChannel {
+			prefix = "channel"
+		}
+		return chat.Title, prefix + strconv.FormatInt(chat.ID, 10), nil
+	}
+	if peerID, ok := msg["PeerID"].(map[string]interface{}); ok {
+		return e.peerName(peerID)
+	}
+	return chatEntry.FSTitle, "", nil
+}
+
+func (e *TDesktopExporter) peerName(peer map[string]interface{}) (string, string, error) {
+	switch peer["_"] {
+	case "TL_peerUser":
+		id := mapInt64(peer["UserID"])
+		user, err := e.userReader.ReadOpt(id)
+		if err != nil {
+			return "", "", merry.Wrap(err)
+		}
+		name := ""
+		if user != nil {
+			name = tdesktopUserName(user)
+		}
+		return name, "user" + strconv.FormatInt(id, 10), nil
+	case "TL_peerChat", "TL_peerChannel":
+		idKey, prefix := "ChatID", "chat"
+		if peer["_"] == "TL_peerChannel" {
+			idKey, prefix = "ChannelID", "channel"
+		}
+		id := mapInt64(peer[idKey])
+		chat, err := e.chatReader.ReadOpt(id)
+		if err != nil {
+			return "", "", merry.Wrap(err)
+		}
+		name := ""
+		if chat != nil {
+			name = chat.Title
+		}
+		return name, prefix + strconv.FormatInt(id, 10), nil
+	}
+	return "", "", nil
+}
+
+func tdesktopUserName(user *UserData) string {
+	if user.IsDeleted {
+		return "Deleted Account"
+	}
+	return strings.TrimSpace(derefOr(user.FirstName, "") + " " + derefOr(user.LastName, ""))
+}
+
+// tdesktopChatType guesses chat type, channels and supergroups are distinguished by posts among the first messages.
+func tdesktopChatType(user *UserData, chat *ChatData, firstMessages []map[string]interface{}) string {
+	switch {
+	case user != nil && user.IsBot:
+		return "bot_chat"
+	case user != nil:
+		return "personal_chat"
+	case chat != nil && chat.IsChannel:
+		visibility := "private"
+		if chat.Username != nil && *chat.Username != "" {
+			visibility = "public"
+		}
+		for _, msg := range firstMessages {
+			if msg["Post"] == true {
+				return visibility + "_channel"
+			}
+		}
+		return visibility + "_supergroup"
+	default:
+		return "private_group"
+	}
+}
+
+// Desktop uses local time without zone
+func tdesktopDate(dateAny interface{}) (string, string) {
+	unix := mapInt64(dateAny)
+	return time.Unix(unix, 0).Format("2006-01-02T15:04:05"), strconv.FormatInt(unix, 10)
+}
+
+var tdesktopEntityTypes = map[string]string{
+	"TL_messageEntityUnknown":     "unknown",
+	"TL_messageEntityMention":     "mention",
+	"TL_messageEntityHashtag":     "hashtag",
+	"TL_messageEntityBotCommand":  "bot_command",
+	"TL_messageEntityUrl":         "link", // type name before v0.167.0
+	"TL_messageEntityURL":         "link",
+	"TL_messageEntityEmail":       "email",
+	"TL_messageEntityBold":        "bold",
+	"TL_messageEntityItalic":      "italic",
+	"TL_messageEntityCode":        "code",
+	"TL_messageEntityPre":         "pre",
+	"TL_messageEntityTextUrl":     "text_link", // type name before v0.167.0
+	"TL_messageEntityTextURL":     "text_link",
+	"TL_messageEntityMentionName": "mention_name",
+	"TL_messageEntityPhone":       "phone",
+	"TL_messageEntityCashtag":     "cashtag",
+	"TL_messageEntityUnderline":   "underline",
+	"TL_messageEntityStrike":      "strikethrough",
+	"TL_messageEntityBlockquote":  "blockquote",
+	"TL_messageEntityBankCard":    "bank_card",
+	"TL_messageEntitySpoiler":     "spoiler",
+	"TL_messageEntityCustomEmoji": "custom_emoji",
+}
+
+// tdesktopTextEntities splits text into sequential parts like Telegram Desktop does:
+// plain text between entities becomes "plain" parts, nested and overlapping entities are skipped.
+func tdesktopTextEntities(strText string, entities []interface{}) []TDesktopTextEntity {
+	text := utf16.Encode([]rune(strText))
+	parts := []TDesktopTextEntity{}
+	if len(text) == 0 {
+		return parts
+	}
+
+	type entity struct {
+		offset, length int
+		attrs          map[string]interface{}
+	}
+	var ents []entity
+	for _, entAny := range entities {
+		if ent, ok := entAny.(map[string]interface{}); ok {
+			ents = append(ents, entity{int(mapInt64(ent["Offset"])), int(mapInt64(ent["Length"])), ent})
+		}
+	}
+	sort.SliceStable(ents, func(i, j int) bool { return ents[i].offset < ents[j].offset })
+
+	substr := func(start, end int) string {
+		return string(utf16.Decode(text[start:end]))
+	}
+	pos := 0
+	for _, ent := range ents {
+		if ent.offset < pos || ent.offset >= len(text) || ent.length <= 0 {
+			continue
+		}
+		end := min(ent.offset+ent.length, len(text))
+		if ent.offset > pos {
+			parts = append(parts, TDesktopTextEntity{Type: "plain", Text: substr(pos, ent.offset)})
+		}
+
+		part := TDesktopTextEntity{Type: "unknown", Text: substr(ent.offset, end)}
+		entType, _ := ent.attrs["_"].(string)
+		if t, ok := tdesktopEntityTypes[entType]; ok {
+			part.Type = t
+		}
+		switch part.Type {
+		case "pre":
+			part.Language, _ = ent.attrs["Language"].(string)
+		case "text_link":
+			if u, ok := ent.attrs["Url"].(string); ok { // field name before v0.167.0
+				part.Href = u
+			} else {
+				part.Href, _ = ent.attrs["URL"].(string)
+			}
+		case "mention_name":
+			part.UserID = mapInt64(ent.attrs["UserID"])
+		case "custom_emoji":
+			part.DocumentID = strconv.FormatInt(mapInt64(ent.attrs["DocumentID"]), 10)
+		case "blockquote":
+			part.Collapsed = ent.attrs["Collapsed"] == true
+		}
+		parts = append(parts, part)
+		pos = end
+	}
+	if pos < len(text) {
+		parts = append(parts, TDesktopTextEntity{Type: "plain", Text: substr(pos, len(text))})
+	}
+	return parts
+}
+
+// tdesktopText returns "text" field value: a string for plain text, an array of strings and entities otherwise.
+func tdesktopText(parts []TDesktopTextEntity) interface{} {
+	if len(parts) == 0 {
+		return ""
+	}
+	if len(parts) == 1 && parts[0].Type == "plain" {
+		return parts[0].Text
+	}
+	res := make([]interface{}, len(parts))
+	for i, part := range parts {
+		if part.Type == "plain" {
+			res[i] = part.Text
+		} else {
+			res[i] = part
+		}
+	}
+	return res
+}
+
+// mapInt64 reads integer from message map (int64 values are saved as strings, see tgObjToMap()).
+func mapInt64(val interface{}) int64 {
+	switch v := val.(type) {
+	case float64:
+		return int64(v)
+	case string:
+		res, _ := strconv.ParseInt(v, 10, 64)
+		return res
+	}
+	return 0
+}
+
+func mapFloat64(val interface{}) float64 {
+	if v, ok := val.(float64); ok {
+		return v
+	}
+	return float64(mapInt64(val))
+}
+
+// "ChatEditTitle" -> "chat_edit_title"
+func toSnakeCase(name string) string {
+	var buf strings.Builder
+	for i, c := range name {
+		if 'A' <= c && c <= 'Z' {
+			if i > 0 {
+				buf.WriteByte('_')
+			}
+			c += 'a' - 'A'
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+// exportDump converts saved dump (without connecting to Telegram) to another format.
+func exportDump(config *Config, format string) error {
+	saver := NewJSONFilesHistorySaver(config.OutDirPath)
+	switch format {
+	case ExportTDesktop:
+		return merry.Wrap(NewTDesktopExporter(saver).ExportAll())
+	default:
+		return merry.Errorf("unknown export format '%s', expected '%s'", format, ExportTDesktop)
+	}
+}
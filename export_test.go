@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/3bl3gamer/tgclient/mtproto"
+)
+
+func TestTDesktopExporter(t *testing.T) {
+	prevLog := log
+	log = mtproto.Logger{Hnd: mtproto.NoopLogHandler{}}
+	t.Cleanup(func() { log = prevLog })
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+	chat := &Chat{ID: 5, Title: "Bob", Type: ChatUser}
+	bob, smith := "Bob", "Smith"
+	if err := saver.SaveRelatedUsers([]mtproto.TL{mtproto.TL_user{ID: 5, FirstName: &bob, LastName: &smith}}); err != nil {
+		t.Fatal(err)
+	}
+	replyTo := int32(1)
+	err := saver.SaveMessages(chat, []mtproto.TL{ //newest first, as they are loaded
+		mtproto.TL_message{ID: 3, Date: 1600000002, Out: true, Message: "plain",
+			FromID: mtproto.TL_peerUser{UserID: 5}},
+		mtproto.TL_message{ID: 2, Date: 1600000001, Message: "Hi 👋 bold link!",
+			ReplyTo: mtproto.TL_messageReplyHeader{ReplyToMsgID: &replyTo},
+			Entities: []mtproto.TL{
+				mtproto.TL_messageEntityBold{Offset: 6, Length: 4},
+				mtproto.TL_messageEntityItalic{Offset: 7, Length: 2}, //nested, skipped
+				mtproto.TL_messageEntityTextURL{Offset: 11, Length: 4, URL: "https://example.com"},
+			}},
+		mtproto.TL_messageService{ID: 1, Date: 1600000000, Action: mtproto.TL_messageActionHistoryClear{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewTDesktopExporter(saver).ExportAll(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(saver.Dirpath + "/export/tdesktop/5_Bob/result.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Name     string
+		Type     string
+		ID       int64
+		Messages []map[string]interface{}
+	}
+	if err := json.Unmarshal(buf, &result); err != nil {
+		t.Fatal(err, string(buf))
+	}
+	assertEqual(t, result.Name, "Bob Smith")
+	assertEqual(t, result.Type, "personal_chat")
+	assertEqual(t, result.ID, int64(5))
+	assertEqual(t, len(result.Messages), 3)
+
+	assertEqual(t, result.Messages[0]["type"], "service")
+	assertEqual(t, result.Messages[0]["action"], "clear_history")
+	assertEqual(t, result.Messages[0]["date_unixtime"], "1600000000")
+
+	msg := result.Messages[1]
+	assertEqual(t, msg["from"], "Bob Smith")
+	assertEqual(t, msg["from_id"], "user5")
+	assertEqual(t, msg["reply_to_message_id"], 1.0)
+	assertEqual(t, msg["text"], []interface{}{
+		"Hi 👋 ",
+		map[string]interface{}{"type": "bold", "text": "bold"},
+		" ",
+		map[string]interface{}{"type": "text_link", "text": "link", "href": "https://example.com"},
+		"!",
+	})
+	assertEqual(t, len(msg["text_entities"].([]interface{})), 5)
+
+	assertEqual(t, result.Messages[2]["text"], "plain")
+	assertEqual(t, result.Messages[2]["text_entities"], []interface{}{map[string]interface{}{"type": "plain", "text": "plain"}})
+}
@@ -7,14 +7,18 @@ require (
 	github.com/ansel1/merry/v2 v2.2.3
 	github.com/fatih/color v1.18.0
 	github.com/go-test/deep v1.1.1
+	github.com/mattn/go-sqlite3 v1.14.33
+	github.com/mdp/qrterminal/v3 v3.2.1
 	github.com/valyala/fastjson v1.6.7
 	golang.org/x/net v0.48.0
+	golang.org/x/term v0.38.0
 )
 
 require (
-	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	golang.org/x/crypto v0.46.0 // indirect
 	golang.org/x/sync v0.19.0 // indirect
 	golang.org/x/sys v0.39.0 // indirect
+	rsc.io/qr v0.2.0 // indirect
 )
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/ansel1/merry/v2"
+)
+
+var errInterrupted = merry.New("interrupted")
+
+// Interrupter tracks SIGINT/SIGTERM. The first signal asks long-running loops to stop
+// after the current chunk (they check it with checkInterrupted), the second one exits immediately
+// (trailing partial lines possibly left in that case are truncated on next start).
+type Interrupter struct {
+	once       *sync.Once
+	listenOnce *sync.Once
+	done       chan struct{}
+	mutex      *sync.Mutex
+	signal     os.Signal
+}
+
+func NewInterrupter() *Interrupter {
+	return &Interrupter{once: &sync.Once{}, listenOnce: &sync.Once{}, done: make(chan struct{}), mutex: &sync.Mutex{}}
+}
+
+var interrupter = NewInterrupter()
+
+// Listen starts handling signals. Without it signals have their default behaviour.
+// May be called several times (once per dumped account), signals are handled only once.
+func (i *Interrupter) Listen() {
+	i.listenOnce.Do(func() {
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			log.Warn("got %s, stopping after the current chunk (send it again to exit immediately)", sig)
+			i.Interrupt(sig)
+			sig = <-signals
+			log.Warn("got %s again, exiting", sig)
+			os.Exit(130)
+		}()
+	})
+}
+
+func (i *Interrupter) Interrupt(sig os.Signal) {
+	i.once.Do(func() {
+		i.mutex.Lock()
+		i.signal = sig
+		i.mutex.Unlock()
+		close(i.done)
+	})
+}
+
+func (i *Interrupter) Done() <-chan struct{} {
+	return i.done
+}
+
+func (i *Interrupter) IsInterrupted() bool {
+	select {
+	case <-i.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (i *Interrupter) Signal() os.Signal {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.signal
+}
+
+// checkInterrupted returns errInterrupted if the dump should stop.
+// Called between message chunks, so a chunk is always saved completely.
+func checkInterrupted() error {
+	if interrupter.IsInterrupted() {
+		return errInterrupted
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/3bl3gamer/tgclient"
+	"github.com/3bl3gamer/tgclient/mtproto"
+	"github.com/ansel1/merry/v2"
+	"github.com/mdp/qrterminal/v3"
+	"golang.org/x/net/proxy"
+)
+
+// config.login_method values
+const (
+	LoginInteractive = "interactive"
+	LoginQR          = "qr"
+	LoginProvisioned = "provisioned"
+)
+
+func tgMakeAuthDataProvider(config *Config) (mtproto.AuthDataProvider, error) {
+	switch config.LoginMethod {
+	case LoginInteractive:
+		return mtproto.ScanfAuthDataProvider{}, nil
+	case LoginQR:
+		// QR login is performed before regular auth, so phone login must not be reached
+		return UnavailableAuthDataProvider{Reason: "QR login did not succeed"}, nil
+	case LoginProvisioned:
+		if config.LoginPhone == "" || config.LoginCode == "" {
+			return nil, merry.New("login_phone and login_code are required for 'provisioned' login_method")
+		}
+		return ProvisionedAuthDataProvider{
+			PhoneSource:    config.LoginPhone,
+			PasswordSource: config.LoginPassword,
+			CodeSource:     config.LoginCode,
+		}, nil
+	default:
+		return nil, merry.Errorf("unknown login_method '%s', expected '%s', '%s' or '%s'",
+			config.LoginMethod, LoginInteractive, LoginQR, LoginProvisioned)
+	}
+}
+
+// UnavailableAuthDataProvider fails on any auth data request.
+type UnavailableAuthDataProvider struct {
+	Reason string
+}
+
+func (p UnavailableAuthDataProvider) PhoneNumber() (string, error) {
+	return "", merry.Errorf("can not log in: %s", p.Reason)
+}
+func (p UnavailableAuthDataProvider) Code() (string, error) {
+	return "", merry.Errorf("can not log in: %s", p.Reason)
+}
+func (p UnavailableAuthDataProvider) Password() (string, error) {
+	return "", merry.Errorf("can not log in: %s", p.Reason)
+}
+
+// ProvisionedAuthDataProvider reads phone and 2FA password from environment variables or files
+// ("env:NAME" or "file:path") and waits for login code on a named pipe or on a local HTTP endpoint
+// ("pipe:path" or "http:addr:port").
+type ProvisionedAuthDataProvider struct {
+	PhoneSource    string
+	PasswordSource string
+	CodeSource     string
+}
+
+func (p ProvisionedAuthDataProvider) PhoneNumber() (string, error) {
+	return readSecretSource(p.PhoneSource, "login_phone")
+}
+
+func (p ProvisionedAuthDataProvider) Code() (string, error) {
+	kind, value, _ := strings.Cut(p.CodeSource, ":")
+	switch kind {
+	case "pipe":
+		return readLoginCodeFromPipe(value)
+	case "http":
+		return readLoginCodeFromHTTP(value)
+	default:
+		return "", merry.Errorf("login_code: unknown source '%s', expected 'pipe:<path>' or 'http:<addr>'", p.CodeSource)
+	}
+}
+
+func (p ProvisionedAuthDataProvider) Password() (string, error) {
+	if p.PasswordSource == "" {
+		return "", merry.New("account has 2FA password, but login_password is not set")
+	}
+	return readSecretSource(p.PasswordSource, "login_password")
+}
+
+// "env:TG_PHONE" -> value of TG_PHONE, "file:phone.txt" -> phone.txt content (both are trimmed)
+func readSecretSource(source, paramName string) (string, error) {
+	kind, value, _ := strings.Cut(source, ":")
+	switch kind {
+	case "env":
+		res, ok := os.LookupEnv(value)
+		if !ok {
+			return "", merry.Errorf("%s: environment variable %s is not set", paramName, value)
+		}
+		return strings.TrimSpace(res), nil
+	case "file":
+		buf, err := os.ReadFile(value)
+		if err != nil {
+			return "", merry.Prependf(err, "%s", paramName)
+		}
+		return strings.TrimSpace(string(buf)), nil
+	default:
+		return "", merry.Errorf("%s: unknown source '%s', expected 'env:<name>' or 'file:<path>'", paramName, source)
+	}
+}
+
+// readLoginCodeFromPipe waits for a line written to the named pipe (created with mkfifo).
+func readLoginCodeFromPipe(fpath string) (string, error) {
+	log.Info("waiting for login code: write it to %s (for example, `echo 12345 > %s`)", fpath, fpath)
+	for {
+		file, err := os.Open(fpath) //blocks until someone opens the pipe for writing
+		if err != nil {
+			return "", merry.Prepend(err, "login_code")
+		}
+		line, err := bufio.NewReader(file).ReadString('\n')
+		file.Close()
+		if err != nil && err != io.EOF {
+			return "", merry.Prepend(err, "login_code")
+		}
+		if code := strings.TrimSpace(line); code != "" {
+			return code, nil
+		}
+	}
+}
+
+// readLoginCodeFromHTTP starts a temporary HTTP server and waits for a POST request with the code in body.
+func readLoginCodeFromHTTP(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", merry.Prepend(err, "login_code")
+	}
+	codes := make(chan string, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "code must be sent with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		buf, err := io.ReadAll(io.LimitReader(r.Body, 256))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		code := strings.TrimSpace(string(buf))
+		if code == "" {
+			http.Error(w, "code is empty", http.StatusBadRequest)
+			return
+		}
+		select {
+		case codes <- code:
+			fmt.Fprintln(w, "ok")
+		default:
+			http.Error(w, "code is already received", http.StatusConflict)
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	log.Info("waiting for login code: send it to http://%s (for example, `curl -d 12345 http://%s`)", addr, addr)
+	return <-codes, nil
+}
+
+// tgLoginQR logs in by QR code (https://core.telegram.org/api/qr-login) if current session is not authorized.
+// If account belongs to another DC, client is reconnected there with `reconnect`, so a new client may be returned.
+func tgLoginQR(
+	tg *tgclient.TGClient, config *Config, reconnect func(dcID int32, addr string) (*tgclient.TGClient, error),
+) (*tgclient.TGClient, error) {
+	res := tg.SendSync(mtproto.TL_users_getUsers{ID: []mtproto.TL{mtproto.TL_inputUserSelf{}}})
+	if !mtproto.IsErrorType(res, mtproto.TL_ErrUnauthorized) {
+		return tg, nil //already logged in (or it is some other error which will be handled later)
+	}
+
+	tokenUpdated := make(chan struct{}, 1)
+	tg.SetUpdateHandler(func(updTL mtproto.TL) {
+		if _, ok := updTL.(mtproto.TL_updateLoginToken); ok {
+			select {
+			case tokenUpdated <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer tg.SetUpdateHandler(nil)
+
+	res = tg.SendSync(mtproto.TL_auth_exportLoginToken{APIID: config.AppID, APIHash: config.AppHash})
+	for {
+		switch token := res.(type) {
+		case mtproto.TL_auth_loginToken:
+			link := "tg://login?token=" + base64.RawURLEncoding.EncodeToString(token.Token)
+			log.Info("scan this QR code with Telegram app (Settings > Devices > Link Desktop Device):")
+			qrterminal.GenerateHalfBlock(link, qrterminal.L, os.Stdout)
+			log.Info("or open %s on a logged in device", link)
+			select {
+			case <-tokenUpdated:
+			case <-time.After(time.Until(time.Unix(int64(token.Expires), 0))):
+				log.Info("QR code has expired, generating a new one")
+			}
+			res = tg.SendSync(mtproto.TL_auth_exportLoginToken{APIID: config.AppID, APIHash: config.AppHash})
+		case mtproto.TL_auth_loginTokenMigrateTo:
+			addr, err := tgFindDCAddr(tg, token.DCID)
+			if err != nil {
+				return nil, merry.Wrap(err)
+			}
+			log.Info("account belongs to DC %d, reconnecting", token.DCID)
+			tg, err = reconnect(token.DCID, addr)
+			if err != nil {
+				return nil, merry.Wrap(err)
+			}
+			res = tg.SendSync(mtproto.TL_auth_importLoginToken{Token: token.Token})
+		case mtproto.TL_auth_loginTokenSuccess:
+			return tg, nil
+		default:
+			if mtproto.IsError(res, "SESSION_PASSWORD_NEEDED") {
+				return tg, merry.Wrap(tgCheckPassword(tg, config))
+			}
+			return nil, merry.Wrap(mtproto.WrongRespError(res))
+		}
+	}
+}
+
+func tgFindDCAddr(tg *tgclient.TGClient, dcID int32) (string, error) {
+	res := tg.SendSync(mtproto.TL_help_getConfig{})
+	cfg, ok := res.(mtproto.TL_config)
+	if !ok {
+		return "", merry.Wrap(mtproto.WrongRespError(res))
+	}
+	for _, option := range cfg.DCOptions {
+		if option.ID == dcID && !option.IPv6 && !option.MediaOnly && !option.CDN {
+			return fmt.Sprintf("%s:%d", option.IPAddress, option.Port), nil
+		}
+	}
+	return "", merry.Errorf("address of DC %d not found", dcID)
+}
+
+// tgCheckPassword finishes login of account with 2FA password.
+func tgCheckPassword(tg *tgclient.TGClient, config *Config) error {
+	res := tg.SendSync(mtproto.TL_account_getPassword{})
+	accPassword, ok := res.(mtproto.TL_account_password)
+	if !ok {
+		return merry.Wrap(mtproto.WrongRespError(res))
+	}
+	algo, ok := accPassword.CurrentAlgo.(mtproto.TL_passwordKDFAlgoSHA256SHA256PBKDF2HMACSHA512iter100000SHA256ModPow)
+	if !ok {
+		return merry.Errorf("unknown password algo %T, application update is maybe needed to log in", accPassword.CurrentAlgo)
+	}
+
+	var password string
+	var err error
+	if config.LoginPassword != "" {
+		password, err = readSecretSource(config.LoginPassword, "login_password")
+	} else {
+		password, err = mtproto.ScanfAuthDataProvider{}.Password()
+	}
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	passwordSRP, err := calcPasswordSRP(algo, accPassword, password)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	res = tg.SendSync(mtproto.TL_auth_checkPassword{Password: passwordSRP})
+	if _, ok := res.(mtproto.TL_auth_authorization); !ok {
+		return merry.Wrap(mtproto.WrongRespError(res))
+	}
+	return nil
+}
+
+// calcPasswordSRP is the same as in tgclient (where it is not exported):
+// https://core.telegram.org/api/srp
+func calcPasswordSRP(
+	algo mtproto.TL_passwordKDFAlgoSHA256SHA256PBKDF2HMACSHA512iter100000SHA256ModPow,
+	accPassword mtproto.TL_account_password,
+	password string,
+) (mtproto.TL, error) {
+	if password == "" {
+		return nil, merry.New("password is empty")
+	}
+	if accPassword.SrpID == nil {
+		return nil, merry.New("srpID is not set")
+	}
+	if len(accPassword.SrpB) != 256 {
+		return nil, merry.Errorf("wrong SrpB size, expected 256 bytes, got %d", len(accPassword.SrpB))
+	}
+
+	sha256some := func(buffers ...[]byte) []byte {
+		h := sha256.New()
+		for _, buf := range buffers {
+			h.Write(buf)
+		}
+		return h.Sum(nil)
+	}
+	padded := func(num *big.Int) []byte {
+		return num.FillBytes(make([]byte, 256))
+	}
+
+	clientSalt := algo.Salt1
+	serverSalt := algo.Salt2
+	gNum := big.NewInt(int64(algo.G))
+	gBuf := padded(gNum)
+	pNum := new(big.Int).SetBytes(algo.P)
+	BBuf := accPassword.SrpB
+	BNum := new(big.Int).SetBytes(BBuf)
+	if BNum.Cmp(pNum) != -1 {
+		return nil, merry.New("expected SrpB < P")
+	}
+
+	buf := sha256some(clientSalt, []byte(password), clientSalt)
+	buf = sha256some(serverSalt, buf, serverSalt)
+	hash, err := pbkdf2.Key(sha512.New, string(buf), clientSalt, 100000, 64)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	xNum := new(big.Int).SetBytes(sha256some(serverSalt, hash, serverSalt))
+
+	aBuf := make([]byte, 256)
+	if _, err := rand.Read(aBuf); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	aNum := new(big.Int).SetBytes(aBuf)
+	ABuf := padded(new(big.Int).Exp(gNum, aNum, pNum))
+
+	uNum := new(big.Int).SetBytes(sha256some(ABuf, BBuf))
+	kNum := new(big.Int).SetBytes(sha256some(algo.P, gBuf))
+
+	vNum := new(big.Int).Exp(gNum, xNum, pNum)
+	kvNum := new(big.Int).Mul(kNum, vNum)
+	kvNum.Mod(kvNum, pNum)
+	tNum := new(big.Int).Sub(BNum, kvNum)
+	if tNum.Sign() == -1 {
+		tNum.Add(tNum, pNum)
+	}
+	expNum := new(big.Int).Mul(uNum, xNum)
+	expNum.Add(expNum, aNum)
+	KBuf := sha256some(padded(new(big.Int).Exp(tNum, expNum, pNum)))
+
+	h1 := sha256some(algo.P)
+	h2 := sha256some(gBuf)
+	for i := range h1 {
+		h1[i] ^= h2[i]
+	}
+	MBuf := sha256some(h1, sha256some(clientSalt), sha256some(serverSalt), ABuf, BBuf, KBuf)
+
+	return mtproto.TL_inputCheckPasswordSRP{SrpID: *accPassword.SrpID, A: ABuf, M1: MBuf}, nil
+}
+
+// tgclient connects to this address when there is no saved session
+const tgDefaultDCAddr = "149.154.167.50:443"
+
+// migrationDialer makes new session (with no saved data) connect to another DC instead of the default one.
+type migrationDialer struct {
+	proxy.Dialer
+	addr string
+}
+
+func (d migrationDialer) Dial(network, addr string) (net.Conn, error) {
+	if addr == tgDefaultDCAddr {
+		addr = d.addr
+	}
+	return d.Dialer.Dial(network, addr)
+}
+
+// migrationSessionStore saves actual DC address (instead of the default one) to the new session.
+type migrationSessionStore struct {
+	mtproto.SessionStore
+	addr string
+}
+
+func (s migrationSessionStore) Save(sess *mtproto.SessionInfo) error {
+	if sess.Addr == tgDefaultDCAddr {
+		sess.Addr = s.addr
+	}
+	return merry.Wrap(s.SessionStore.Save(sess))
+}
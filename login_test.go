@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3bl3gamer/tgclient/mtproto"
+)
+
+func TestTGMakeAuthDataProvider(t *testing.T) {
+	provider, err := tgMakeAuthDataProvider(&Config{LoginMethod: LoginInteractive})
+	assertOk(t, err)
+	assertEqual(t, provider, mtproto.AuthDataProvider(mtproto.ScanfAuthDataProvider{}))
+
+	provider, err = tgMakeAuthDataProvider(&Config{LoginMethod: LoginQR})
+	assertOk(t, err)
+	if _, err := provider.PhoneNumber(); err == nil {
+		t.Error("phone login must not be reached after QR login")
+	}
+
+	provider, err = tgMakeAuthDataProvider(&Config{LoginMethod: LoginProvisioned,
+		LoginPhone: "env:TG_PHONE", LoginCode: "pipe:code"})
+	assertOk(t, err)
+	assertEqual(t, provider, mtproto.AuthDataProvider(ProvisionedAuthDataProvider{
+		PhoneSource: "env:TG_PHONE", CodeSource: "pipe:code"}))
+	if _, err := provider.Password(); err == nil {
+		t.Error("expected error for missing login_password")
+	}
+
+	for _, config := range []*Config{
+		{LoginMethod: LoginProvisioned, LoginPhone: "env:TG_PHONE"},
+		{LoginMethod: LoginProvisioned, LoginCode: "pipe:code"},
+		{LoginMethod: "unknown"},
+	} {
+		if _, err := tgMakeAuthDataProvider(config); err == nil {
+			t.Errorf("expected error for %#v", config)
+		}
+	}
+}
+
+func TestReadSecretSource(t *testing.T) {
+	t.Setenv("TG_TEST_PHONE", " +123 \n")
+	value, err := readSecretSource("env:TG_TEST_PHONE", "login_phone")
+	assertOk(t, err)
+	assertEqual(t, value, "+123")
+
+	fpath := t.TempDir() + "/password.txt"
+	assertOk(t, os.WriteFile(fpath, []byte("passw0rd\n"), 0600))
+	value, err = readSecretSource("file:"+fpath, "login_password")
+	assertOk(t, err)
+	assertEqual(t, value, "passw0rd")
+
+	for _, source := range []string{"env:TG_TEST_MISSING", "file:" + fpath + ".missing", "+123", ""} {
+		if _, err := readSecretSource(source, "login_phone"); err == nil {
+			t.Errorf("expected error for '%s'", source)
+		}
+	}
+}
+
+func TestReadLoginCodeFromHTTP(t *testing.T) {
+	prevLog := log
+	log = mtproto.Logger{Hnd: mtproto.NoopLogHandler{}}
+	t.Cleanup(func() { log = prevLog })
+
+	// finding a free port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertOk(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	go func() {
+		for i := 0; i < 50; i++ {
+			res, err := http.Post("http://"+addr, "text/plain", strings.NewReader(" 12345\n"))
+			if err == nil {
+				res.Body.Close()
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	code, err := readLoginCodeFromHTTP(addr)
+	assertOk(t, err)
+	assertEqual(t, code, "12345")
+}
+
+func TestMigrationSessionStore(t *testing.T) {
+	fpath := t.TempDir() + "/tg.session"
+	store := migrationSessionStore{SessionStore: &mtproto.SessFileStore{FPath: fpath}, addr: "149.154.167.91:443"}
+
+	sess := mtproto.SessionInfo{DCID: 4, Addr: tgDefaultDCAddr}
+	assertOk(t, store.Save(&sess))
+	loaded := mtproto.SessionInfo{}
+	assertOk(t, store.Load(&loaded))
+	assertEqual(t, loaded.Addr, "149.154.167.91:443")
+
+	// address of already migrated session is kept
+	sess = mtproto.SessionInfo{DCID: 2, Addr: "149.154.167.51:443"}
+	assertOk(t, store.Save(&sess))
+	assertOk(t, store.Load(&loaded))
+	assertEqual(t, loaded.Addr, "149.154.167.51:443")
+}
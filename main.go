@@ -1,12 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	stdlog "log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/3bl3gamer/tgclient"
@@ -107,7 +110,11 @@ func loadAndSaveMessages(tg *tgclient.TGClient, chat *Chat, saver HistorySaver,
 	historyLimit := int32(0)
 	// applying limit only if no history has been dumped for this chat yet
 	if startID == 0 {
-		historyLimit = config.HistoryLimit.For(chat)
+		historyLimit, lastID, err = resolveHistoryLimit(tg, chat, config)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		startID = lastID
 	}
 	if historyLimit > chat.LastMessageID {
 		log.Debug("history limit is set to %d, but chat has %d message(s) as most (it is the last message ID), disabling limit",
@@ -115,13 +122,22 @@ func loadAndSaveMessages(tg *tgclient.TGClient, chat *Chat, saver HistorySaver,
 		historyLimit = 0
 	}
 
+	lastCommentIDs, err := loadLastCommentIDsIfEnabled(chat, saver, config)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	isForum := tgIsForum(chat.Obj)
+
 	greenf := color.New(color.FgGreen).SprintfFunc()
 
-	prevIterTime := time.Now()
 	for {
 		if lastID >= chat.LastMessageID {
 			break
 		}
+		if err := checkInterrupted(); err != nil {
+			return merry.Wrap(err)
+		}
 
 		{
 			percent := (lastID - startID) * 100 / (chat.LastMessageID - startID)
@@ -142,6 +158,7 @@ func loadAndSaveMessages(tg *tgclient.TGClient, chat *Chat, saver HistorySaver,
 				greenf("%d%%", percent), fromNum, chunkSize, chat.LastMessageID, approxRemCount, limitText)
 		}
 
+		tgLimiterFor(tg).Wait()
 		newMessages, users, chats, err := tgLoadMessages(tg, chat.Obj, chunkSize, lastID, historyLimit)
 		if err != nil {
 			return merry.Wrap(err)
@@ -188,10 +205,20 @@ func loadAndSaveMessages(tg *tgclient.TGClient, chat *Chat, saver HistorySaver,
 
 			log.Debug("got %d new message(s)", len(newMessages))
 
-			if err := saver.SaveMessages(chat, newMessages); err != nil {
+			messagesToSave := newMessages
+			if isForum {
+				messagesToSave = filterForumMessagesByTopic(chat, newMessages, config)
+			}
+			if err := saver.SaveMessages(chat, messagesToSave); err != nil {
 				return merry.Wrap(err)
 			}
 
+			if lastCommentIDs != nil {
+				if err := loadAndSaveComments(tg, chat, saver, newMessages, lastCommentIDs); err != nil {
+					return merry.Wrap(err)
+				}
+			}
+
 			if len(newMessages) < int(chunkSize) && lastID < chat.LastMessageID {
 				log.Warn(
 					"go %d message(s) (instead of %d), but their last ID=%d is still less than chat last message ID=%d; "+
@@ -200,11 +227,913 @@ func loadAndSaveMessages(tg *tgclient.TGClient, chat *Chat, saver HistorySaver,
 				break
 			}
 		}
+	}
+	return nil
+}
+
+// resolveHistoryLimit returns count limit and ID of the last message before date limit
+// (only one of them is non-zero, the one which leaves fewer messages is used).
+// Date limit is resolved to message ID with messages.getHistory by offset_date.
+func resolveHistoryLimit(tg *tgclient.TGClient, chat *Chat, config *Config) (int32, int32, error) {
+	limit := config.HistoryLimit.For(chat)
+	startDate := limit.StartDate(time.Now())
+	if startDate.IsZero() {
+		return limit.Count, 0, nil
+	}
+	tgLimiterFor(tg).Wait()
+	beforeID, err := tgFindLastMessageIDBeforeDate(tg, chat.Obj, int32(startDate.Unix()))
+	if err != nil {
+		return 0, 0, merry.Wrap(err)
+	}
+	if beforeID == 0 {
+		return limit.Count, 0, nil
+	}
+	if limit.Count > 0 {
+		// oldest of `limit.Count` most recent messages
+		tgLimiterFor(tg).Wait()
+		messages, _, _, err := tgLoadMessages(tg, chat.Obj, 1, 0, limit.Count)
+		if err != nil {
+			return 0, 0, merry.Wrap(err)
+		}
+		if len(messages) > 0 {
+			countStartID, err := tgGetMessageID(messages[0])
+			if err != nil {
+				return 0, 0, merry.Wrap(err)
+			}
+			if countStartID > beforeID {
+				return limit.Count, 0, nil
+			}
+		}
+	}
+	return 0, beforeID, nil
+}
+
+// backfillMessages loads messages older than the first saved one, down to config.HistoryLimit
+// (counting already saved messages, or down to its date) or to the very first message of the chat.
+func backfillMessages(tg *tgclient.TGClient, chat *Chat, saver HistorySaver, config *Config) error {
+	oldestID, savedCount, err := saver.GetOldestMessageID(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if oldestID == 0 {
+		return nil //nothing saved yet, regular dump will handle it
+	}
+	limit := config.HistoryLimit.For(chat)
+	historyLimit := int(limit.Count)
+	startDate := limit.StartDate(time.Now())
+	chunkSize := int32(100)
+
+	lastCommentIDs, err := loadLastCommentIDsIfEnabled(chat, saver, config)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	isForum := tgIsForum(chat.Obj)
+
+	for oldestID > 1 && (historyLimit == 0 || savedCount < historyLimit) {
+		if err := checkInterrupted(); err != nil {
+			return merry.Wrap(err)
+		}
+		limitText := ""
+		if historyLimit > 0 {
+			limitText = fmt.Sprintf(" of %d limit", historyLimit)
+		}
+		if !startDate.IsZero() {
+			limitText += fmt.Sprintf(", since %s", startDate.Format("2006-01-02"))
+		}
+		log.Info("backfilling messages: before #%d (%d saved%s)", oldestID, savedCount, limitText)
+
+		tgLimiterFor(tg).Wait()
+		newMessages, users, chats, err := tgLoadMessagesBefore(tg, chat.Obj, chunkSize, oldestID)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		if len(newMessages) == 0 {
+			break
+		}
+		// messages are sorted from newest to oldest, so the oldest ones are cut
+		if historyLimit > 0 && savedCount+len(newMessages) > historyLimit {
+			newMessages = newMessages[:historyLimit-savedCount]
+		}
+		reachedStartDate := false
+		if !startDate.IsZero() {
+			for i, msg := range newMessages {
+				_, date, _, err := tgGetMessageIDStampPeer(msg)
+				if err == nil && int64(date) < startDate.Unix() {
+					newMessages = newMessages[:i]
+					reachedStartDate = true
+					break
+				}
+			}
+			if len(newMessages) == 0 {
+				break
+			}
+		}
+
+		if err := saveRelated(saver, users, chats); err != nil {
+			return merry.Wrap(err)
+		}
+		prevOldestID := oldestID
+		for i, msg := range newMessages {
+			msgID, err := tgGetMessageID(msg)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			if msgID < oldestID {
+				oldestID = msgID
+			}
+			newMsg, err := tgLoadMissingMessageMediaStory(tg, chat.Obj, msg, chats)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			newMessages[i] = newMsg
+		}
+		if oldestID >= prevOldestID {
+			log.Warn("got no messages older than #%d, stopping backfill", prevOldestID)
+			break
+		}
+		savedCount += len(newMessages)
+
+		messagesToSave := newMessages
+		if isForum {
+			messagesToSave = filterForumMessagesByTopic(chat, newMessages, config)
+		}
+		if err := saver.SaveOlderMessages(chat, messagesToSave); err != nil {
+			return merry.Wrap(err)
+		}
+
+		if lastCommentIDs != nil {
+			if err := loadAndSaveComments(tg, chat, saver, newMessages, lastCommentIDs); err != nil {
+				return merry.Wrap(err)
+			}
+		}
+		if reachedStartDate {
+			break
+		}
+	}
+	return merry.Wrap(saver.MergeOlderMessages(chat))
+}
+
+// GapsCheckStats are -verify-gaps results summed up for all chats.
+type GapsCheckStats struct {
+	mutex    sync.Mutex
+	Chats    int
+	Repaired int
+	Deleted  int
+}
+
+func (s *GapsCheckStats) Add(repaired, deleted int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Chats += 1
+	s.Repaired += repaired
+	s.Deleted += deleted
+}
+
+// uncheckedGapsRanges returns parts of the saved messages range (oldestID..lastID)
+// that are not covered by the previous gaps check.
+func uncheckedGapsRanges(oldestID, lastID int32, check GapsCheckData) []MessageIDsGap {
+	if check.ToID == 0 {
+		return []MessageIDsGap{{AfterID: oldestID, BeforeID: lastID}}
+	}
+	var ranges []MessageIDsGap
+	if oldestID < check.FromID {
+		ranges = append(ranges, MessageIDsGap{AfterID: oldestID, BeforeID: check.FromID})
+	}
+	if lastID > check.ToID {
+		ranges = append(ranges, MessageIDsGap{AfterID: check.ToID, BeforeID: lastID})
+	}
+	return ranges
+}
+
+// verifyMessageGaps searches for messages which are missing in the middle of saved history,
+// loads the ones that still exist and reports the rest as deleted.
+// Checked range is remembered, so next checks only cover messages saved after (or before) it.
+func verifyMessageGaps(tg *tgclient.TGClient, chat *Chat, saver HistorySaver, config *Config, stats *GapsCheckStats) error {
+	_, isChannel := chat.Obj.(mtproto.TL_channel)
+
+	oldestID, _, err := saver.GetOldestMessageID(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	lastID, err := saver.GetLastMessageID(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if oldestID == 0 {
+		return nil
+	}
+	prevCheck, err := saver.GetGapsCheck(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	ranges := uncheckedGapsRanges(oldestID, lastID, prevCheck)
+
+	var gaps []MessageIDsGap
+	if isChannel {
+		allGaps, err := saver.FindMessageIDsGaps(chat)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		for _, gap := range allGaps {
+			for _, r := range ranges {
+				if gap.AfterID >= r.AfterID && gap.BeforeID <= r.BeforeID {
+					gaps = append(gaps, gap)
+					break
+				}
+			}
+		}
+	} else {
+		// messages IDs of other chats are shared with the whole account, so gaps are everywhere,
+		// checking whole unchecked ranges instead
+		for _, r := range ranges {
+			if r.BeforeID > r.AfterID+1 {
+				gaps = append(gaps, r)
+			}
+		}
+	}
+
+	savedIDs, err := saver.GetSavedMessageIDs(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	savedIDsSet := make(map[int32]bool, len(savedIDs))
+	for _, id := range savedIDs {
+		savedIDsSet[id] = true
+	}
+	isForum := tgIsForum(chat.Obj)
+	chunkSize := int32(100)
+
+	if len(gaps) > 0 {
+		log.Info("checking %d gap(s) in saved messages", len(gaps))
+	}
+	repairedTotal := 0
+	deletedTotal := 0
+	for _, gap := range gaps {
+		repaired := 0
+		returned := 0
+		offsetID := gap.BeforeID
+		for {
+			if err := checkInterrupted(); err != nil {
+				return merry.Wrap(err)
+			}
+			tgLimiterFor(tg).Wait()
+			messages, users, chats, err := tgLoadMessagesBetween(tg, chat.Obj, gap.AfterID, offsetID, chunkSize)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			if len(messages) == 0 {
+				break
+			}
+			if err := saveRelated(saver, users, chats); err != nil {
+				return merry.Wrap(err)
+			}
+
+			var missing []mtproto.TL
+			for _, msg := range messages {
+				msgID, err := tgGetMessageID(msg)
+				if err != nil {
+					return merry.Wrap(err)
+				}
+				if msgID < offsetID {
+					offsetID = msgID
+				}
+				if !savedIDsSet[msgID] {
+					newMsg, err := tgLoadMissingMessageMediaStory(tg, chat.Obj, msg, chats)
+					if err != nil {
+						return merry.Wrap(err)
+					}
+					missing = append(missing, newMsg)
+				}
+			}
+			returned += len(messages)
+			if isForum {
+				missing = filterForumMessagesByTopic(chat, missing, config)
+			}
+			if err := saver.SaveGapMessages(chat, missing); err != nil {
+				return merry.Wrap(err)
+			}
+			repaired += len(missing)
+
+			if len(messages) < int(chunkSize) {
+				break
+			}
+		}
+
+		if isChannel {
+			deleted := int(gap.BeforeID-gap.AfterID-1) - returned
+			log.Info("gap #%d..#%d: %d repaired, %d deleted", gap.AfterID+1, gap.BeforeID-1, repaired, deleted)
+			deletedTotal += deleted
+		} else if repaired > 0 {
+			log.Info("found %d missing message(s) between #%d and #%d", repaired, gap.AfterID, gap.BeforeID)
+		}
+		repairedTotal += repaired
+	}
+
+	if err := saver.MergeGapMessages(chat); err != nil {
+		return merry.Wrap(err)
+	}
+	err = saver.SaveGapsCheck(chat, GapsCheckData{FromID: oldestID, ToID: lastID, CheckedAt: time.Now()})
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	stats.Add(repairedTotal, deletedTotal)
+	if len(gaps) == 0 {
+		log.Debug("no unchecked gaps in saved messages")
+	} else if isChannel {
+		log.Info("gaps check done: %d message(s) repaired, %d were deleted", repairedTotal, deletedTotal)
+	} else {
+		log.Info("gaps check done: %d message(s) repaired (deleted ones can not be counted: message IDs are shared with other chats)",
+			repairedTotal)
+	}
+	return nil
+}
+
+// filterForumMessagesByTopic replaces messages from topics not matched by config.History with empty messages.
+// Placeholders are saved instead of just skipping messages, so the last saved message ID advances
+// (even if all messages of the chunk are from excluded topics) and skipped IDs are not reported as gaps.
+func filterForumMessagesByTopic(chat *Chat, messages []mtproto.TL, config *Config) []mtproto.TL {
+	res := make([]mtproto.TL, len(messages))
+	skipped := 0
+	for i, msg := range messages {
+		topicID, _ := tgGetForumMessageTopicID(chat.Obj, msg)
+		if config.History.Match(chat.WithTopic(topicID), nil) == MatchTrue {
+			res[i] = msg
+			continue
+		}
+		msgID, err := tgGetMessageID(msg)
+		if err != nil {
+			res[i] = msg //should not happen: messages were already checked by the caller
+			continue
+		}
+		res[i] = mtproto.TL_messageEmpty{ID: msgID}
+		skipped += 1
+	}
+	if skipped > 0 {
+		log.Debug("skipped %d message(s) from excluded topics", skipped)
+	}
+	return res
+}
+
+func loadAndSaveForumTopics(tg *tgclient.TGClient, chat *Chat, saver HistorySaver) error {
+	topics, users, chats, err := tgLoadForumTopics(tg, chat.Obj)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if err := saveRelated(saver, users, chats); err != nil {
+		return merry.Wrap(err)
+	}
+	if err := saver.SaveForumTopics(chat, topics); err != nil {
+		return merry.Wrap(err)
+	}
+	log.Info("saved %d forum topic(s)", len(topics))
+	return nil
+}
+
+// loadAndSaveChatFullInfo saves info available only in full group/channel object
+// (about text, participants count, etc.) to the chats file.
+func loadAndSaveChatFullInfo(tg *tgclient.TGClient, chat *Chat, saver HistorySaver) error {
+	tgLimiterFor(tg).Wait()
+	fullTL, users, chats, err := tgLoadFullChat(tg, chat.Obj)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if err := saveRelated(saver, users, chats); err != nil {
+		return merry.Wrap(err)
+	}
+	full, err := tgExtractChatFullData(fullTL)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(saver.SaveChatFullInfo(chat.Obj, full))
+}
+
+// loadAndSaveParticipants saves current members of the group/channel and logs who has joined or left since the last run.
+func loadAndSaveParticipants(tg *tgclient.TGClient, chat *Chat, saver HistorySaver) error {
+	participants, count, users, chats, err := tgLoadParticipants(tg, chat.Obj)
+	if err != nil {
+		if errors.Is(err, errChatAdminRequired) {
+			log.Warn("participants of %s are available only for admins, skipping", chat.Title)
+			return nil
+		}
+		return merry.Wrap(err)
+	}
+	if err := saveRelated(saver, users, chats); err != nil {
+		return merry.Wrap(err)
+	}
+
+	snapshot := &ParticipantsSnapshotData{TakenAt: time.Now(), Count: count}
+	for _, participantTL := range participants {
+		if p, ok := tgExtractParticipantData(participantTL); ok {
+			snapshot.Participants = append(snapshot.Participants, p)
+		}
+	}
+	snapshot.Partial = int32(len(snapshot.Participants)) < count
+	if snapshot.Partial {
+		log.Warn("only %d of %d participants of %s are available, only recently joined members are tracked",
+			len(snapshot.Participants), count, chat.Title)
+	}
+
+	change, err := saver.SaveParticipants(chat, snapshot)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	log.Info("saved %d participant(s): %d joined, %d left", len(snapshot.Participants), len(change.Joined), len(change.Left))
+	return nil
+}
+
+// loadAndSaveAdminLog saves admin log events that are newer than the last saved one.
+// Telegram keeps events only for 48 hours, so earlier ones can not be recovered.
+func loadAndSaveAdminLog(tg *tgclient.TGClient, chat *Chat, saver HistorySaver) error {
+	lastID, err := saver.GetLastAdminLogEventID(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	// events are returned from newest to oldest, but must be saved in ascending order,
+	// so they are collected first (there are not too many of them during 48 hours)
+	var allEvents []mtproto.TL
+	maxID := int64(0)
+	for {
+		if err := checkInterrupted(); err != nil {
+			return merry.Wrap(err)
+		}
+		tgLimiterFor(tg).Wait()
+		events, users, chats, err := tgLoadAdminLog(tg, chat.Obj, lastID, maxID, 100)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		if err := saveRelated(saver, users, chats); err != nil {
+			return merry.Wrap(err)
+		}
+		if len(events) == 0 {
+			break
+		}
+		allEvents = append(allEvents, events...)
+		maxID = events[len(events)-1].(mtproto.TL_channelAdminLogEvent).ID
+		log.Debug("got %d admin log event(s), oldest #%d", len(events), maxID)
+	}
+
+	if err := saver.SaveAdminLogEvents(chat, allEvents); err != nil {
+		return merry.Wrap(err)
+	}
+	log.Info("saved %d admin log event(s)", len(allEvents))
+	return nil
+}
+
+// loadAndSaveProfilePhotos downloads profile photos of the user/chat that were not downloaded yet.
+// Photos are downloaded directly (not via downloads queue): file references of
+// profile photos can not be refreshed the same way as of messages.
+func loadAndSaveProfilePhotos(tg *tgclient.TGClient, chat *Chat, saver HistorySaver) error {
+	photos, err := tgLoadProfilePhotos(tg, chat.Obj)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	count := 0
+	// from oldest to newest
+	for i := len(photos) - 1; i >= 0; i-- {
+		if err := checkInterrupted(); err != nil {
+			return merry.Wrap(err)
+		}
+		photo := photos[i]
+		file, err := tgFindProfilePhotoFileInfo(photo)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		fpath := saver.AvatarFPath(chat.ID, file.FName)
+		if _, err := os.Stat(fpath); err == nil {
+			continue //already downloaded
+		} else if !os.IsNotExist(err) {
+			return merry.Wrap(err)
+		}
+
+		log.Info("downloading profile photo to %s", fpath)
+		tgLimiterFor(tg).WaitPause()
+		_, err = tg.DownloadFileToPath(fpath, file.InputLocation, file.DCID, file.Size, NewFileProgressLogger())
+		if isBrokenFileError(err) {
+			log.Error(nil, "in chat %d %s (%s): wrong profile photo file: %s", chat.ID, chat.Title, chat.Username, fpath)
+			continue
+		}
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		if err := saver.SetAvatarDate(chat.ID, file.FName, time.Unix(int64(photo.Date), 0)); err != nil {
+			return merry.Wrap(err)
+		}
+		count++
+	}
+	log.Info("downloaded %d new of %d profile photo(s)", count, len(photos))
+	return nil
+}
+
+// Comments of already saved posts are re-checked within this window
+// if edits re-scan is not configured for the channel.
+var defaultCommentsRescanWindow = ConfigMessagesWindow{Days: 7}
+
+// rescanEditedMessages re-fetches most recent messages (according to config.EditsRescan)
+// and saves revisions of the ones that have changed since they were dumped.
+// New comments of re-fetched posts are loaded too (if enabled).
+func rescanEditedMessages(tg *tgclient.TGClient, chat *Chat, saver HistorySaver, config *Config) error {
+	window := config.EditsRescan.For(chat)
+	saveRevisions := !window.IsEmpty()
+	if !saveRevisions && config.CommentsEnabledFor(chat) {
+		window = defaultCommentsRescanWindow
+	}
+	if window.IsEmpty() {
+		return nil
+	}
+	minDate := int32(0)
+	if window.Days > 0 {
+		minDate = int32(time.Now().AddDate(0, 0, -int(window.Days)).Unix())
+	}
+	chunkSize := int32(100)
+
+	lastCommentIDs, err := loadLastCommentIDsIfEnabled(chat, saver, config)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	isForum := tgIsForum(chat.Obj)
+	offsetID := int32(0)
+	scannedCount := int32(0)
+	revisionsCount := 0
+	for {
+		if err := checkInterrupted(); err != nil {
+			return merry.Wrap(err)
+		}
+		log.Debug("rescanning messages for edits: from #%d (-%d), %d scanned", offsetID, chunkSize, scannedCount)
+
+		tgLimiterFor(tg).Wait()
+		messages, users, chats, err := tgLoadMessagesBefore(tg, chat.Obj, chunkSize, offsetID)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		if err := saveRelated(saver, users, chats); err != nil {
+			return merry.Wrap(err)
+		}
+
+		windowEnded := false
+		windowMessages := make([]mtproto.TL, 0, len(messages))
+		for _, msg := range messages {
+			msgID, err := tgGetMessageID(msg)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			msgDate := int32(0)
+			if _, date, _, err := tgGetMessageIDStampPeer(msg); err == nil {
+				msgDate = date
+			}
+			inCountWindow := scannedCount < window.Count
+			inDaysWindow := window.Days > 0 && msgDate >= minDate
+			if !inCountWindow && !inDaysWindow {
+				windowEnded = true
+				break
+			}
+			windowMessages = append(windowMessages, msg)
+			scannedCount += 1
+			offsetID = msgID
+		}
+		if isForum {
+			// messages of excluded topics are saved as placeholders and must not be saved as their revisions
+			windowMessages = filterForumMessagesByTopic(chat, windowMessages, config)
+		}
+
+		if saveRevisions {
+			n, err := saver.SaveMessageRevisions(chat, windowMessages)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			revisionsCount += n
+		}
+
+		if lastCommentIDs != nil {
+			if err := loadAndSaveComments(tg, chat, saver, windowMessages, lastCommentIDs); err != nil {
+				return merry.Wrap(err)
+			}
+		}
+
+		if windowEnded || len(messages) < int(chunkSize) {
+			break
+		}
+	}
+
+	if revisionsCount > 0 {
+		log.Info("found %d edited message(s) among %d most recent", revisionsCount, scannedCount)
+	}
+	return nil
+}
+
+// saveMetricsSnapshot re-fetches views, forwards, replies and reactions counters
+// of the last saved channel posts and appends them as a new snapshot.
+func saveMetricsSnapshot(tg *tgclient.TGClient, chat *Chat, saver HistorySaver, config *Config) error {
+	count := config.MetricsSnapshots.For(chat)
+	if count == 0 || chat.Type != ChatChannel {
+		return nil
+	}
+	savedIDs, err := saver.GetSavedMessageIDs(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	ids := savedIDs[max(len(savedIDs)-int(count), 0):]
+	if len(ids) == 0 {
+		return nil
+	}
+
+	chunkSize := 100
+	snapshot := MetricsSnapshotData{TakenAt: time.Now()}
+	for i := 0; i < len(ids); i += chunkSize {
+		chunk := ids[i:min(i+chunkSize, len(ids))]
+		log.Debug("loading metrics: %d of %d", i, len(ids))
+
+		tgLimiterFor(tg).Wait()
+		views, users, chats, err := tgLoadMessagesViews(tg, chat.Obj, chunk)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		if err := saveRelated(saver, users, chats); err != nil {
+			return merry.Wrap(err)
+		}
+		tgLimiterFor(tg).Wait()
+		reactions, err := tgLoadMessagesReactions(tg, chat.Obj, chunk)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+
+		for j, id := range chunk {
+			metrics := MessageMetricsData{ID: id, Views: views[j].Views, Forwards: views[j].Forwards}
+			if views[j].Replies != nil {
+				metrics.Replies = &views[j].Replies.Replies
+			}
+			if msgReactions, ok := reactions[id]; ok && len(msgReactions.Results) > 0 {
+				metrics.Reactions = make(map[string]int32, len(msgReactions.Results))
+				for _, r := range msgReactions.Results {
+					metrics.Reactions[tgReactionKey(r.Reaction)] = r.Count
+				}
+			}
+			snapshot.Messages = append(snapshot.Messages, metrics)
+		}
+	}
+
+	if err := saver.SaveMetricsSnapshot(chat, snapshot); err != nil {
+		return merry.Wrap(err)
+	}
+	log.Info("saved metrics snapshot of %d post(s)", len(ids))
+	return nil
+}
+
+// checkDeletedMessages re-checks saved messages and records the ones that were removed from the chat.
+// For channels, if there is a PTS saved during previous check, only updates since that PTS are checked.
+func checkDeletedMessages(tg *tgclient.TGClient, chat *Chat, saver HistorySaver, config *Config) error {
+	savedIDs, err := saver.GetSavedMessageIDs(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if len(savedIDs) == 0 {
+		return nil
+	}
+	_, isChannel := chat.Obj.(mtproto.TL_channel)
+
+	if isChannel {
+		pts, err := saver.GetChannelPTS(chat)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		if pts > 0 {
+			deletedIDs, newPTS, tooLong, err := tgLoadChannelDeletedMessageIDs(tg, chat.Obj, pts)
+			if err != nil {
+				log.Warn("could not get channel difference, will re-check all saved messages: %s", err)
+			} else if tooLong {
+				log.Info("channel difference is too long, will re-check all saved messages")
+			} else {
+				savedIDsSet := make(map[int32]bool, len(savedIDs))
+				for _, id := range savedIDs {
+					savedIDsSet[id] = true
+				}
+				var deletedSavedIDs []int32
+				for _, id := range deletedIDs {
+					if savedIDsSet[id] {
+						deletedSavedIDs = append(deletedSavedIDs, id)
+						savedIDsSet[id] = false //update may be received multiple times
+					}
+				}
+				if err := saver.SaveDeletedMessages(chat, deletedSavedIDs); err != nil {
+					return merry.Wrap(err)
+				}
+				if len(deletedSavedIDs) > 0 {
+					log.Info("found %d deleted message(s)", len(deletedSavedIDs))
+				}
+				return merry.Wrap(saver.SaveChannelPTS(chat, newPTS))
+			}
+		}
+	}
+
+	chunkSize := 100
+	deletedCount := 0
+	firstPTS := int32(0)
+	for i := 0; i < len(savedIDs); i += chunkSize {
+		if err := checkInterrupted(); err != nil {
+			return merry.Wrap(err)
+		}
+		ids := savedIDs[i:min(i+chunkSize, len(savedIDs))]
+		log.Info("checking deleted messages: %d of %d", i, len(savedIDs))
+
+		tgLimiterFor(tg).Wait()
+		messages, users, chats, pts, err := tgLoadMessagesByIDs(tg, chat.Obj, ids)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		if err := saveRelated(saver, users, chats); err != nil {
+			return merry.Wrap(err)
+		}
+		// PTS from the beginning of the check, so messages deleted during the check will be found next time
+		if firstPTS == 0 {
+			firstPTS = pts
+		}
+
+		existingIDs := make(map[int32]bool, len(messages))
+		for _, msg := range messages {
+			if _, ok := msg.(mtproto.TL_messageEmpty); ok {
+				continue
+			}
+			msgID, err := tgGetMessageID(msg)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			existingIDs[msgID] = true
+		}
+		var deletedIDs []int32
+		for _, id := range ids {
+			if !existingIDs[id] {
+				deletedIDs = append(deletedIDs, id)
+			}
+		}
+		if err := saver.SaveDeletedMessages(chat, deletedIDs); err != nil {
+			return merry.Wrap(err)
+		}
+		deletedCount += len(deletedIDs)
+	}
+
+	if deletedCount > 0 {
+		log.Info("found %d deleted message(s)", deletedCount)
+	}
+	if isChannel && firstPTS > 0 {
+		if err := saver.SaveChannelPTS(chat, firstPTS); err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// refetchPendingWebPages re-fetches saved messages (or comments, or stories) which link previews were not ready during dump.
+func refetchPendingWebPages(tg *tgclient.TGClient, chat *Chat, saver HistorySaver, source MediaFileSource) error {
+	pending, err := saver.GetPendingWebPages(chat, source)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	log.Info("re-fetching %d record(s) with pending link previews", len(pending))
+
+	chunkSize := 100
+	if source == CommentMediaFile {
+		chunkSize = 1 //comments are loaded one by one, each from its own post replies
+	}
+	resolvedCount := 0
+	for i := 0; i < len(pending); i += chunkSize {
+		if err := checkInterrupted(); err != nil {
+			return merry.Wrap(err)
+		}
+		items := pending[i:min(i+chunkSize, len(pending))]
+		ids := make([]int32, len(items))
+		for j, item := range items {
+			ids[j] = item.ID
+		}
+
+		tgLimiterFor(tg).Wait()
+		var records, users, chats []mtproto.TL
+		switch source {
+		case MessageMediaFile:
+			records, users, chats, _, err = tgLoadMessagesByIDs(tg, chat.Obj, ids)
+		case StoryMediaFile:
+			records, users, chats, err = tgLoadStoriesByIDs(tg, chat.Obj, ids)
+		case CommentMediaFile:
+			records, users, chats, err = tgLoadReplies(tg, chat.Obj, items[0].PostID, ids[0]+1, 0, 1)
+		default:
+			err = merry.Errorf("unexpected media source: %d", source)
+		}
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		if err := saveRelated(saver, users, chats); err != nil {
+			return merry.Wrap(err)
+		}
+		if source != MessageMediaFile {
+			// only existing stories and comments are returned, missing ones are marked as deleted
+			records, err = markMissingAsDeleted(records, ids, source)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+		count, err := saver.SaveResolvedWebPages(chat, source, records)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		resolvedCount += count
+	}
+	if resolvedCount > 0 {
+		log.Info("got %d ready link preview(s)", resolvedCount)
+	}
+	return nil
+}
+
+// markMissingAsDeleted leaves only records with given IDs and adds
+// TL_messageEmpty (or TL_storyItemDeleted) for the ones that are missing.
+func markMissingAsDeleted(records []mtproto.TL, ids []int32, source MediaFileSource) ([]mtproto.TL, error) {
+	byID := make(map[int32]mtproto.TL, len(records))
+	for _, rec := range records {
+		id, err := tgGetMessageOrStoryID(rec)
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+		byID[id] = rec
+	}
+	res := make([]mtproto.TL, len(ids))
+	for i, id := range ids {
+		if rec, ok := byID[id]; ok {
+			res[i] = rec
+		} else if source == StoryMediaFile {
+			res[i] = mtproto.TL_storyItemDeleted{ID: id}
+		} else {
+			res[i] = mtproto.TL_messageEmpty{ID: id}
+		}
+	}
+	return res, nil
+}
+
+// loadLastCommentIDsIfEnabled returns last saved comment IDs (post ID -> comment ID)
+// if comments dumping is enabled for the chat, nil otherwise.
+func loadLastCommentIDsIfEnabled(chat *Chat, saver HistorySaver, config *Config) (map[int32]int32, error) {
+	if !config.CommentsEnabledFor(chat) {
+		return nil, nil
+	}
+	lastCommentIDs, err := saver.GetLastCommentIDs(chat)
+	return lastCommentIDs, merry.Wrap(err)
+}
+
+// loadAndSaveComments loads and saves new comments (from linked discussion group) of the channel posts.
+// lastCommentIDs (post ID -> last saved comment ID) is updated accordingly.
+func loadAndSaveComments(tg *tgclient.TGClient, chat *Chat, saver HistorySaver, posts []mtproto.TL, lastCommentIDs map[int32]int32) error {
+	chunkSize := int32(100)
+	for _, postTL := range posts {
+		post, ok := postTL.(mtproto.TL_message)
+		if !ok || post.Replies == nil || !post.Replies.Comments || post.Replies.MaxID == nil {
+			continue
+		}
+		lastID := lastCommentIDs[post.ID]
+		if *post.Replies.MaxID <= lastID {
+			continue
+		}
+
+		log.Info("loading comments of post #%d (%d total)", post.ID, post.Replies.Replies)
+		var comments []mtproto.TL //from newest to oldest
+		offsetID := int32(0)
+		for {
+			tgLimiterFor(tg).Wait()
+			chunk, users, chats, err := tgLoadReplies(tg, chat.Obj, post.ID, offsetID, lastID, chunkSize)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			if err := saveRelated(saver, users, chats); err != nil {
+				return merry.Wrap(err)
+			}
+			for _, msg := range chunk {
+				msgID, err := tgGetMessageID(msg)
+				if err != nil {
+					return merry.Wrap(err)
+				}
+				if offsetID == 0 || msgID < offsetID {
+					offsetID = msgID
+				}
+			}
+			comments = append(comments, chunk...)
+			if len(chunk) < int(chunkSize) {
+				break
+			}
+		}
 
-		now := time.Now()
-		delta := time.Duration(config.RequestIntervalMS)*time.Millisecond - now.Sub(prevIterTime)
-		time.Sleep(delta)
-		prevIterTime = now
+		if len(comments) == 0 {
+			continue
+		}
+		if err := saver.SaveComments(chat, post.ID, comments); err != nil {
+			return merry.Wrap(err)
+		}
+		newLastID, err := tgGetMessageID(comments[0])
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		lastCommentIDs[post.ID] = newLastID
+		log.Debug("got %d new comment(s) of post #%d", len(comments), post.ID)
 	}
 	return nil
 }
@@ -251,6 +1180,9 @@ func loadAndSaveStories(tg *tgclient.TGClient, chat *Chat, saver HistorySaver, t
 	// loading and saving stories between last saved and latest loaded
 	if lastSavedID+1 < latestChunkFirstID {
 		for lowerOffsetID := lastSavedID + 1; lowerOffsetID < latestChunkFirstID; lowerOffsetID += chunkSize {
+			if err := checkInterrupted(); err != nil {
+				return merry.Wrap(err)
+			}
 			offsetID := lowerOffsetID + chunkSize
 
 			stories, err := loadStoriesAndSaveRelated(tg, saver, chat, chunkSize, offsetID, archivedAreAvailable)
@@ -321,6 +1253,244 @@ func mayHaveStories(chat *Chat) bool {
 	return chat.Type == ChatUser || chat.Type == ChatChannel
 }
 
+// prioritizeCheckpointChats moves chats that were being dumped when previous run was interrupted
+// to the beginning of the list, so they are finished first.
+func prioritizeCheckpointChats(chats []*Chat, checkpoint *Checkpoint) []*Chat {
+	isInterrupted := make(map[int64]bool, len(checkpoint.Chats))
+	for _, c := range checkpoint.Chats {
+		isInterrupted[c.ID] = true
+	}
+	res := make([]*Chat, 0, len(chats))
+	for _, chat := range chats {
+		if isInterrupted[chat.ID] {
+			res = append(res, chat)
+		}
+	}
+	for _, chat := range chats {
+		if !isInterrupted[chat.ID] {
+			res = append(res, chat)
+		}
+	}
+	return res
+}
+
+// dumpChatsConcurrently runs dumpChat for each chat using `concurrency` workers.
+// Stops (after already started chats are done) on first error or on interruption.
+func dumpChatsConcurrently(chats []*Chat, concurrency int, dumpChat func(*Chat) error) error {
+	chatsChan := make(chan *Chat)
+	errChan := make(chan error, concurrency)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chat := range chatsChan {
+				if err := dumpChat(chat); err != nil {
+					errChan <- merry.Prependf(err, "chat #%d %s", chat.ID, chat.Title)
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for _, chat := range chats {
+		if err = checkInterrupted(); err != nil {
+			break
+		}
+		select {
+		case chatsChan <- chat:
+		case err = <-errChan:
+			break feed
+		}
+	}
+	close(chatsChan)
+	wg.Wait()
+
+	if err == nil {
+		select {
+		case err = <-errChan:
+		default:
+		}
+	}
+	return err
+}
+
+// ChatsByID is a chats list shared between dump and download workers.
+// It may be replaced while workers are running (for example, when chats are reloaded in watch mode).
+type ChatsByID struct {
+	mutex sync.RWMutex
+	chats map[int64]*Chat
+}
+
+func NewChatsByID(chats []*Chat) *ChatsByID {
+	c := &ChatsByID{}
+	c.Replace(chats)
+	return c
+}
+
+func (c *ChatsByID) Replace(chats []*Chat) {
+	chatsByID := make(map[int64]*Chat, len(chats))
+	for _, chat := range chats {
+		chatsByID[chat.ID] = chat
+	}
+	c.mutex.Lock()
+	c.chats = chatsByID
+	c.mutex.Unlock()
+}
+
+func (c *ChatsByID) Get(id int64) (*Chat, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	chat, ok := c.chats[id]
+	return chat, ok
+}
+
+// startDownloadWorkers starts `concurrency` workers downloading files from the queue
+// until it is closed and there is nothing more to download.
+func startDownloadWorkers(tg *tgclient.TGClient, saver *JSONFilesHistorySaver, queue *DownloadQueue, chatsByID *ChatsByID, concurrency int) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				item, ok := queue.Take()
+				if !ok {
+					return
+				}
+				item, err := downloadQueuedFile(tg, saver, queue, chatsByID, item)
+				if errors.Is(err, errQueuedChatNotFound) {
+					queue.Park(item)
+					log.Warn("chat #%d of file '%s' (message #%d) not found among dialogs, skipping its files until next run",
+						item.ChatID, item.File.FName, item.MsgID)
+					continue
+				}
+				if err == nil {
+					err = queue.Done(item)
+					if err != nil {
+						log.Error(err, "download queue")
+					}
+					continue
+				}
+				willRetry, qErr := queue.Fail(item, err)
+				if qErr != nil {
+					log.Error(qErr, "download queue")
+				}
+				if willRetry {
+					log.Warn("failed to download file '%s' of message #%d in chat #%d, will retry: %s",
+						item.File.FName, item.MsgID, item.ChatID, err)
+				} else {
+					log.Error(err, "failed to download file '%s' of message #%d in chat #%d, will retry on next run",
+						item.File.FName, item.MsgID, item.ChatID)
+				}
+			}
+		}()
+	}
+	return wg
+}
+
+var errQueuedChatNotFound = merry.New("chat not found among dialogs")
+
+func downloadQueuedFile(tg *tgclient.TGClient, saver *JSONFilesHistorySaver, queue *DownloadQueue, chatsByID *ChatsByID, item DownloadQueueItem) (DownloadQueueItem, error) {
+	chat, ok := chatsByID.Get(item.ChatID)
+	if !ok {
+		return item, merry.Wrap(errQueuedChatNotFound)
+	}
+	fpath, err := saver.MessageFileFPath(chat, item.MsgID, item.File.FName, item.File.IndexInMsg, item.MediaSource)
+	if err != nil {
+		return item, merry.Wrap(err)
+	}
+	if _, err := os.Stat(fpath); err == nil {
+		return item, nil //already downloaded
+	} else if !os.IsNotExist(err) {
+		return item, merry.Wrap(err)
+	}
+
+	file, err := item.File.FileInfo()
+	if err != nil {
+		return item, merry.Wrap(err)
+	}
+	log.Info("downloading file to %s", fpath)
+	tgLimiterFor(tg).WaitPause()
+	_, err = tg.DownloadFileToPath(fpath, file.InputLocation, file.DCID, int64(file.Size), NewFileProgressLogger())
+
+	if isFileReferenceExpiredError(err) {
+		log.Info("file reference has expired, re-fetching record #%d", item.MsgID)
+		var found bool
+		item, found, err = refreshQueuedFileReference(tg, queue, chat, item)
+		if err != nil {
+			return item, merry.Wrap(err)
+		}
+		if !found {
+			log.Warn("record #%d in chat #%d no longer has file '%s', skipping it", item.MsgID, item.ChatID, item.File.FName)
+			return item, nil
+		}
+		if file, err = item.File.FileInfo(); err != nil {
+			return item, merry.Wrap(err)
+		}
+		tgLimiterFor(tg).WaitPause()
+		_, err = tg.DownloadFileToPath(fpath, file.InputLocation, file.DCID, int64(file.Size), NewFileProgressLogger())
+	}
+
+	if isBrokenFileError(err) {
+		log.Error(nil, "in chat %d %s (%s): wrong file: %s", chat.ID, chat.Title, chat.Username, fpath)
+		return item, nil
+	}
+	return item, merry.Wrap(err)
+}
+
+// refreshQueuedFileReference re-fetches queued file message (or story, or comment) to get a fresh file reference
+// (they expire after some time, https://core.telegram.org/api/file_reference).
+func refreshQueuedFileReference(tg *tgclient.TGClient, queue *DownloadQueue, chat *Chat, item DownloadQueueItem) (DownloadQueueItem, bool, error) {
+	var records []mtproto.TL
+	var err error
+	fileInfosFunc := tgFindMessageMediaFileInfos
+	tgLimiterFor(tg).Wait()
+	switch item.MediaSource {
+	case MessageMediaFile:
+		records, _, _, _, err = tgLoadMessagesByIDs(tg, chat.Obj, []int32{item.MsgID})
+	case StoryMediaFile:
+		records, _, _, err = tgLoadStoriesByIDs(tg, chat.Obj, []int32{item.MsgID})
+		fileInfosFunc = tgFindStoryMediaFileInfos
+	case CommentMediaFile:
+		if item.PostID == 0 {
+			return item, false, merry.Errorf("post of comment #%d is unknown, can not re-fetch it", item.MsgID)
+		}
+		// the newest comment older than item.MsgID+1, should be the comment itself (checked below)
+		records, _, _, err = tgLoadReplies(tg, chat.Obj, item.PostID, item.MsgID+1, 0, 1)
+	default:
+		return item, false, merry.Errorf("unexpected media source: %d", item.MediaSource)
+	}
+	if err != nil {
+		return item, false, merry.Wrap(err)
+	}
+
+	for _, rec := range records {
+		if item.MediaSource == CommentMediaFile {
+			if id, err := tgGetMessageID(rec); err != nil || id != item.MsgID {
+				continue
+			}
+		}
+		fileInfos, err := fileInfosFunc(rec)
+		if err != nil {
+			return item, false, merry.Wrap(err)
+		}
+		for _, fileInfo := range fileInfos {
+			if fileInfo.IndexInMsg == item.File.IndexInMsg && fileInfo.FName == item.File.FName {
+				queueFile, err := NewDownloadQueueFile(&fileInfo)
+				if err != nil {
+					return item, false, merry.Wrap(err)
+				}
+				item, err = queue.UpdateFile(item, queueFile)
+				return item, true, merry.Wrap(err)
+			}
+		}
+	}
+	return item, false, nil
+}
+
 func mustOpen(fpath string) *os.File {
 	file, err := os.OpenFile(fpath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 	if err != nil {
@@ -333,27 +1503,42 @@ func isBrokenFileError(err error) bool {
 	return err != nil && err.Error() == `unexpected file part: mtproto.TL_rpc_error{ErrorCode:400, ErrorMessage:"LOCATION_INVALID"}`
 }
 
+func isFileReferenceExpiredError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "FILE_REFERENCE_EXPIRED")
+}
+
 func dump() error {
 	// flags
 	configFPath := flag.String("config", "config.json", "path to config file")
+	accountName := flag.String("account", "", "name of the account (from config.accounts) to dump, all accounts are dumped by default")
 	appID := flag.Int("app-id", 0, "app id")
 	appHash := flag.String("app-hash", "", "app hash")
 	sosks5addr := flag.String("socks5", "", "socks5 proxy address:port, overrides config.socks5_proxy_addr")
 	sosks5user := flag.String("socks5-user", "", "socks5 proxy username, overrides config.socks5_proxy_user")
 	sosks5password := flag.String("socks5-password", "", "socks5 proxy password, overrides config.socks5_proxy_password")
 	sessionFPath := flag.String("session", "", "session file path, overrides config.session_file_path")
+	loginMethod := flag.String("login", "", "login method: interactive, qr or provisioned, overrides config.login_method")
 	outDirPath := flag.String("out", "", "output directory path, overriders config.out_dir_path")
 	chatTitle := flag.String("chat", "", "title of the chat to dump, overrides config.history")
 	skipStories := flag.Bool("skip-stories", false, "do not dump sotries, overrides config.stories")
+	concurrency := flag.Int("concurrency", 0, "number of chats dumped simultaneously, overrides config.concurrency")
+	doWatch := flag.Bool("watch", false, "after dump stay connected and save new messages as they arrive")
+	doBackfill := flag.Bool("backfill", false, "load messages older than already saved ones (down to history_limit or to the first message)")
+	doVerifyGaps := flag.Bool("verify-gaps", false, "search for missing messages between saved ones and load them")
+	doCheckDeleted := flag.Bool("check-deleted", false, "re-check already saved messages and record deleted ones")
 	doListChats := flag.Bool("list-chats", false, "list all available chats, do not dump anything")
 	doLogout := flag.Bool("logout", false, "logout and remove session file, do not dump anything")
+	doExportSession := flag.Bool("export-session", false, "print session as a portable string (for -import-session), do not dump anything")
+	importSession := flag.String("import-session", "", "save session from a string made by -export-session, do not dump anything")
 	logDebug := flag.Bool("debug", false, "show debug log messages")
 	tgLogDebug := flag.Bool("debug-tg", false, "show debug TGClient log messages")
 	doAccountDump := flag.String("dump-account", "", "enable basic user information dump, use 'write' to enable dump, overriders config.dump_account")
 	doContactsDump := flag.String("dump-contacts", "", "enable contacts dump, use 'write' to enable dump, overriders config.dump_contacts")
 	doSessionsDump := flag.String("dump-sessions", "", "enable active sessions dump, use 'write' to enable dump, overriders config.dump_sessions")
 	httpAddr := flag.String("preview-http", "", "HTTP service address to browse through the dump")
-	flag.BoolVar(&skipPendingWebpagePhotos, "skip-pending-webpage-photos", false, skipPendingWebpagePhotosHelp)
+	exportHTMLDir := flag.String("export-html", "", "directory for static HTML pages of the dump (same as -preview-http ones), do not dump anything")
+	exportFormat := flag.String("export", "", "convert saved dump to another format (tdesktop: Telegram Desktop result.json per chat), do not dump anything")
+	skipPendingWebpagePhotos := flag.Bool("skip-pending-webpage-photos", false, "deprecated, has no effect: messages with pending link previews are re-fetched automatically")
 	flag.Parse()
 
 	// logging
@@ -383,51 +1568,270 @@ func dump() error {
 		logger.Print("")
 	}
 
+	if *skipPendingWebpagePhotos {
+		log.Warn("-skip-pending-webpage-photos is deprecated and has no effect: messages with pending link previews are re-fetched automatically")
+	}
+
 	// config
 	config, err := ParseConfig(*configFPath)
 	if err != nil {
 		return merry.Wrap(err)
 	}
+	accounts := config.AccountConfigs()
+	if *accountName != "" {
+		var selected []*Config
+		for _, account := range accounts {
+			if account.Name == *accountName {
+				selected = append(selected, account)
+			}
+		}
+		if len(selected) == 0 {
+			return merry.Errorf("account '%s' not found in config.accounts", *accountName)
+		}
+		accounts = selected
+	}
+	if len(accounts) > 1 && (*sessionFPath != "" || *outDirPath != "") {
+		return merry.New("-session and -out can not be used with several accounts, select one with -account")
+	}
+
 	overrideStrParam := func(cfgAttr, srcValue *string) {
 		if *srcValue != "" {
 			*cfgAttr = *srcValue
 		}
 	}
-	if *appID != 0 {
-		config.AppID = int32(*appID)
-	}
-	overrideStrParam(&config.AppHash, appHash)
-	overrideStrParam(&config.Socks5ProxyAddr, sosks5addr)
-	overrideStrParam(&config.Socks5ProxyUser, sosks5user)
-	overrideStrParam(&config.Socks5ProxyPassword, sosks5password)
-	if *chatTitle != "" {
-		config.History = ConfigChatFilterAttrs{Title: chatTitle}
-		config.Stories = ConfigChatFilterAttrs{Title: chatTitle}
-	}
-	overrideStrParam(&config.SessionFilePath, sessionFPath)
-	overrideStrParam(&config.OutDirPath, outDirPath)
-	overrideStrParam(&config.DoAccountDump, doAccountDump)
-	overrideStrParam(&config.DoContactsDump, doContactsDump)
-	overrideStrParam(&config.DoSessionsDump, doSessionsDump)
+	for _, config := range accounts {
+		if *appID != 0 {
+			config.AppID = int32(*appID)
+		}
+		overrideStrParam(&config.AppHash, appHash)
+		overrideStrParam(&config.Socks5ProxyAddr, sosks5addr)
+		overrideStrParam(&config.Socks5ProxyUser, sosks5user)
+		overrideStrParam(&config.Socks5ProxyPassword, sosks5password)
+		if *chatTitle != "" {
+			config.History = ConfigChatFilterAttrs{Title: chatTitle}
+			config.Stories = ConfigChatFilterAttrs{Title: chatTitle}
+		}
+		if *concurrency > 0 {
+			config.Concurrency = int64(*concurrency)
+		}
+		overrideStrParam(&config.LoginMethod, loginMethod)
+		overrideStrParam(&config.SessionFilePath, sessionFPath)
+		overrideStrParam(&config.OutDirPath, outDirPath)
+		overrideStrParam(&config.DoAccountDump, doAccountDump)
+		overrideStrParam(&config.DoContactsDump, doContactsDump)
+		overrideStrParam(&config.DoSessionsDump, doSessionsDump)
 
-	if config.AppID == 0 || config.AppHash == "" {
-		log.Error(nil, "app_id and app_hash are required (in config or flags)")
-		flag.Usage()
-		os.Exit(2)
+		if config.AppID == 0 || config.AppHash == "" {
+			log.Error(nil, "app_id and app_hash are required (in config or flags)")
+			flag.Usage()
+			os.Exit(2)
+		}
 	}
 
-	saver := &JSONFilesHistorySaver{Dirpath: config.OutDirPath}
+	if *doExportSession || *importSession != "" {
+		if len(accounts) > 1 {
+			return merry.New("-export-session and -import-session can not be used with several accounts, select one with -account")
+		}
+		config := accounts[0]
+		sessStore, err := tgMakeSessionStore(config)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		if *doExportSession {
+			str, err := exportSessionString(sessStore)
+			if errors.Is(err, mtproto.ErrNoSessionData) {
+				return merry.Errorf("session file %s not found, nothing to export", config.SessionFilePath)
+			}
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			fmt.Println(str)
+			return nil
+		}
+		if err := importSessionString(sessStore, config.SessionFilePath, *importSession); err != nil {
+			return merry.Wrap(err)
+		}
+		log.Info("session saved to %s", config.SessionFilePath)
+		return nil
+	}
 
 	if *httpAddr != "" {
-		err := servePreviewHttp(*httpAddr, config, saver)
+		if err := checkJSONStorage(accounts); err != nil {
+			return merry.Prepend(err, "http preview")
+		}
+		err := servePreviewHttp(*httpAddr, accounts)
 		return merry.Prepend(err, "http preview")
 	}
 
+	if *exportHTMLDir != "" {
+		if err := checkJSONStorage(accounts); err != nil {
+			return merry.Prepend(err, "html export")
+		}
+		err := exportStaticHTML(*exportHTMLDir, accounts)
+		return merry.Prepend(err, "html export")
+	}
+
+	if *exportFormat != "" {
+		if err := checkJSONStorage(accounts); err != nil {
+			return merry.Prepend(err, "export")
+		}
+		for _, config := range accounts {
+			if err := exportDump(config, *exportFormat); err != nil {
+				return merry.Prependf(err, "account %s", config.Name)
+			}
+		}
+		return nil
+	}
+
+	opts := DumpOptions{
+		SkipStories:  *skipStories,
+		Watch:        *doWatch,
+		Backfill:     *doBackfill,
+		VerifyGaps:   *doVerifyGaps,
+		CheckDeleted: *doCheckDeleted,
+		ListChats:    *doListChats,
+		Logout:       *doLogout,
+	}
+	accountsConcurrency := int(config.AccountsConcurrency)
+	if opts.Watch {
+		// watching account does not finish until interrupted, so others would never start
+		accountsConcurrency = len(accounts)
+	}
+	return merry.Wrap(dumpAccounts(accounts, accountsConcurrency, func(config *Config) error {
+		return dumpAccount(config, opts, tgLogHandler)
+	}))
+}
+
+// checkJSONStorage fails if some account is not saved as JSON files:
+// preview and exports read dump files directly.
+func checkJSONStorage(accounts []*Config) error {
+	for _, config := range accounts {
+		if config.Storage != "json" {
+			return merry.Errorf("only 'json' storage is supported, but dump in %s uses '%s'", config.OutDirPath, config.Storage)
+		}
+	}
+	return nil
+}
+
+// makeHistorySaver returns saver for config.storage ("json" or "sqlite").
+// Returned close function must be called after use.
+func makeHistorySaver(config *Config, files *JSONFilesHistorySaver) (HistorySaver, func() error, error) {
+	switch config.Storage {
+	case "json":
+		return files, func() error { return nil }, nil
+	case "sqlite":
+		return openSQLiteHistorySaver(files)
+	default:
+		return nil, nil, merry.Errorf("unknown storage '%s', expected 'json' or 'sqlite'", config.Storage)
+	}
+}
+
+// DumpOptions are command line flags that affect every dumped account.
+type DumpOptions struct {
+	SkipStories  bool
+	Watch        bool
+	Backfill     bool
+	VerifyGaps   bool
+	CheckDeleted bool
+	ListChats    bool
+	Logout       bool
+}
+
+// dumpAccounts dumps accounts one by one (or `concurrency` accounts simultaneously).
+// Failed account does not stop the others, interruption does.
+func dumpAccounts(accounts []*Config, concurrency int, dumpAccount func(*Config) error) error {
+	if len(accounts) == 1 {
+		return merry.Wrap(dumpAccount(accounts[0]))
+	}
+
+	var failedNames []string
+	var interruptedErr error
+	mutex := &sync.Mutex{}
+	slots := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+	for _, account := range accounts {
+		if checkInterrupted() != nil {
+			break
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(account *Config) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			log.Info("dumping account %s", color.New(color.Bold).Sprint(account.Name))
+			err := dumpAccount(account)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if errors.Is(err, errInterrupted) {
+				interruptedErr = err
+			} else if err != nil {
+				log.Error(err, "account %s", account.Name)
+				failedNames = append(failedNames, account.Name)
+			}
+		}(account)
+	}
+	wg.Wait()
+
+	if interruptedErr != nil {
+		return interruptedErr
+	}
+	if len(failedNames) > 0 {
+		return merry.Errorf("failed to dump account(s): %s", strings.Join(failedNames, ", "))
+	}
+	return nil
+}
+
+func dumpAccount(config *Config, opts DumpOptions, tgLogHandler LogHandler) error {
+	saver := NewJSONFilesHistorySaver(config.OutDirPath)
+
+	// previous run may have been killed while writing records
+	truncatedFPaths, err := saver.TruncatePartialLines()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	for _, fpath := range truncatedFPaths {
+		log.Warn("removed incomplete last record from %s", fpath)
+	}
+	checkpoint, err := saver.ReadCheckpoint()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	// messages, stories, users, etc. (media files and other data are always saved by JSON files saver)
+	history, closeHistory, err := makeHistorySaver(config, saver)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer closeHistory()
+
 	// tg setup
-	tg, me, err := tgConnect(config, &tgLogHandler)
+	reconnected := make(chan struct{}, 1)
+	var onReconnected func()
+	if opts.Watch {
+		onReconnected = func() {
+			select {
+			case reconnected <- struct{}{}:
+			default:
+			}
+		}
+	}
+	tg, me, err := tgConnect(config, &tgLogHandler, onReconnected)
 	if err != nil {
 		return merry.Wrap(err)
 	}
+	tgSetLimiter(tg, NewRequestLimiter(time.Duration(config.RequestIntervalMS)*time.Millisecond))
+	// Client is not disconnected: files of interrupted dump may still be downloading.
+	// Its limiter is removed only after download workers stop (otherwise they would create an unlimited one).
+	var downloadsWG *sync.WaitGroup
+	defer func() {
+		if downloadsWG == nil {
+			tgRemoveLimiter(tg)
+			return
+		}
+		go func() {
+			downloadsWG.Wait()
+			tgRemoveLimiter(tg)
+		}()
+	}()
 
 	{
 		greenBoldf := color.New(color.FgGreen, color.Bold).SprintfFunc()
@@ -438,7 +1842,11 @@ func dump() error {
 			greenBoldf("%s (%s)", strings.TrimSpace(firstName+" "+lastName), username), me.ID)
 	}
 
-	saver.SetFileRequestCallback(func(chat *Chat, file *TGFileInfo, msgID int32, mediaSource MediaFileSource) error {
+	downloadQueue, err := saver.OpenDownloadQueue()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	saver.SetFileRequestCallback(func(chat *Chat, file *TGFileInfo, msgID int32, mediaSource MediaFileSource, postID int32) error {
 		if config.Media.Match(chat, file) == MatchTrue {
 			fpath, err := saver.MessageFileFPath(chat, msgID, file.FName, file.IndexInMsg, mediaSource)
 			if err != nil {
@@ -446,13 +1854,18 @@ func dump() error {
 			}
 			_, err = os.Stat(fpath)
 			if os.IsNotExist(err) {
-				log.Info("downloading file to %s", fpath)
-				_, err := tg.DownloadFileToPath(fpath, file.InputLocation, file.DCID, int64(file.Size), NewFileProgressLogger())
-				if isBrokenFileError(err) {
-					log.Error(nil, "in chat %d %s (%s): wrong file: %s", chat.ID, chat.Title, chat.Username, fpath)
-					err = nil
+				queueFile, err := NewDownloadQueueFile(file)
+				if err != nil {
+					return merry.Wrap(err)
 				}
-				return merry.Wrap(err)
+				log.Debug("queueing file '%s' of message #%d", file.FName, msgID)
+				return merry.Wrap(downloadQueue.Push(DownloadQueueItem{
+					ChatID:      chat.ID,
+					MsgID:       msgID,
+					PostID:      postID,
+					MediaSource: mediaSource,
+					File:        queueFile,
+				}))
 			}
 			return merry.Wrap(err)
 		} else {
@@ -461,6 +1874,12 @@ func dump() error {
 		}
 	})
 
+	stickers, err := NewStickersCollector(saver, config)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	saver.SetStickersRequestCallback(stickers.Collect)
+
 	// loading chats
 	chats, err := tgLoadChats(tg)
 	if err != nil {
@@ -473,7 +1892,7 @@ func dump() error {
 	CheckConfig(config, chats)
 
 	// processing chats
-	if *doLogout {
+	if opts.Logout {
 		if err := tgLogout(tg); err != nil {
 			return merry.Wrap(err)
 		}
@@ -482,18 +1901,33 @@ func dump() error {
 			return merry.Wrap(err)
 		}
 		log.Info("removed session file %s", config.SessionFilePath)
-	} else if *doListChats {
+	} else if opts.ListChats {
 		green := color.New(color.FgGreen).SprintFunc()
 		yellow := color.New(color.FgYellow).SprintFunc()
 		grayf := color.New(color.FgHiBlack).SprintfFunc()
 		noopf := color.New().SprintfFunc()
-		log.Info(grayf(" type     chat ID    limit  title (username)"))
+		log.Info(grayf(" type     chat ID    limit  title (username)  [folders]"))
 		for _, chat := range chats {
 			colf := noopf
 			title := chat.Title
 			historyLimitStr := "       "
-			if historyLimit := config.HistoryLimit.For(chat); historyLimit != 0 {
-				historyLimitStr = fmt.Sprintf("%7d", historyLimit)
+			sinceStr := ""
+			limit := config.HistoryLimit.For(chat)
+			if limit.Count != 0 {
+				historyLimitStr = fmt.Sprintf("%7d", limit.Count)
+			}
+			if startDate := limit.StartDate(time.Now()); !startDate.IsZero() {
+				sinceStr = grayf("  since %s", startDate.Format("2006-01-02"))
+				// resolving start message only for dumped chats (it costs a request)
+				if config.History.Match(chat, nil) == MatchTrue {
+					_, beforeID, err := resolveHistoryLimit(tg, chat, config)
+					if err != nil {
+						return merry.Wrap(err)
+					}
+					if beforeID != 0 {
+						historyLimitStr = fmt.Sprintf("%7s", fmt.Sprintf("#%d", beforeID+1))
+					}
+				}
 			}
 			if config.History.Match(chat, nil) == MatchTrue {
 				title = green(title)
@@ -501,13 +1935,21 @@ func dump() error {
 			} else {
 				colf = grayf
 			}
-			log.Info(colf("%-7s %10d %s  %s (%s)", chat.Type, chat.ID, historyLimitStr, title, chat.Username))
+			folders := chat.Folders
+			if chat.Archived {
+				folders = append(slices.Clone(folders), "archived")
+			}
+			foldersStr := ""
+			if len(folders) > 0 {
+				foldersStr = grayf("  [%s]", strings.Join(folders, ", "))
+			}
+			log.Info(colf("%-7s %10d %s  %s (%s)", chat.Type, chat.ID, historyLimitStr, title, chat.Username) + sinceStr + foldersStr)
 		}
 
 	} else {
 		// saving user info
 		if config.DoAccountDump == "write" {
-			if err := saver.SaveAccount(*me); err != nil {
+			if err := history.SaveAccount(*me); err != nil {
 				return merry.Wrap(err)
 			}
 			log.Info("user Account Info Saved")
@@ -519,7 +1961,7 @@ func dump() error {
 			if err != nil {
 				return merry.Wrap(err)
 			}
-			if err := saver.SaveContacts(contacts.Users); err != nil {
+			if err := history.SaveContacts(contacts.Users); err != nil {
 				return merry.Wrap(err)
 			}
 			log.Info("contacts Saved")
@@ -531,33 +1973,226 @@ func dump() error {
 			if err != nil {
 				return merry.Wrap(err)
 			}
-			saver.SaveAuths(authList)
+			history.SaveAuths(authList)
 			log.Info("active Sessions Saved")
 		}
 
 		// saving messages and stories
-		if err := saveChatsAsRelated(chats, saver); err != nil {
+		if err := saveChatsAsRelated(chats, history); err != nil {
 			return merry.Wrap(err)
 		}
+		if checkpoint != nil {
+			log.Info("previous dump was interrupted at %s, resuming",
+				checkpoint.InterruptedAt.Format("2006-01-02 15:04:05"))
+			chats = prioritizeCheckpointChats(chats, checkpoint)
+		}
+		interrupter.Listen()
+		chatsByID := NewChatsByID(chats)
+		downloadsWG = startDownloadWorkers(tg, saver, downloadQueue, chatsByID, int(config.DownloadConcurrency))
+
 		green := color.New(color.FgGreen).SprintFunc()
-		for _, chat := range chats {
+		gapsStats := &GapsCheckStats{}
+		dumpChat := func(chat *Chat) error {
+			// full info
+			if chat.Type != ChatUser && config.FullInfo.Match(chat, nil) == MatchTrue {
+				log.Info("saving full info of: %s (%s) #%d %v",
+					green(chat.Title), chat.Username, chat.ID, chat.Type)
+				if err := loadAndSaveChatFullInfo(tg, chat, history); err != nil {
+					return merry.Wrap(err)
+				}
+			}
+			// participants
+			if chat.Type != ChatUser && config.Participants.Match(chat, nil) == MatchTrue {
+				log.Info("saving participants of: %s (%s) #%d %v",
+					green(chat.Title), chat.Username, chat.ID, chat.Type)
+				if err := loadAndSaveParticipants(tg, chat, history); err != nil {
+					return merry.Wrap(err)
+				}
+			}
+			// profile photos
+			if config.ProfilePhotos.Match(chat, nil) == MatchTrue {
+				log.Info("saving profile photos of: %s (%s) #%d %v",
+					green(chat.Title), chat.Username, chat.ID, chat.Type)
+				if err := loadAndSaveProfilePhotos(tg, chat, history); err != nil {
+					return merry.Wrap(err)
+				}
+			}
+			// admin log
+			if tgCanReadAdminLog(chat.Obj) && config.AdminLog.Match(chat, nil) == MatchTrue {
+				log.Info("saving admin log of: %s (%s) #%d %v",
+					green(chat.Title), chat.Username, chat.ID, chat.Type)
+				if err := loadAndSaveAdminLog(tg, chat, history); err != nil {
+					return merry.Wrap(err)
+				}
+			}
 			// messages
 			if config.History.Match(chat, nil) == MatchTrue {
 				log.Info("saving messages from: %s (%s) #%d %v",
 					green(chat.Title), chat.Username, chat.ID, chat.Type)
-				if err := loadAndSaveMessages(tg, chat, saver, config); err != nil {
+				if tgIsForum(chat.Obj) {
+					if err := loadAndSaveForumTopics(tg, chat, history); err != nil {
+						return merry.Wrap(err)
+					}
+				}
+				if err := refetchPendingWebPages(tg, chat, history, MessageMediaFile); err != nil {
+					return merry.Wrap(err)
+				}
+				if err := refetchPendingWebPages(tg, chat, history, CommentMediaFile); err != nil {
+					return merry.Wrap(err)
+				}
+				if err := loadAndSaveMessages(tg, chat, history, config); err != nil {
+					return merry.Wrap(err)
+				}
+				if err := rescanEditedMessages(tg, chat, history, config); err != nil {
 					return merry.Wrap(err)
 				}
+				if err := saveMetricsSnapshot(tg, chat, history, config); err != nil {
+					return merry.Wrap(err)
+				}
+				if opts.VerifyGaps {
+					if err := verifyMessageGaps(tg, chat, history, config, gapsStats); err != nil {
+						return merry.Wrap(err)
+					}
+				}
+				if opts.Backfill {
+					if err := backfillMessages(tg, chat, history, config); err != nil {
+						return merry.Wrap(err)
+					}
+				}
+				if opts.CheckDeleted {
+					if err := checkDeletedMessages(tg, chat, history, config); err != nil {
+						return merry.Wrap(err)
+					}
+				}
 			}
 			// stories
-			if !*skipStories && mayHaveStories(chat) && config.Stories.Match(chat, nil) == MatchTrue {
+			if !opts.SkipStories && mayHaveStories(chat) && config.Stories.Match(chat, nil) == MatchTrue {
 				log.Info("saving stories  from: %s (%s) #%d %v",
 					green(chat.Title), chat.Username, chat.ID, chat.Type)
 				tryLoadArchived := chat.ID == me.ID || chat.Type == ChatChannel
-				if err := loadAndSaveStories(tg, chat, saver, tryLoadArchived); err != nil {
+				if err := refetchPendingWebPages(tg, chat, history, StoryMediaFile); err != nil {
+					return merry.Wrap(err)
+				}
+				if err := loadAndSaveStories(tg, chat, history, tryLoadArchived); err != nil {
+					return merry.Wrap(err)
+				}
+			}
+			return nil
+		}
+		interruptedChats := make(map[int64]*Chat)
+		interruptedChatsMutex := &sync.Mutex{}
+		trackInterrupted := func(dumpChat func(*Chat) error) func(*Chat) error {
+			return func(chat *Chat) error {
+				err := dumpChat(chat)
+				if errors.Is(err, errInterrupted) {
+					interruptedChatsMutex.Lock()
+					interruptedChats[chat.ID] = chat
+					interruptedChatsMutex.Unlock()
+				}
+				return err
+			}
+		}
+		dumpChats := func(chats []*Chat) error {
+			if err := dumpChatsConcurrently(chats, int(config.Concurrency), trackInterrupted(dumpChat)); err != nil {
+				return merry.Wrap(err)
+			}
+			// link previews are usually generated within seconds,
+			// so messages that were pending during the dump are likely ready by now
+			err := dumpChatsConcurrently(chats, int(config.Concurrency), trackInterrupted(func(chat *Chat) error {
+				if config.History.Match(chat, nil) == MatchTrue {
+					for _, source := range []MediaFileSource{MessageMediaFile, CommentMediaFile} {
+						if err := refetchPendingWebPages(tg, chat, history, source); err != nil {
+							return merry.Wrap(err)
+						}
+					}
+				}
+				if !opts.SkipStories && mayHaveStories(chat) && config.Stories.Match(chat, nil) == MatchTrue {
+					return merry.Wrap(refetchPendingWebPages(tg, chat, history, StoryMediaFile))
+				}
+				return nil
+			}))
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			if opts.VerifyGaps {
+				log.Info("gaps check summary: %d chat(s) checked, %d message(s) repaired, %d deleted (in channels)",
+					gapsStats.Chats, gapsStats.Repaired, gapsStats.Deleted)
+			}
+			// sticker sets are shared by chats, so they are saved after all chats are dumped
+			return merry.Wrap(stickers.SavePending(tg))
+		}
+		// chunks are already saved completely at this point, remaining downloads are resumed on next run
+		stopInterrupted := func() error {
+			downloadQueue.Abort()
+			checkpoint := &Checkpoint{
+				InterruptedAt:    time.Now(),
+				Signal:           interrupter.Signal().String(),
+				PendingDownloads: downloadQueue.PendingCount(),
+			}
+			for _, chat := range interruptedChats {
+				lastID, err := history.GetLastMessageID(chat)
+				if err != nil {
 					return merry.Wrap(err)
 				}
+				checkpoint.Chats = append(checkpoint.Chats, CheckpointChat{ID: chat.ID, Title: chat.Title, LastMessageID: lastID})
+			}
+			if err := saver.SaveCheckpoint(checkpoint); err != nil {
+				return merry.Wrap(err)
+			}
+			log.Info("saved checkpoint: %d chat(s) in progress, %d file(s) left to download",
+				len(checkpoint.Chats), checkpoint.PendingDownloads)
+			return errInterrupted
+		}
+
+		if opts.Watch {
+			watcher := NewUpdatesWatcher(tg, history, config, reconnected)
+			// updates state is requested before the dump, so messages received during the dump won't be missed
+			if err := watcher.Reset(chats); err != nil {
+				return merry.Wrap(err)
+			}
+			if err := dumpChats(chats); err != nil {
+				if errors.Is(err, errInterrupted) {
+					return stopInterrupted()
+				}
+				return merry.Wrap(err)
+			}
+			loadChats := func() ([]*Chat, error) {
+				chats, err := tgLoadChats(tg)
+				if err != nil {
+					return nil, merry.Wrap(err)
+				}
+				chats = prependSelfChat(chats, me)
+				// files of chats missing from the previous list may have been parked
+				chatsByID.Replace(chats)
+				downloadQueue.UnparkAll()
+				return chats, merry.Wrap(saveChatsAsRelated(chats, history))
+			}
+			if err := watcher.Run(loadChats, dumpChats); err != nil {
+				if errors.Is(err, errInterrupted) {
+					return stopInterrupted()
+				}
+				return merry.Wrap(err)
+			}
+		} else if err := dumpChats(chats); err != nil {
+			if errors.Is(err, errInterrupted) {
+				return stopInterrupted()
 			}
+			return merry.Wrap(err)
+		}
+
+		downloadQueue.Close()
+		downloadsDone := make(chan struct{})
+		go func() {
+			downloadsWG.Wait()
+			close(downloadsDone)
+		}()
+		select {
+		case <-downloadsDone:
+		case <-interrupter.Done():
+			return stopInterrupted()
+		}
+		if err := saver.RemoveCheckpoint(); err != nil {
+			return merry.Wrap(err)
 		}
 	}
 
@@ -566,6 +2201,10 @@ func dump() error {
 
 func main() {
 	if err := dump(); err != nil {
+		if errors.Is(err, errInterrupted) {
+			log.Warn("interrupted, run again to resume")
+			os.Exit(130)
+		}
 		log.Error(err, "")
 		os.Exit(1)
 	}
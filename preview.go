@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"embed"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -28,6 +31,7 @@ var staticFS embed.FS
 
 type Server struct {
 	config         *Config
+	accounts       []*Config
 	saver          *JSONFilesHistorySaver
 	userReader     *ChatSyncReader[UserData]
 	chatReader     *ChatSyncReader[ChatData]
@@ -46,6 +50,27 @@ type ChatPageView struct {
 	Limit               int
 	HasPrev             bool
 	HasNext             bool
+	Topics              []ForumTopic
+	TopicID             int32
+}
+
+type ForumTopic struct {
+	ID    int32
+	Title string
+}
+
+// MetricsChart is a small chart of channel post views built from metrics snapshots.
+type MetricsChart struct {
+	Points         string //SVG polyline points
+	Width          int
+	Height         int
+	FirstAt        time.Time
+	LastAt         time.Time
+	FirstViews     int32
+	LastViews      int32
+	Forwards       int //from the last snapshot
+	Reactions      int //from the last snapshot
+	SnapshotsCount int
 }
 
 type File struct {
@@ -56,22 +81,71 @@ type File struct {
 	Size        int64
 }
 
+// PreviewURLs makes links for preview pages: absolute ones for HTTP server
+// and relative ones for static HTML export (see [StaticPreviewURLs]).
+type PreviewURLs interface {
+	Chat(chatID int64, from, limit int, topicID int32) string
+	// "/files/123_Chat/1_Media.jpg" -> link to this file
+	File(webPath string) string
+	Static(name string) string
+	Account(name string) string
+}
+
+type HTTPPreviewURLs struct{}
+
+func (HTTPPreviewURLs) Chat(chatID int64, from, limit int, topicID int32) string {
+	query := url.Values{}
+	if limit != 0 {
+		query.Set("from", strconv.Itoa(from))
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if topicID != 0 {
+		query.Set("topic", strconv.FormatInt(int64(topicID), 10))
+	}
+	res := "/chats/" + strconv.FormatInt(chatID, 10)
+	if len(query) > 0 {
+		res += "?" + query.Encode()
+	}
+	return res
+}
+
+func (HTTPPreviewURLs) File(webPath string) string {
+	return webPath
+}
+
+func (HTTPPreviewURLs) Static(name string) string {
+	return "/static/" + name
+}
+
+func (HTTPPreviewURLs) Account(name string) string {
+	return "/?account=" + url.QueryEscape(name)
+}
+
+type ChatWithTitle struct {
+	SavedChatEntry
+	Title      string
+	AvatarPath string
+}
+
 func (s *Server) chatsPageHandler(w http.ResponseWriter, r *http.Request) error {
-	type ChatWithTitle struct {
-		SavedChatEntry
-		Title string
+	chats, err := s.loadChatsList()
+	if err != nil {
+		return merry.Wrap(err)
 	}
+	return merry.Wrap(s.renderTemplate(w, HTTPPreviewURLs{}, "chats.html", chats))
+}
 
+func (s *Server) loadChatsList() ([]ChatWithTitle, error) {
 	chatEntries, err := s.saver.ReadSavedChatsList()
 	if err != nil {
-		return merry.Wrap(err)
+		return nil, merry.Wrap(err)
 	}
 
 	if err := s.userReader.UpdateOffsets(); err != nil {
-		return merry.Wrap(err)
+		return nil, merry.Wrap(err)
 	}
 	if err := s.chatReader.UpdateOffsets(); err != nil {
-		return merry.Wrap(err)
+		return nil, merry.Wrap(err)
 	}
 
 	chats := make([]ChatWithTitle, len(chatEntries))
@@ -81,10 +155,14 @@ func (s *Server) chatsPageHandler(w http.ResponseWriter, r *http.Request) error
 		if err != nil {
 			log.Warn("chat #%d reading error: %s", chatEntry.ID, err)
 		}
+		avatarFName, err := s.findChatAvatarFName(chatEntry.ID)
+		if err != nil {
+			log.Warn("chat #%d profile photo reading error: %s", chatEntry.ID, err)
+		} else if avatarFName != "" {
+			chats[i].AvatarPath = fmt.Sprintf("/files/avatars/%d/%s", chatEntry.ID, avatarFName)
+		}
 	}
-
-	s.renderTemplate(w, "chats.html", chats)
-	return nil
+	return chats, nil
 }
 
 func (s *Server) chatPageHandler(w http.ResponseWriter, r *http.Request) error {
@@ -95,8 +173,10 @@ func (s *Server) chatPageHandler(w http.ResponseWriter, r *http.Request) error {
 
 	limitStr := r.URL.Query().Get("limit")
 	fromStr := r.URL.Query().Get("from")
+	topicStr := r.URL.Query().Get("topic")
 	limit := 10000
 	from := 0
+	topicID := int32(0)
 
 	if limitStr != "" {
 		limit, err = strconv.Atoi(limitStr)
@@ -112,6 +192,14 @@ func (s *Server) chatPageHandler(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
+	if topicStr != "" {
+		id, err := strconv.ParseInt(topicStr, 10, 32)
+		if err != nil {
+			return merry.Prepend(err, "invalid topic")
+		}
+		topicID = int32(id)
+	}
+
 	chatEntries, err := s.saver.ReadSavedChatsList()
 	if err != nil {
 		return merry.Wrap(err)
@@ -127,11 +215,21 @@ func (s *Server) chatPageHandler(w http.ResponseWriter, r *http.Request) error {
 		return merry.Prepend(err, "couldn't load chat")
 	}
 
-	if err := s.userReader.UpdateOffsets(); err != nil {
+	view, err := s.loadChatPage(chatEntry, from, limit, topicID)
+	if err != nil {
 		return merry.Wrap(err)
 	}
+	return merry.Wrap(s.renderTemplate(w, HTTPPreviewURLs{}, "chat.html", view))
+}
+
+// loadChatPage reads limit messages of the chat (or of its forum topic) starting from the offset from.
+func (s *Server) loadChatPage(chatEntry SavedChatEntry, from, limit int, topicID int32) (*ChatPageView, error) {
+	chatID := chatEntry.ID
+	if err := s.userReader.UpdateOffsets(); err != nil {
+		return nil, merry.Wrap(err)
+	}
 	if err := s.chatReader.UpdateOffsets(); err != nil {
-		return merry.Wrap(err)
+		return nil, merry.Wrap(err)
 	}
 
 	userReader := &ChatCachedReader[UserData]{reader: s.userReader}
@@ -139,31 +237,96 @@ func (s *Server) chatPageHandler(w http.ResponseWriter, r *http.Request) error {
 
 	userData, err := userReader.ReadOpt(chatID)
 	if err != nil {
-		return merry.Wrap(err)
+		return nil, merry.Wrap(err)
 	}
 	chatData, err := chatReader.ReadOpt(chatID)
 	if err != nil {
-		return merry.Wrap(err)
+		return nil, merry.Wrap(err)
 	}
 
 	chatTitle, err := s.readChatTitle(userReader, chatReader, chatID, chatEntry.FSTitle)
 	if err != nil {
-		return merry.Wrap(err)
+		return nil, merry.Wrap(err)
 	}
 
-	filesByIds, err := s.loadChatFiles(chatID)
+	filesByIds, err := s.loadChatFiles(chatID, MessageMediaFile)
 	if err != nil {
-		return merry.Wrap(err)
+		return nil, merry.Wrap(err)
 	}
 
-	messages, hasNext, err := s.chatsMsgReader.Read(chatEntry.FPath, from, limit)
+	commentsByPostID, err := s.loadChatComments(chatID, chatEntry.FPath+chatCommentsFileSuffix, userReader, chatReader)
 	if err != nil {
-		return merry.Wrap(err)
+		return nil, merry.Wrap(err)
+	}
+
+	topics, err := loadChatForumTopics(chatEntry.FPath + chatTopicsFileSuffix)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	var messages []map[string]interface{}
+	var hasNext bool
+	var msgsTotalApprox int64
+	if topicID == 0 {
+		messages, hasNext, err = s.chatsMsgReader.Read(chatEntry.FPath, from, limit)
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+		msgsTotalApprox, err = s.chatsMsgReader.EstimateMessagesCount(chatEntry.FPath)
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+	} else {
+		// messages of all topics are stored in a single file, so filtering and paginating in memory
+		allMessages, _, err := s.chatsMsgReader.Read(chatEntry.FPath, 0, 0)
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+		var topicMessages []map[string]interface{}
+		for _, t := range allMessages {
+			if id, ok := t["_TOPIC_ID"].(float64); ok && int32(id) == topicID {
+				topicMessages = append(topicMessages, t)
+			}
+		}
+		msgsTotalApprox = int64(len(topicMessages))
+		if from > len(topicMessages) {
+			from = len(topicMessages)
+		}
+		end := len(topicMessages)
+		if limit > 0 && from+limit < end {
+			end = from + limit
+			hasNext = true
+		}
+		messages = topicMessages[from:end]
+	}
+
+	deletedMessages, err := readDeletedMessages(chatEntry.FPath + chatDeletedFileSuffix)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	metricsSnapshots, err := readMetricsSnapshots(chatEntry.FPath + chatMetricsFileSuffix)
+	if err != nil {
+		return nil, merry.Wrap(err)
 	}
+	metricsCharts := buildMetricsCharts(metricsSnapshots)
+
+	// empty messages (placeholders of skipped ones) have nothing to show
+	shownMessages := messages[:0]
+	for _, t := range messages {
+		if t["_"] != "TL_messageEmpty" {
+			shownMessages = append(shownMessages, t)
+		}
+	}
+	messages = shownMessages
 
 	for _, t := range messages {
 		id := int64(t["ID"].(float64))
 
+		if deleted, ok := deletedMessages[int32(id)]; ok {
+			t["__DeletedAt"] = deleted.DetectedAt
+		}
+
 		if t["_"] == "TL_messageService" {
 			action := t["Action"].(map[string]interface{})
 			// TL_messageActionChatCreate -> "ChatCreate"
@@ -173,6 +336,14 @@ func (s *Server) chatPageHandler(w http.ResponseWriter, r *http.Request) error {
 				t["__Files"] = files
 			}
 
+			if comments, ok := commentsByPostID[id]; ok {
+				t["__Comments"] = comments
+			}
+
+			if chart, ok := metricsCharts[int32(id)]; ok {
+				t["__Metrics"] = chart
+			}
+
 			if _, ok := t["Message"]; ok {
 				t["__MessageParts"] = applyEntities(t["Message"].(string), t["Entities"].([]interface{}))
 			}
@@ -223,12 +394,7 @@ func (s *Server) chatPageHandler(w http.ResponseWriter, r *http.Request) error {
 	}
 	next := from + limit
 
-	msgsTotalApprox, err := s.chatsMsgReader.EstimateMessagesCount(chatEntry.FPath)
-	if err != nil {
-		return merry.Wrap(err)
-	}
-
-	s.renderTemplate(w, "chat.html", ChatPageView{
+	return &ChatPageView{
 		ChatID:              chatID,
 		ChatTitle:           chatTitle,
 		Messages:            messages,
@@ -239,8 +405,9 @@ func (s *Server) chatPageHandler(w http.ResponseWriter, r *http.Request) error {
 		Limit:               limit,
 		HasPrev:             hasPrev,
 		HasNext:             hasNext,
-	})
-	return nil
+		Topics:              topics,
+		TopicID:             topicID,
+	}, nil
 }
 
 func (s *Server) getFirstLastNames(
@@ -503,10 +670,150 @@ func (s *Server) readChatTitle(
 	return fallback, nil
 }
 
-func (s *Server) loadChatFiles(chatID int64) (map[int64][]File, error) {
+// findChatAvatarFName returns file name of the current (according to the saved user/chat record)
+// profile photo of the chat, or an empty string if there is no such photo.
+func (s *Server) findChatAvatarFName(chatID int64) (string, error) {
+	var photoID int64
+	userData, found, err := s.userReader.Read(chatID)
+	if err != nil {
+		return "", merry.Wrap(err)
+	}
+	if found {
+		photoID = userData.PhotoID
+	} else {
+		chatData, found, err := s.chatReader.Read(chatID)
+		if err != nil {
+			return "", merry.Wrap(err)
+		}
+		if found {
+			photoID = chatData.PhotoID
+		}
+	}
+	return s.saver.FindCurrentAvatarFName(chatID, photoID)
+}
+
+// loadChatForumTopics reads forum topics list (if any) of the chat.
+func loadChatForumTopics(fpath string) ([]ForumTopic, error) {
+	if _, err := os.Stat(fpath); os.IsNotExist(err) {
+		return nil, nil
+	}
+	items, _, err := NewJSONMessageReader(fpath).Read(0, 0)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	var topics []ForumTopic
+	for _, t := range items {
+		if t["_"] != "TL_forumTopic" {
+			continue
+		}
+		topics = append(topics, ForumTopic{ID: int32(t["ID"].(float64)), Title: t["Title"].(string)})
+	}
+	return topics, nil
+}
+
+// buildMetricsCharts makes views charts for posts that have at least two snapshots.
+func buildMetricsCharts(snapshots []MetricsSnapshotData) map[int32]*MetricsChart {
+	type point struct {
+		at    time.Time
+		views int32
+	}
+	pointsByID := make(map[int32][]point)
+	lastByID := make(map[int32]MessageMetricsData)
+	for _, snapshot := range snapshots {
+		for _, m := range snapshot.Messages {
+			if m.Views != nil {
+				pointsByID[m.ID] = append(pointsByID[m.ID], point{snapshot.TakenAt, *m.Views})
+			}
+			lastByID[m.ID] = m
+		}
+	}
+
+	charts := make(map[int32]*MetricsChart)
+	for id, points := range pointsByID {
+		if len(points) < 2 {
+			continue
+		}
+		first, last := points[0], points[len(points)-1]
+		minViews, maxViews := first.views, first.views
+		for _, p := range points {
+			minViews = min(minViews, p.views)
+			maxViews = max(maxViews, p.views)
+		}
+
+		chart := &MetricsChart{
+			Width: 120, Height: 24,
+			FirstAt: first.at, LastAt: last.at,
+			FirstViews: first.views, LastViews: last.views,
+			SnapshotsCount: len(points),
+		}
+		duration := last.at.Sub(first.at).Seconds()
+		var buf strings.Builder
+		for _, p := range points {
+			x, y := 0.0, 0.5
+			if duration > 0 {
+				x = p.at.Sub(first.at).Seconds() / duration
+			}
+			if maxViews > minViews {
+				y = float64(p.views-minViews) / float64(maxViews-minViews)
+			}
+			fmt.Fprintf(&buf, "%.1f,%.1f ", x*float64(chart.Width), (1-y)*float64(chart.Height-2)+1)
+		}
+		chart.Points = strings.TrimSpace(buf.String())
+
+		lastMetrics := lastByID[id]
+		chart.Forwards = int(derefOr(lastMetrics.Forwards, 0))
+		for _, count := range lastMetrics.Reactions {
+			chart.Reactions += int(count)
+		}
+		charts[id] = chart
+	}
+	return charts
+}
+
+// loadChatComments reads channel posts comments (if any) grouped by post ID.
+func (s *Server) loadChatComments(
+	chatID int64, fpath string,
+	userReader *ChatCachedReader[UserData],
+	chatReader *ChatCachedReader[ChatData],
+) (map[int64][]map[string]interface{}, error) {
+	commentsByPostID := make(map[int64][]map[string]interface{})
+	if _, err := os.Stat(fpath); os.IsNotExist(err) {
+		return commentsByPostID, nil
+	}
+
+	comments, _, err := NewJSONMessageReader(fpath).Read(0, 0)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	filesByIds, err := s.loadChatFiles(chatID, CommentMediaFile)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	for _, t := range comments {
+		postID := int64(t["_POST_ID"].(float64))
+		if t["_"] == "TL_messageService" {
+			continue
+		}
+		if files, ok := filesByIds[int64(t["ID"].(float64))]; ok {
+			t["__Files"] = files
+		}
+		if _, ok := t["Message"]; ok {
+			t["__MessageParts"] = applyEntities(t["Message"].(string), t["Entities"].([]interface{}))
+		}
+		t["__FromFirstName"], t["__FromLastName"], err = s.getFirstLastNames(t, userReader, chatReader)
+		if err != nil {
+			log.Error(err, "")
+		}
+		commentsByPostID[postID] = append(commentsByPostID[postID], t)
+	}
+	return commentsByPostID, nil
+}
+
+func (s *Server) loadChatFiles(chatID int64, mediaSource MediaFileSource) (map[int64][]File, error) {
 	filesById := make(map[int64][]File)
 
-	files, err := s.saver.ReadSavedChatFilesList(chatID)
+	files, err := s.saver.ReadSavedChatFilesList(chatID, mediaSource)
 	if err != nil {
 		return nil, merry.Wrap(err)
 	}
@@ -546,7 +853,7 @@ func (s *Server) loadChatFiles(chatID int64) (map[int64][]File, error) {
 	return filesById, nil
 }
 
-func (s *Server) renderTemplate(w http.ResponseWriter, tmpl string, data interface{}) {
+func (s *Server) renderTemplate(w io.Writer, urls PreviewURLs, tmpl string, data interface{}) error {
 	templates := template.New("").Funcs(template.FuncMap{
 		"formatDate": func(date interface{}) string {
 			return time.Unix(int64(date.(float64)), 0).Format("02.01.2006 15:04:05")
@@ -575,6 +882,23 @@ func (s *Server) renderTemplate(w http.ResponseWriter, tmpl string, data interfa
 		"add": func(a, b int) int {
 			return a + b
 		},
+		"chatURL":   urls.Chat,
+		"fileURL":   urls.File,
+		"staticURL": urls.Static,
+		"accounts": func() []PreviewAccountLink {
+			if len(s.accounts) < 2 {
+				return nil
+			}
+			links := make([]PreviewAccountLink, len(s.accounts))
+			for i, account := range s.accounts {
+				links[i] = PreviewAccountLink{
+					Name:      account.Name,
+					URL:       urls.Account(account.Name),
+					IsCurrent: account == s.config,
+				}
+			}
+			return links
+		},
 		"canDisplayAsImg": func(msg map[string]interface{}, file File) bool {
 			// or $.Media.Photo $.Media.ExtendedMedia $.Media.Webpage.Photo $.Media.VideoCover
 			return isSet(msg, "Media", "Photo") ||
@@ -587,16 +911,11 @@ func (s *Server) renderTemplate(w http.ResponseWriter, tmpl string, data interfa
 	// Parse the layout and the specific template
 	templates, err := templates.ParseFS(templatesFS, "preview_templates/layout.html", "preview_templates/"+tmpl)
 	if err != nil {
-		log.Info("Error parsing templates: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return merry.Prepend(err, "parsing templates")
 	}
 
 	err = templates.ExecuteTemplate(w, "layout.html", data)
-	if err != nil {
-		log.Info("Error rendering template %s: %v", tmpl, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	return merry.Prependf(err, "rendering template %s", tmpl)
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -724,9 +1043,48 @@ func withError(handler func(http.ResponseWriter, *http.Request) error) func(http
 	}
 }
 
-func servePreviewHttp(addr string, config *Config, saver *JSONFilesHistorySaver) error {
+type PreviewAccountLink struct {
+	Name      string
+	URL       string
+	IsCurrent bool
+}
+
+// AccountsServer switches between dumps of config.accounts. Selected account is stored in a cookie,
+// so pages and files have the same URLs for all accounts.
+type AccountsServer struct {
+	accounts []*Config
+	servers  map[string]*Server
+}
+
+const previewAccountCookieName = "account"
+
+func (s *AccountsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if name := r.URL.Query().Get("account"); name != "" {
+		if _, ok := s.servers[name]; !ok {
+			http.Error(w, fmt.Sprintf("account '%s' not found", name), http.StatusNotFound)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: previewAccountCookieName, Value: url.QueryEscape(name), Path: "/"})
+		http.Redirect(w, r, "/chats/", http.StatusFound)
+		return
+	}
+
+	server := s.servers[s.accounts[0].Name]
+	if cookie, err := r.Cookie(previewAccountCookieName); err == nil {
+		if name, err := url.QueryUnescape(cookie.Value); err == nil {
+			if accServer, ok := s.servers[name]; ok {
+				server = accServer
+			}
+		}
+	}
+	server.ServeHTTP(w, r)
+}
+
+func newPreviewServer(config *Config, accounts []*Config) *Server {
+	saver := NewJSONFilesHistorySaver(config.OutDirPath)
 	server := &Server{
 		config:         config,
+		accounts:       accounts,
 		saver:          saver,
 		userReader:     NewChatSyncReader[UserData](saver.usersFPath()),
 		chatReader:     NewChatSyncReader[ChatData](saver.chatsFPath()),
@@ -744,6 +1102,14 @@ func servePreviewHttp(addr string, config *Config, saver *JSONFilesHistorySaver)
 
 	staticFS, _ := fs.Sub(staticFS, "preview_static")
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticFS))))
+	return server
+}
+
+func servePreviewHttp(addr string, accounts []*Config) error {
+	server := &AccountsServer{accounts: accounts, servers: make(map[string]*Server, len(accounts))}
+	for _, config := range accounts {
+		server.servers[config.Name] = newPreviewServer(config, accounts)
+	}
 
 	log.Info("Starting server on http://%s", addr) //"http://" makes the address openable with Ctrl+Click in some terminal emulators (like GNOME Terminal)
 	if err := http.ListenAndServe(addr, server); err != nil {
@@ -751,3 +1117,186 @@ func servePreviewHttp(addr string, config *Config, saver *JSONFilesHistorySaver)
 	}
 	return nil
 }
+
+// StaticPreviewURLs makes links relative to a page of static HTML export:
+//
+//	index.html                               chats list
+//	chats/<id>.html, chats/<id>_<page>.html  chat messages (pages 1, 2, 3...)
+//	chats/<id>_topic<topic_id>.html, ...     forum topic messages
+//	files/, static/                          media files and assets
+//
+// Multiple accounts are exported to <account name> subfolders.
+type StaticPreviewURLs struct {
+	root string //path from the current page to the export root, "" or "../"
+}
+
+func (u StaticPreviewURLs) Chat(chatID int64, from, limit int, topicID int32) string {
+	return u.root + staticChatPagePath(chatID, from, limit, topicID)
+}
+
+func (u StaticPreviewURLs) File(webPath string) string {
+	return u.root + (&url.URL{Path: strings.TrimPrefix(webPath, "/")}).EscapedPath()
+}
+
+func (u StaticPreviewURLs) Static(name string) string {
+	return u.root + "static/" + name
+}
+
+func (u StaticPreviewURLs) Account(name string) string {
+	return u.root + "../" + url.PathEscape(escapeNameForFS(name)) + "/index.html"
+}
+
+func staticChatPagePath(chatID int64, from, limit int, topicID int32) string {
+	name := strconv.FormatInt(chatID, 10)
+	if topicID != 0 {
+		name += "_topic" + strconv.FormatInt(int64(topicID), 10)
+	}
+	if limit > 0 && from >= limit {
+		name += "_" + strconv.Itoa(from/limit+1)
+	}
+	return "chats/" + name + ".html"
+}
+
+const staticExportPageSize = 1000
+
+// exportStaticHTML renders preview pages of all accounts to dirpath, so the dump may be browsed without the dumper.
+func exportStaticHTML(dirpath string, accounts []*Config) error {
+	for _, config := range accounts {
+		accDirpath := dirpath
+		if len(accounts) > 1 {
+			accDirpath = dirpath + "/" + escapeNameForFS(config.Name)
+		}
+		if err := newPreviewServer(config, accounts).exportStatic(accDirpath); err != nil {
+			return merry.Prependf(err, "account %s", config.Name)
+		}
+	}
+	return nil
+}
+
+func (s *Server) exportStatic(dirpath string) error {
+	for _, name := range []string{"chats", "static"} {
+		if err := os.MkdirAll(dirpath+"/"+name, 0700); err != nil {
+			return merry.Wrap(err)
+		}
+	}
+
+	// assets
+	staticFS, _ := fs.Sub(staticFS, "preview_static")
+	err := fs.WalkDir(staticFS, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		buf, err := fs.ReadFile(staticFS, path)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		return merry.Wrap(os.WriteFile(dirpath+"/static/"+path, buf, 0600))
+	})
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	// media (hardlinked if possible)
+	filesDirpath := s.saver.chatsFilesDirpath()
+	err = filepath.WalkDir(filesDirpath, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && path == filesDirpath {
+			return nil
+		}
+		if err != nil || !d.Type().IsRegular() || strings.HasSuffix(path, ".temp") {
+			return err
+		}
+		relPath, err := filepath.Rel(filesDirpath, path)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		return merry.Wrap(linkOrCopyFile(path, dirpath+"/files/"+filepath.ToSlash(relPath)))
+	})
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	// pages
+	chats, err := s.loadChatsList()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if err := s.writeStaticPage(dirpath+"/index.html", StaticPreviewURLs{root: ""}, "chats.html", chats); err != nil {
+		return merry.Wrap(err)
+	}
+	for _, chat := range chats {
+		topics, err := loadChatForumTopics(chat.FPath + chatTopicsFileSuffix)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		topicIDs := []int32{0}
+		for _, topic := range topics {
+			topicIDs = append(topicIDs, topic.ID)
+		}
+
+		for _, topicID := range topicIDs {
+			for from := 0; ; {
+				if err := checkInterrupted(); err != nil {
+					return merry.Wrap(err)
+				}
+				view, err := s.loadChatPage(chat.SavedChatEntry, from, staticExportPageSize, topicID)
+				if err != nil {
+					return merry.Prependf(err, "chat #%d", chat.ID)
+				}
+				fpath := dirpath + "/" + staticChatPagePath(chat.ID, from, staticExportPageSize, topicID)
+				if err := s.writeStaticPage(fpath, StaticPreviewURLs{root: "../"}, "chat.html", view); err != nil {
+					return merry.Wrap(err)
+				}
+				if !view.HasNext {
+					break
+				}
+				from = view.Next
+			}
+		}
+	}
+	log.Info("exported %d chat(s) to %s", len(chats), dirpath+"/index.html")
+	return nil
+}
+
+func (s *Server) writeStaticPage(fpath string, urls PreviewURLs, tmpl string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := s.renderTemplate(&buf, urls, tmpl, data); err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(os.WriteFile(fpath, buf.Bytes(), 0600))
+}
+
+// linkOrCopyFile makes a hardlink (or a copy if files are on different devices) of src,
+// files with the same size are assumed to be already exported.
+func linkOrCopyFile(src, dst string) error {
+	srcStat, err := os.Stat(src)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if dstStat, err := os.Stat(dst); err == nil && dstStat.Size() == srcStat.Size() {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return merry.Wrap(err)
+	}
+	if err := removeIfExists(dst); err != nil {
+		return merry.Wrap(err)
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer srcFile.Close()
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer dstFile.Close()
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(dstFile.Close())
+}
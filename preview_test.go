@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/3bl3gamer/tgclient/mtproto"
+)
+
+func TestStaticPreviewURLs(t *testing.T) {
+	root := StaticPreviewURLs{root: ""}
+	assertEqual(t, root.Chat(5, 0, 0, 0), "chats/5.html")
+	assertEqual(t, root.Static("style.css"), "static/style.css")
+	assertEqual(t, root.Account("work"), "../work/index.html")
+
+	page := StaticPreviewURLs{root: "../"}
+	assertEqual(t, page.Chat(5, 0, 1000, 0), "../chats/5.html")
+	assertEqual(t, page.Chat(5, 1000, 1000, 0), "../chats/5_2.html")
+	assertEqual(t, page.Chat(5, 2000, 1000, 3), "../chats/5_topic3_3.html")
+	assertEqual(t, page.File("/files/5_Bob/1_0_my photo#1.jpg"), "../files/5_Bob/1_0_my%20photo%231.jpg")
+	assertEqual(t, page.Static("style.css"), "../static/style.css")
+	assertEqual(t, page.Account("home/work"), "../../home_work/index.html")
+}
+
+func TestStaticChatPagePath(t *testing.T) {
+	for _, c := range []struct {
+		from, limit int
+		topicID     int32
+		expected    string
+	}{
+		{0, 0, 0, "chats/5.html"},
+		{0, 1000, 0, "chats/5.html"},
+		{999, 1000, 0, "chats/5.html"},
+		{1000, 1000, 0, "chats/5_2.html"},
+		{2500, 1000, 0, "chats/5_3.html"},
+		{0, 1000, 7, "chats/5_topic7.html"},
+		{1000, 1000, 7, "chats/5_topic7_2.html"},
+	} {
+		assertEqual(t, staticChatPagePath(5, c.from, c.limit, c.topicID), c.expected)
+	}
+}
+
+func TestExportStatic(t *testing.T) {
+	prevLog := log
+	log = mtproto.Logger{Hnd: mtproto.NoopLogHandler{}}
+	t.Cleanup(func() { log = prevLog })
+
+	config := &Config{Name: "main", OutDirPath: t.TempDir()}
+	saver := NewJSONFilesHistorySaver(config.OutDirPath)
+	chat := &Chat{ID: 5, Title: "Bob", Type: ChatUser}
+	bob := "Bob"
+	if err := saver.SaveRelatedUsers([]mtproto.TL{mtproto.TL_user{ID: 5, FirstName: &bob}}); err != nil {
+		t.Fatal(err)
+	}
+	var messages []mtproto.TL
+	for id := int32(1); id <= staticExportPageSize+1; id++ {
+		messages = append(messages, mtproto.TL_message{ID: id, Message: "hello"})
+	}
+	if err := saver.SaveMessages(chat, messages); err != nil {
+		t.Fatal(err)
+	}
+	fpath, err := saver.MessageFileFPath(chat, staticExportPageSize+1, "my photo.jpg", 0, MessageMediaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(fpath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fpath, []byte("jpeg"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dirpath := t.TempDir()
+	if err := exportStaticHTML(dirpath, []*Config{config}); err != nil {
+		t.Fatal(err)
+	}
+	read := func(t *testing.T, fpath string) string {
+		t.Helper()
+		buf, err := os.ReadFile(dirpath + "/" + fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	index := read(t, "index.html")
+	if !strings.Contains(index, `href="chats/5.html"`) || !strings.Contains(index, `href="static/style.css"`) {
+		t.Errorf("unexpected index page links: %s", index)
+	}
+
+	// pages link each other, links are relative to chats/
+	page1, page2 := read(t, "chats/5.html"), read(t, "chats/5_2.html")
+	if !strings.Contains(page1+page2, `href="../chats/5_2.html"`) || !strings.Contains(page1+page2, `href="../chats/5.html"`) {
+		t.Error("pages must link each other")
+	}
+	if !strings.Contains(page1+page2, `href="../static/style.css"`) {
+		t.Error("page must link styles relatively")
+	}
+	if !strings.Contains(page1+page2, `href="../files/5_Bob/1001_Media_my%20photo.jpg"`) {
+		t.Error("page must link media file relatively")
+	}
+
+	// media files and assets are exported along with pages
+	assertEqual(t, read(t, "files/5_Bob/1001_Media_my photo.jpg"), "jpeg")
+	if _, err := os.Stat(dirpath + "/static/style.css"); err != nil {
+		t.Error(err)
+	}
+}
@@ -4,12 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/3bl3gamer/tgclient/mtproto"
@@ -22,6 +25,7 @@ type MediaFileSource byte
 const (
 	MessageMediaFile MediaFileSource = iota
 	StoryMediaFile
+	CommentMediaFile
 )
 
 type UserData struct {
@@ -36,6 +40,7 @@ type UserData struct {
 	IsVerified  bool
 	IsPremium   bool
 	IsDeleted   bool
+	PhotoID     int64 `json:",omitempty"` //current profile photo
 	UpdatedAt   time.Time
 }
 
@@ -52,6 +57,7 @@ func NewUserDataFromTG(tgUser mtproto.TL_user) *UserData {
 		IsVerified:  tgUser.Verified,
 		IsPremium:   tgUser.Premium,
 		IsDeleted:   tgUser.Deleted,
+		PhotoID:     peerPhotoIDFromTG(tgUser.Photo),
 		UpdatedAt:   time.Now(),
 	}
 }
@@ -69,7 +75,19 @@ func (u *UserData) IsUpdatedBy(other *mtproto.TL_user) bool {
 		u.IsScam != other.Scam ||
 		u.IsVerified != other.Verified ||
 		u.IsPremium != other.Premium ||
-		u.IsDeleted != other.Deleted
+		u.IsDeleted != other.Deleted ||
+		u.PhotoID != peerPhotoIDFromTG(other.Photo)
+}
+
+// peerPhotoIDFromTG returns ID of user/chat profile photo (or 0 if there is no photo).
+func peerPhotoIDFromTG(photoTL mtproto.TL) int64 {
+	switch photo := photoTL.(type) {
+	case mtproto.TL_userProfilePhoto:
+		return photo.PhotoID
+	case mtproto.TL_chatPhoto:
+		return photo.PhotoID
+	}
+	return 0
 }
 
 type ChatData struct {
@@ -77,19 +95,122 @@ type ChatData struct {
 	Username  *string
 	Title     string
 	IsChannel bool
+	PhotoID   int64 `json:",omitempty"` //current chat photo
+	// is loaded only for chats matched by config.full_info
+	Full      *ChatFullData `json:",omitempty"`
 	UpdatedAt time.Time
 }
 
+// ChatFullData is an extra info from channelFull/chatFull (https://core.telegram.org/constructor/channelFull).
+// Zero values mean "not set" (linked chat and slow mode are not available for basic groups).
+type ChatFullData struct {
+	About             string
+	ParticipantsCount int32
+	LinkedChatID      int64
+	SlowModeSeconds   int32
+	PinnedMsgID       int32
+	PhotoID           int64
+}
+
 func (c *ChatData) IsUpdatedBy(other *ChatData, otherIsMin bool) bool {
 	if otherIsMin {
 		return false
 	}
 	return !equalsOpt(c.Username, other.Username) ||
 		c.IsChannel != other.IsChannel ||
-		c.Title != other.Title
+		c.Title != other.Title ||
+		c.PhotoID != other.PhotoID ||
+		!equalsOpt(c.Full, other.Full)
+}
+
+// DeletedMessageData is a tombstone record for a message that was removed after being dumped.
+type DeletedMessageData struct {
+	ID         int32
+	DetectedAt time.Time
+}
+
+// PendingWebPageData is a record of message (or comment, or story) with webpage preview
+// that was not ready yet when the record was dumped.
+// Records are appended, the last one for each ID is the actual one.
+type PendingWebPageData struct {
+	ID         int32
+	PostID     int32 `json:",omitempty"` //commented post ID (for comments)
+	DetectedAt time.Time
+	ResolvedAt *time.Time `json:",omitempty"`
+}
+
+// MetricsSnapshotData is a record of channel posts counters at some moment.
+// Snapshots are appended, so counters can be tracked over time.
+type MetricsSnapshotData struct {
+	TakenAt  time.Time
+	Messages []MessageMetricsData
+}
+
+type MessageMetricsData struct {
+	ID       int32
+	Views    *int32 `json:",omitempty"`
+	Forwards *int32 `json:",omitempty"`
+	Replies  *int32 `json:",omitempty"`
+	// reaction (see tgReactionKey) -> count
+	Reactions map[string]int32 `json:",omitempty"`
+}
+
+// ParticipantData is a member of a group or channel.
+type ParticipantData struct {
+	UserID    int64
+	Role      string //"creator", "admin" or "member"
+	InviterID int64  `json:",omitempty"`
+	JoinedAt  int32  `json:",omitempty"` //Unix time, if known
+}
+
+// ParticipantsSnapshotData is a list of chat members, it is replaced on each run.
+type ParticipantsSnapshotData struct {
+	TakenAt time.Time
+	// total count reported by Telegram
+	Count int32
+	// not all participants are available (there are too many of them or they are hidden)
+	Partial      bool
+	Participants []ParticipantData
+}
+
+// ParticipantsChangeData is a record of members that have joined or left the chat since previous snapshot.
+type ParticipantsChangeData struct {
+	DetectedAt time.Time
+	Joined     []int64 `json:",omitempty"`
+	Left       []int64 `json:",omitempty"`
+	// some snapshot is partial, so only members that have joined after the previous snapshot are reported
+	Partial bool `json:",omitempty"`
+}
+
+// GapsCheckData is a range of saved message IDs (from the oldest to the last one) that was already checked
+// for gaps by -verify-gaps, so next checks may skip it.
+type GapsCheckData struct {
+	FromID    int32
+	ToID      int32
+	CheckedAt time.Time
+}
+
+// ChannelPTSData holds channel updates state (https://core.telegram.org/api/updates#message-related-event-sequences)
+// saved during last deleted messages check.
+type ChannelPTSData struct {
+	ID        int64
+	PTS       int32
+	UpdatedAt time.Time
 }
 
-type SaveFileCallbackFunc func(*Chat, *TGFileInfo, int32, MediaFileSource) error
+// SaveFileCallbackFunc is called for each file of saved message (or story, or comment).
+// Last argument is the commented post ID for comment files (and zero otherwise).
+type SaveFileCallbackFunc func(*Chat, *TGFileInfo, int32, MediaFileSource, int32) error
+
+// SaveStickersCallbackFunc is called for each saved message (to collect used sticker sets and custom emoji).
+type SaveStickersCallbackFunc func(*Chat, mtproto.TL) error
+
+// StickerRefData is a sticker set or a custom emoji found in saved messages (but not saved itself yet).
+type StickerRefData struct {
+	SetID      int64 `json:",omitempty"`
+	AccessHash int64 `json:",omitempty"`
+	EmojiID    int64 `json:",omitempty"`
+}
 
 func equalsOpt[T comparable](old, new *T) bool {
 	return new == old || (old != nil && new != nil && *new == *old)
@@ -177,7 +298,56 @@ func clampNameForFS(name string) string {
 	return name[:splitIndex] + ellipsis
 }
 
+// Chat history sidecar files are stored next to the history file
+// and have the same name with an extra suffix: history/<id>_<title>.<suffix>
+const (
+	chatEditsFileSuffix    = ".edits"
+	chatDeletedFileSuffix  = ".deleted"
+	chatCommentsFileSuffix = ".comments"
+	chatTopicsFileSuffix   = ".topics"
+	chatPendingFileSuffix  = ".pending"
+	chatOlderFileSuffix    = ".older"
+	chatGapsFileSuffix     = ".gaps"
+	chatMergingFileSuffix  = ".merging"
+	chatMetricsFileSuffix  = ".metrics"
+	// next to history/participants/<id>_<title>
+	chatSnapshotFileSuffix = ".snapshot"
+
+	// pending webpages of comments
+	chatCommentsPendingFileSuffix = chatCommentsFileSuffix + chatPendingFileSuffix
+	// range of message IDs already checked for gaps
+	chatGapsCheckedFileSuffix = ".gaps_checked"
+)
+
+var chatSidecarFileSuffixes = []string{
+	chatEditsFileSuffix, chatDeletedFileSuffix, chatCommentsFileSuffix, chatTopicsFileSuffix, chatPendingFileSuffix,
+	chatCommentsPendingFileSuffix, chatOlderFileSuffix, chatGapsFileSuffix, chatGapsCheckedFileSuffix, chatMergingFileSuffix,
+	chatMetricsFileSuffix,
+}
+
+func isChatSidecarFName(fname string) bool {
+	return isSidecarFName(fname, chatSidecarFileSuffixes)
+}
+
+// participantsSidecarFileSuffixes are suffixes of files next to history/participants/<id>_<title>
+var participantsSidecarFileSuffixes = []string{chatSnapshotFileSuffix}
+
+func isSidecarFName(fname string, sidecarSuffixes []string) bool {
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(fname, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
 func findFPathForID(dirpath string, id int64, defaultName string, canRename bool) (string, error) {
+	return findFPathForIDWithSidecars(dirpath, id, defaultName, canRename, chatSidecarFileSuffixes)
+}
+
+// findFPathForIDWithSidecars is like findFPathForID, but with files suffixes specific for the dirpath
+// (files with such suffixes are skipped while searching and are renamed along with the main file).
+func findFPathForIDWithSidecars(dirpath string, id int64, defaultName string, canRename bool, sidecarSuffixes []string) (string, error) {
 	fnamePrefix := fnameIDPrefix(id)
 	correctFPath := dirpath + "/" + clampNameForFS(fnamePrefix+escapeNameForFS(defaultName))
 
@@ -191,7 +361,7 @@ func findFPathForID(dirpath string, id int64, defaultName string, canRename bool
 	var matchedFNames []string
 	for _, entry := range entries {
 		fname := entry.Name()
-		if strings.HasPrefix(fname, fnamePrefix) {
+		if strings.HasPrefix(fname, fnamePrefix) && !isSidecarFName(fname, sidecarSuffixes) {
 			matchedFNames = append(matchedFNames, fname)
 		}
 	}
@@ -213,6 +383,12 @@ func findFPathForID(dirpath string, id int64, defaultName string, canRename bool
 			if err := os.Rename(curFPath, correctFPath); err != nil {
 				return "", merry.Wrap(err)
 			}
+			for _, suffix := range sidecarSuffixes {
+				err := os.Rename(curFPath+suffix, correctFPath+suffix)
+				if err != nil && !os.IsNotExist(err) {
+					return "", merry.Wrap(err)
+				}
+			}
 		}
 		return correctFPath, nil
 	} else {
@@ -225,21 +401,58 @@ type HistorySaver interface {
 	GetLastStoryID(*Chat) (int32, error)
 	SaveRelatedUsers([]mtproto.TL) error
 	SaveRelatedChats([]mtproto.TL) error
+	SaveChatFullInfo(mtproto.TL, *ChatFullData) error
 	SaveMessages(*Chat, []mtproto.TL) error
+	SaveMessageRevisions(*Chat, []mtproto.TL) (int, error)
+	GetSavedMessageIDs(*Chat) ([]int32, error)
+	SaveDeletedMessages(*Chat, []int32) error
+	SaveMetricsSnapshot(*Chat, MetricsSnapshotData) error
+	SaveParticipants(*Chat, *ParticipantsSnapshotData) (ParticipantsChangeData, error)
+	GetLastAdminLogEventID(*Chat) (int64, error)
+	SaveAdminLogEvents(*Chat, []mtproto.TL) error
+	GetChannelPTS(*Chat) (int32, error)
+	SaveChannelPTS(*Chat, int32) error
+	GetLastCommentIDs(*Chat) (map[int32]int32, error)
+	SaveComments(*Chat, int32, []mtproto.TL) error
+	SaveForumTopics(*Chat, []mtproto.TL) error
+	GetOldestMessageID(*Chat) (int32, int, error)
+	SaveOlderMessages(*Chat, []mtproto.TL) error
+	MergeOlderMessages(*Chat) error
+	FindMessageIDsGaps(*Chat) ([]MessageIDsGap, error)
+	GetGapsCheck(*Chat) (GapsCheckData, error)
+	SaveGapsCheck(*Chat, GapsCheckData) error
+	SaveGapMessages(*Chat, []mtproto.TL) error
+	MergeGapMessages(*Chat) error
+	GetPendingWebPages(*Chat, MediaFileSource) ([]PendingWebPageData, error)
+	SaveResolvedWebPages(*Chat, MediaFileSource, []mtproto.TL) (int, error)
 	SaveStories(*Chat, []mtproto.TL) error
+	AvatarFPath(int64, string) string
+	SetAvatarDate(int64, string, time.Time) error
 	SetFileRequestCallback(SaveFileCallbackFunc)
 	SaveAccount(mtproto.TL_user) error
 	SaveContacts([]mtproto.TL) error
 	SaveAuths([]mtproto.TL_authorization) error
 }
 
+// JSONFilesHistorySaver may be used by multiple chat workers at once:
+// shared data (users, chats, channels PTS) is guarded by mutex,
+// while each chat's own files are expected to be written by one worker at a time.
 type JSONFilesHistorySaver struct {
 	Dirpath         string
+	mutex           *sync.Mutex
 	usersReader     *JSONRecordsReader[UserData]
 	chatsReader     *JSONRecordsReader[ChatData]
 	usersData       map[int64]*UserData
 	chatsData       map[int64]*ChatData
+	revisionReaders map[string]*JSONRecordsReader[SavedMessageRevision]
+	channelsPTS     *JSONRecordsReader[ChannelPTSData]
 	requestFileFunc SaveFileCallbackFunc
+	// called for each message, so must be fast
+	requestStickersFunc SaveStickersCallbackFunc
+}
+
+func NewJSONFilesHistorySaver(dirpath string) *JSONFilesHistorySaver {
+	return &JSONFilesHistorySaver{Dirpath: dirpath, mutex: &sync.Mutex{}}
 }
 
 func (s JSONFilesHistorySaver) chatMessagesFPath(chat *Chat) (string, error) {
@@ -254,6 +467,63 @@ func (s JSONFilesHistorySaver) chatsFilesDirpath() string {
 	return s.Dirpath + "/files"
 }
 
+func (s JSONFilesHistorySaver) chatsFilesDirpathFor(mediaSource MediaFileSource) string {
+	switch mediaSource {
+	case StoryMediaFile:
+		return s.chatsFilesDirpath() + "/stories"
+	case CommentMediaFile:
+		return s.chatsFilesDirpath() + "/comments"
+	default:
+		return s.chatsFilesDirpath()
+	}
+}
+
+// Profile photos are stored by peer ID (without title): the same user or chat may have
+// multiple history directories (e.g. for messages and for stories), but only one set of photos.
+func (s JSONFilesHistorySaver) avatarsDirpath(peerID int64) string {
+	return s.chatsFilesDirpath() + "/avatars/" + strconv.FormatInt(peerID, 10)
+}
+
+func (s JSONFilesHistorySaver) AvatarFPath(peerID int64, fname string) string {
+	return s.avatarsDirpath(peerID) + "/" + fname
+}
+
+// SetAvatarDate sets photo modification time to the time it was uploaded.
+func (s JSONFilesHistorySaver) SetAvatarDate(peerID int64, fname string, date time.Time) error {
+	return merry.Wrap(os.Chtimes(s.AvatarFPath(peerID, fname), date, date))
+}
+
+// FindCurrentAvatarFName returns the name of the current profile photo (with photoID from user/chat object)
+// or an empty string if it was not downloaded.
+func (s JSONFilesHistorySaver) FindCurrentAvatarFName(peerID, photoID int64) (string, error) {
+	if photoID == 0 {
+		return "", nil
+	}
+	fname := strconv.FormatInt(photoID, 10) + ".jpg"
+	if _, err := os.Stat(s.AvatarFPath(peerID, fname)); os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", merry.Wrap(err)
+	}
+	return fname, nil
+}
+
+func (s JSONFilesHistorySaver) stickersDirpath() string {
+	return s.Dirpath + "/stickers"
+}
+
+func (s JSONFilesHistorySaver) pendingStickersFPath() string {
+	return s.stickersDirpath() + "/pending"
+}
+
+func (s JSONFilesHistorySaver) StickerFPath(set mtproto.TL_stickerSet, fname string) (string, error) {
+	dirpath, err := findFPathForID(s.stickersDirpath(), set.ID, set.ShortName, true)
+	if err != nil {
+		return "", merry.Wrap(err)
+	}
+	return dirpath + "/" + fname, nil
+}
+
 func (s JSONFilesHistorySaver) usersFPath() string {
 	return s.Dirpath + "/users"
 }
@@ -262,6 +532,10 @@ func (s JSONFilesHistorySaver) chatsFPath() string {
 	return s.Dirpath + "/chats"
 }
 
+func (s JSONFilesHistorySaver) channelsPTSFPath() string {
+	return s.Dirpath + "/channels_pts"
+}
+
 func (s JSONFilesHistorySaver) contactsFPath() string {
 	return s.Dirpath + "/contacts"
 }
@@ -274,16 +548,27 @@ func (s JSONFilesHistorySaver) accountFPath() string {
 	return s.Dirpath + "/account"
 }
 
+func (s JSONFilesHistorySaver) checkpointFPath() string {
+	return s.Dirpath + "/checkpoint"
+}
+
+func (s JSONFilesHistorySaver) chatParticipantsFPath(chat *Chat) (string, error) {
+	return findFPathForIDWithSidecars(s.Dirpath+"/participants", int64(chat.ID), chat.Title, true, participantsSidecarFileSuffixes)
+}
+
+func (s JSONFilesHistorySaver) chatAdminLogFPath(chat *Chat) (string, error) {
+	return findFPathForID(s.Dirpath+"/admin_log", int64(chat.ID), chat.Title, true)
+}
+
 func (s JSONFilesHistorySaver) chatStoriesFPath(chat *Chat) (string, error) {
 	return findFPathForID(s.Dirpath+"/stories", int64(chat.ID), chat.Title, true)
 }
 
 func (s JSONFilesHistorySaver) MessageFileFPath(chat *Chat, msgID int32, fname string, indexInMsg int64, mediaSource MediaFileSource) (string, error) {
-	baseDirPath := s.chatsFilesDirpath()
-	if mediaSource == StoryMediaFile {
-		baseDirPath += "/stories"
-	}
-	dirPath, err := findFPathForID(baseDirPath, int64(chat.ID), chat.Title, true)
+	s.mutex.Lock() //files dir may be renamed, and there may be multiple download workers
+	defer s.mutex.Unlock()
+
+	dirPath, err := findFPathForID(s.chatsFilesDirpathFor(mediaSource), int64(chat.ID), chat.Title, true)
 	if err != nil {
 		return "", merry.Wrap(err)
 	}
@@ -317,6 +602,12 @@ func (s JSONFilesHistorySaver) openAndTruncate(fpath string) (*os.File, error) {
 }
 
 func (s JSONFilesHistorySaver) getLastLineID(fpath string) (int32, error) {
+	id, err := s.getLastLineID64(fpath)
+	return int32(id), err
+}
+
+// getLastLineID64 is same as getLastLineID but for records with 64-bit IDs (like admin log events).
+func (s JSONFilesHistorySaver) getLastLineID64(fpath string) (int64, error) {
 	file, err := os.Open(fpath)
 	if os.IsNotExist(err) {
 		return 0, nil
@@ -358,11 +649,90 @@ func (s JSONFilesHistorySaver) getLastLineID(fpath string) (int32, error) {
 	if !ok {
 		return 0, merry.Errorf("malformed json: 'ID' attr is missing: %s", string(buf))
 	}
-	id, ok := idInterf.(float64)
-	if !ok {
-		return 0, merry.Errorf("malformed ID: %#v", idInterf)
+	switch id := idInterf.(type) {
+	case float64:
+		return int64(id), nil
+	case string: //int64 fields are saved as strings
+		if id, err := strconv.ParseInt(id, 10, 64); err == nil {
+			return id, nil
+		}
+	}
+	return 0, merry.Errorf("malformed ID: %#v", idInterf)
+}
+
+// truncatePartialLine removes the last line if it is not terminated with a newline
+// (i.e. process was killed while writing a record). Returns true if file was truncated.
+func truncatePartialLine(fpath string) (bool, error) {
+	file, err := os.OpenFile(fpath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, merry.Wrap(err)
+	}
+	defer file.Close()
+
+	endPos, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, merry.Wrap(err)
+	}
+	buf := make([]byte, 4096)
+	pos := endPos
+	for pos > 0 {
+		chunkStart := max(pos-int64(len(buf)), 0)
+		chunk := buf[:pos-chunkStart]
+		if _, err := file.ReadAt(chunk, chunkStart); err != nil {
+			return false, merry.Wrap(err)
+		}
+		if pos == endPos && chunk[len(chunk)-1] == '\n' {
+			return false, nil
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			pos = chunkStart + int64(i) + 1
+			break
+		}
+		pos = chunkStart
+	}
+	if pos == endPos {
+		return false, nil
+	}
+	if err := file.Truncate(pos); err != nil {
+		return false, merry.Wrap(err)
+	}
+	return true, merry.Wrap(file.Close())
+}
+
+// TruncatePartialLines removes incomplete trailing records from history (and sidecar), stories
+// and related users/chats files. Returns paths of truncated files.
+func (s JSONFilesHistorySaver) TruncatePartialLines() ([]string, error) {
+	// other files may be in the same directory (if it is set so in config), they must not be touched
+	fpaths := []string{s.usersFPath(), s.chatsFPath(), s.channelsPTSFPath(), s.checkpointFPath(), s.pendingStickersFPath()}
+	for _, dirpath := range []string{s.chatsMessagesDirpath(), s.Dirpath + "/stories", s.Dirpath + "/participants", s.Dirpath + "/admin_log"} {
+		entries, err := os.ReadDir(dirpath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+		for _, entry := range entries {
+			if _, _, ok := matchFNameIDPrefix(entry.Name()); ok && entry.Type().IsRegular() {
+				fpaths = append(fpaths, dirpath+"/"+entry.Name())
+			}
+		}
+	}
+
+	var truncated []string
+	for _, fpath := range fpaths {
+		ok, err := truncatePartialLine(fpath)
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+		if ok {
+			truncated = append(truncated, fpath)
+		}
 	}
-	return int32(id), nil
+	return truncated, nil
 }
 
 func (s JSONFilesHistorySaver) GetLastMessageID(chat *Chat) (int32, error) {
@@ -381,6 +751,14 @@ func (s JSONFilesHistorySaver) GetLastStoryID(chat *Chat) (int32, error) {
 	return s.getLastLineID(chatFPath)
 }
 
+func (s JSONFilesHistorySaver) GetLastAdminLogEventID(chat *Chat) (int64, error) {
+	fpath, err := s.chatAdminLogFPath(chat)
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+	return s.getLastLineID64(fpath)
+}
+
 func findOrReadRelated[T UserData | ChatData](itemsMap map[int64]*T, itemsReader *JSONRecordsReader[T], id int64) (*T, bool, error) {
 	item, exists := itemsMap[id]
 	if exists {
@@ -400,6 +778,9 @@ func findOrReadRelated[T UserData | ChatData](itemsMap map[int64]*T, itemsReader
 }
 
 func (s *JSONFilesHistorySaver) SaveRelatedUsers(users []mtproto.TL) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	if s.usersReader == nil {
 		s.usersReader = NewJSONRecordsReader[UserData](s.usersFPath())
 		if err := s.usersReader.UpdateOffsets(); err != nil {
@@ -443,6 +824,18 @@ func (s *JSONFilesHistorySaver) SaveRelatedUsers(users []mtproto.TL) error {
 }
 
 func (s *JSONFilesHistorySaver) SaveRelatedChats(chats []mtproto.TL) error {
+	return merry.Wrap(s.saveRelatedChats(chats, nil))
+}
+
+// SaveChatFullInfo saves chat with its full info (as a new record if something has changed).
+func (s *JSONFilesHistorySaver) SaveChatFullInfo(chatTL mtproto.TL, full *ChatFullData) error {
+	return merry.Wrap(s.saveRelatedChats([]mtproto.TL{chatTL}, full))
+}
+
+func (s *JSONFilesHistorySaver) saveRelatedChats(chats []mtproto.TL, full *ChatFullData) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	if s.chatsReader == nil {
 		s.chatsReader = NewJSONRecordsReader[ChatData](s.chatsFPath())
 		if err := s.chatsReader.UpdateOffsets(); err != nil {
@@ -459,12 +852,12 @@ func (s *JSONFilesHistorySaver) SaveRelatedChats(chats []mtproto.TL) error {
 		chatIsMin := false
 		switch c := chatTL.(type) {
 		case mtproto.TL_chat:
-			newChat = &ChatData{ID: c.ID, Title: c.Title}
+			newChat = &ChatData{ID: c.ID, Title: c.Title, PhotoID: peerPhotoIDFromTG(c.Photo)}
 		case mtproto.TL_chatForbidden:
 			newChat = &ChatData{ID: c.ID, Title: c.Title}
 		case mtproto.TL_channel:
 			chatIsMin = c.Min
-			newChat = &ChatData{ID: c.ID, Title: c.Title, Username: c.Username, IsChannel: !c.Megagroup}
+			newChat = &ChatData{ID: c.ID, Title: c.Title, Username: c.Username, IsChannel: !c.Megagroup, PhotoID: peerPhotoIDFromTG(c.Photo)}
 		case mtproto.TL_channelForbidden:
 			newChat = &ChatData{ID: c.ID, Title: c.Title, IsChannel: !c.Megagroup}
 		default:
@@ -475,6 +868,11 @@ func (s *JSONFilesHistorySaver) SaveRelatedChats(chats []mtproto.TL) error {
 		if err != nil {
 			return merry.Wrap(err)
 		}
+		if full != nil {
+			newChat.Full = full
+		} else if exists {
+			newChat.Full = chat.Full //regular chat objects have no full info, keeping the saved one
+		}
 		if !exists || chat.IsUpdatedBy(newChat, chatIsMin) {
 			newChat.UpdatedAt = time.Now()
 
@@ -555,9 +953,61 @@ func (s JSONFilesHistorySaver) SaveAccount(me mtproto.TL_user) error {
 	return nil
 }
 
+// Checkpoint is saved when dump is interrupted (by SIGINT/SIGTERM) and removed after the next complete dump.
+// Dump progress itself is restored from the saved files, checkpoint just tells what was going on.
+type Checkpoint struct {
+	InterruptedAt time.Time
+	Signal        string
+	// chats that were being dumped at the moment of interruption
+	Chats []CheckpointChat
+	// number of files left in the download queue
+	PendingDownloads int
+}
+
+type CheckpointChat struct {
+	ID            int64
+	Title         string
+	LastMessageID int32 //last saved one
+}
+
+func (s JSONFilesHistorySaver) SaveCheckpoint(checkpoint *Checkpoint) error {
+	file, err := s.openAndTruncate(s.checkpointFPath())
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+	if err := json.NewEncoder(file).Encode(checkpoint); err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(file.Close())
+}
+
+// ReadCheckpoint returns nil if there is no checkpoint (previous dump was not interrupted).
+func (s JSONFilesHistorySaver) ReadCheckpoint() (*Checkpoint, error) {
+	buf, err := os.ReadFile(s.checkpointFPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	if len(buf) == 0 {
+		return nil, nil //was truncated as partial
+	}
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(buf, checkpoint); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	return checkpoint, nil
+}
+
+func (s JSONFilesHistorySaver) RemoveCheckpoint() error {
+	return removeIfExists(s.checkpointFPath())
+}
+
 func (s JSONFilesHistorySaver) appendRecordsWithRelatedMedia(
 	fpath string, messages []mtproto.TL,
-	chat *Chat, mediaSource MediaFileSource, fileInfosFunc FileInfosExtractorFunc,
+	chat *Chat, mediaSource MediaFileSource, fileInfosFunc FileInfosExtractorFunc, extraFields map[string]interface{},
 ) error {
 	file, err := s.openForAppend(fpath)
 	if err != nil {
@@ -570,16 +1020,11 @@ func (s JSONFilesHistorySaver) appendRecordsWithRelatedMedia(
 		msg := messages[i]
 		msgMap := tgObjToMap(msg)
 		msgMap["_TL_LAYER"] = mtproto.TL_Layer
-		if s.requestFileFunc != nil {
-			fileInfos, err := fileInfosFunc(msg)
-			if err != nil {
-				return merry.Wrap(err)
-			}
-			for _, fileInfo := range fileInfos {
-				if err := s.requestFileFunc(chat, &fileInfo, msgMap["ID"].(int32), mediaSource); err != nil {
-					return merry.Wrap(err)
-				}
-			}
+		for k, v := range extraFields {
+			msgMap[k] = v
+		}
+		if err := s.requestRelatedMedia(msg, msgMap, chat, mediaSource, fileInfosFunc); err != nil {
+			return merry.Wrap(err)
 		}
 		if err := encoder.Encode(msgMap); err != nil {
 			return merry.Wrap(err)
@@ -592,97 +1037,1555 @@ func (s JSONFilesHistorySaver) appendRecordsWithRelatedMedia(
 	return nil
 }
 
+// requestRelatedMedia calls file and stickers callbacks for the record (message or story)
+// and adds "_TOPIC_ID" to the record map for forum messages.
+func (s JSONFilesHistorySaver) requestRelatedMedia(
+	msg mtproto.TL, msgMap map[string]interface{},
+	chat *Chat, mediaSource MediaFileSource, fileInfosFunc FileInfosExtractorFunc,
+) error {
+	fileChat := chat
+	if mediaSource == MessageMediaFile {
+		if topicID, ok := tgGetForumMessageTopicID(chat.Obj, msg); ok {
+			msgMap["_TOPIC_ID"] = topicID
+			fileChat = chat.WithTopic(topicID)
+		}
+	}
+	if s.requestFileFunc != nil {
+		fileInfos, err := fileInfosFunc(msg)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		postID, _ := msgMap["_POST_ID"].(int32)
+		for _, fileInfo := range fileInfos {
+			if err := s.requestFileFunc(fileChat, &fileInfo, msgMap["ID"].(int32), mediaSource, postID); err != nil {
+				return merry.Wrap(err)
+			}
+		}
+	}
+	if s.requestStickersFunc != nil && mediaSource != StoryMediaFile {
+		if err := s.requestStickersFunc(fileChat, msg); err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	return nil
+}
+
 func (s JSONFilesHistorySaver) SaveMessages(chat *Chat, messages []mtproto.TL) error {
 	messagesFPath, err := s.chatMessagesFPath(chat)
 	if err != nil {
 		return merry.Wrap(err)
 	}
-	err = s.appendRecordsWithRelatedMedia(messagesFPath, messages, chat, MessageMediaFile, tgFindMessageMediaFileInfos)
-	return merry.Wrap(err)
+	return merry.Wrap(s.appendMessages(messagesFPath, messagesFPath, chat, messages))
 }
 
-func (s JSONFilesHistorySaver) SaveStories(chat *Chat, stories []mtproto.TL) error {
-	storiesFPath, err := s.chatStoriesFPath(chat)
+// SaveOlderMessages saves messages older than the first saved one to the prepend segment (history/<id>_<title>.older).
+// Segment becomes part of the history after [JSONFilesHistorySaver.MergeOlderMessages].
+func (s JSONFilesHistorySaver) SaveOlderMessages(chat *Chat, messages []mtproto.TL) error {
+	messagesFPath, err := s.chatMessagesFPath(chat)
 	if err != nil {
 		return merry.Wrap(err)
 	}
-	err = s.appendRecordsWithRelatedMedia(storiesFPath, stories, chat, StoryMediaFile, tgFindStoryMediaFileInfos)
-	return merry.Wrap(err)
-}
-
-func (s *JSONFilesHistorySaver) SetFileRequestCallback(callback SaveFileCallbackFunc) {
-	s.requestFileFunc = callback
+	return merry.Wrap(s.appendMessages(messagesFPath, messagesFPath+chatOlderFileSuffix, chat, messages))
 }
 
-type SavedChatEntry struct {
-	ID int64
-	// chat title which may have been modified to be filesystem-safe (i.e. "/" replaced with "_")
-	FSTitle string
-	FName   string
-	FPath   string
-}
+func (s JSONFilesHistorySaver) appendMessages(messagesFPath, fpath string, chat *Chat, messages []mtproto.TL) error {
+	err := s.appendRecordsWithRelatedMedia(fpath, messages, chat, MessageMediaFile, tgFindMessageMediaFileInfos, nil)
+	if err != nil {
+		return merry.Wrap(err)
+	}
 
-func (s *JSONFilesHistorySaver) ReadSavedChatsList() ([]SavedChatEntry, error) {
-	entries, err := os.ReadDir(s.chatsMessagesDirpath())
-	if os.IsNotExist(err) {
-		return []SavedChatEntry{}, nil
-	} else if err != nil {
-		return nil, merry.Wrap(err)
+	pending, err := findPendingWebPages(messages, 0)
+	if err != nil {
+		return merry.Wrap(err)
 	}
+	return merry.Wrap(s.appendPendingWebPages(messagesFPath+chatPendingFileSuffix, pending, false))
+}
 
-	items := make([]SavedChatEntry, 0, len(entries)) //there should be ~3 extra entries, seems ok
-	for _, entry := range entries {
-		id, suffix, ok := matchFNameIDPrefix(entry.Name())
-		if !ok {
-			continue
-		}
+// SavedMessageRevision contains message fields that are compared to detect edits.
+type SavedMessageRevision struct {
+	Type     string `json:"_"`
+	ID       int64
+	EditDate *int32
+	Message  string
+}
 
-		fpath := s.chatsMessagesDirpath() + "/" + entry.Name()
-		items = append(items, SavedChatEntry{
-			ID:      id,
-			FSTitle: suffix,
-			FPath:   fpath,
-			FName:   entry.Name(),
-		})
-	}
-	return items, nil
+// IsPlaceholder is true for empty messages saved in place of messages from excluded forum topics.
+// They must not be compared with re-fetched messages (that would save excluded messages as edits).
+func (r *SavedMessageRevision) IsPlaceholder() bool {
+	return r.Type == "TL_messageEmpty"
 }
 
-type SavedFilesEntry struct {
-	MessageID      int64
-	IndexInMessage int64
-	// original file name which may have been modified to be filesystem-safe (i.e. "/" replaced with "_")
-	FSOriginalName string
-	FName          string
-	FPath          string
+func (r *SavedMessageRevision) IsUpdatedBy(other *mtproto.TL_message) bool {
+	return !equalsOpt(r.EditDate, other.EditDate) || r.Message != other.Message
 }
 
-func (s *JSONFilesHistorySaver) ReadSavedChatFilesList(chatID int64) ([]SavedFilesEntry, error) {
-	filesDirpath, err := findFPathForID(s.chatsFilesDirpath(), chatID, "", false)
-	if err != nil {
+func (s *JSONFilesHistorySaver) revisionReader(fpath string) (*JSONRecordsReader[SavedMessageRevision], error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.revisionReaders == nil {
+		s.revisionReaders = make(map[string]*JSONRecordsReader[SavedMessageRevision])
+	}
+	reader, ok := s.revisionReaders[fpath]
+	if !ok {
+		reader = NewJSONRecordsReader[SavedMessageRevision](fpath)
+		s.revisionReaders[fpath] = reader
+	}
+	if err := reader.UpdateOffsets(); err != nil {
 		return nil, merry.Wrap(err)
 	}
+	return reader, nil
+}
 
-	entries, err := os.ReadDir(filesDirpath)
+// SaveMessageRevisions compares messages with their last saved versions (from history or edits file)
+// and appends changed ones to the edits file. Messages that were not saved yet
+// (or were saved as empty placeholders) are ignored.
+// Revisions with pending link previews are added to the pending list (as new messages).
+// Returns the number of appended revisions.
+func (s *JSONFilesHistorySaver) SaveMessageRevisions(chat *Chat, messages []mtproto.TL) (int, error) {
+	messagesFPath, err := s.chatMessagesFPath(chat)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return make([]SavedFilesEntry, 0), nil
-		}
+		return 0, merry.Wrap(err)
+	}
+	editsFPath := messagesFPath + chatEditsFileSuffix
 
-		return nil, merry.Wrap(err)
+	messagesReader, err := s.revisionReader(messagesFPath)
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+	editsReader, err := s.revisionReader(editsFPath)
+	if err != nil {
+		return 0, merry.Wrap(err)
 	}
 
-	items := make([]SavedFilesEntry, 0, len(entries))
-	for _, entry := range entries {
-		msgID, indexInMsg, fsName, ok := matchMessageFileName(entry.Name())
+	var encoder *json.Encoder
+	var changed []mtproto.TL
+	for _, msgTL := range messages {
+		msg, ok := msgTL.(mtproto.TL_message)
 		if !ok {
-			continue
+			continue //only regular messages can be edited
 		}
 
-		fpath := filesDirpath + "/" + entry.Name()
-		items = append(items, SavedFilesEntry{
-			MessageID:      msgID,
-			IndexInMessage: indexInMsg,
+		prev, found, err := editsReader.Read(int64(msg.ID))
+		if err != nil {
+			return len(changed), merry.Wrap(err)
+		}
+		if !found {
+			prev, found, err = messagesReader.Read(int64(msg.ID))
+			if err != nil {
+				return len(changed), merry.Wrap(err)
+			}
+		}
+		if !found || prev.IsPlaceholder() || !prev.IsUpdatedBy(&msg) {
+			continue
+		}
+
+		if encoder == nil {
+			file, err := s.openForAppend(editsFPath)
+			if err != nil {
+				return len(changed), merry.Wrap(err)
+			}
+			defer file.Close()
+			encoder = json.NewEncoder(file)
+		}
+		msgMap := tgObjToMap(msg)
+		msgMap["_TL_LAYER"] = mtproto.TL_Layer
+		msgMap["_DETECTED_AT"] = time.Now().Unix()
+		if topicID, ok := tgGetForumMessageTopicID(chat.Obj, msg); ok {
+			msgMap["_TOPIC_ID"] = topicID
+		}
+		if err := encoder.Encode(msgMap); err != nil {
+			return len(changed), merry.Wrap(err)
+		}
+		changed = append(changed, msg)
+	}
+
+	// edited messages media is not requested, but link previews will be (when they are ready)
+	pending, err := findPendingWebPages(changed, 0)
+	if err != nil {
+		return len(changed), merry.Wrap(err)
+	}
+	err = s.appendPendingWebPages(messagesFPath+chatPendingFileSuffix, pending, false)
+	return len(changed), merry.Wrap(err)
+}
+
+// GetSavedMessageIDs returns IDs of saved messages (sorted as in history file)
+// excluding empty messages and messages that are already marked as deleted.
+func (s JSONFilesHistorySaver) GetSavedMessageIDs(chat *Chat) ([]int32, error) {
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	deleted, err := readDeletedMessages(messagesFPath + chatDeletedFileSuffix)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	allIDs, err := readMessageIDs(messagesFPath)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	var ids []int32
+	for _, id := range allIDs {
+		if _, ok := deleted[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// readMessageIDs returns IDs of non-empty messages from history file (in file order).
+func readMessageIDs(fpath string) ([]int32, error) {
+	var ids []int32
+	err := scanMessageIDs(fpath, func(id int32, offset, length int64, isEmpty bool) {
+		if !isEmpty {
+			ids = append(ids, id)
+		}
+	})
+	return ids, merry.Wrap(err)
+}
+
+// scanMessageIDs calls f for each complete line of history file with message ID and line position.
+func scanMessageIDs(fpath string, f func(id int32, offset, length int64, isEmpty bool)) error {
+	file, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Split(ScanFullLines)
+	scanner.Buffer(make([]byte, 1024), 4*1024*1024)
+
+	offset := int64(0)
+	var p fastjson.Parser
+	for scanner.Scan() {
+		buf := scanner.Bytes()
+		if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			break //last line is not complete
+		}
+		v, err := p.ParseBytes(buf)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		isEmpty := string(v.GetStringBytes("_")) == "TL_messageEmpty"
+		f(int32(v.GetInt("ID")), offset, int64(len(buf)), isEmpty)
+		offset += int64(len(buf))
+	}
+	return merry.Wrap(scanner.Err())
+}
+
+// GetOldestMessageID returns the lowest ID of saved messages (including not yet merged older ones)
+// and the number of saved messages.
+func (s JSONFilesHistorySaver) GetOldestMessageID(chat *Chat) (int32, int, error) {
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return 0, 0, merry.Wrap(err)
+	}
+	oldestID := int32(0)
+	count := 0
+	for _, fpath := range []string{messagesFPath, messagesFPath + chatOlderFileSuffix} {
+		err := scanMessageIDs(fpath, func(id int32, offset, length int64, isEmpty bool) {
+			if oldestID == 0 || id < oldestID {
+				oldestID = id
+			}
+			if !isEmpty {
+				count += 1
+			}
+		})
+		if err != nil {
+			return 0, 0, merry.Wrap(err)
+		}
+	}
+	return oldestID, count, nil
+}
+
+// MergeOlderMessages prepends messages saved by [JSONFilesHistorySaver.SaveOlderMessages] to the history file
+// (sorted by ID, so the whole history remains sorted) and removes the segment.
+func (s *JSONFilesHistorySaver) MergeOlderMessages(chat *Chat) error {
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(s.mergeSegment(messagesFPath, messagesFPath+chatOlderFileSuffix))
+}
+
+// SaveGapMessages saves messages that are missing in the middle of the history file to the gaps segment
+// (history/<id>_<title>.gaps). Segment becomes part of the history after [JSONFilesHistorySaver.MergeGapMessages].
+func (s JSONFilesHistorySaver) SaveGapMessages(chat *Chat, messages []mtproto.TL) error {
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(s.appendMessages(messagesFPath, messagesFPath+chatGapsFileSuffix, chat, messages))
+}
+
+// MergeGapMessages inserts messages saved by [JSONFilesHistorySaver.SaveGapMessages] into the history file
+// (keeping it sorted by ID) and removes the segment.
+func (s *JSONFilesHistorySaver) MergeGapMessages(chat *Chat) error {
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(s.mergeSegment(messagesFPath, messagesFPath+chatGapsFileSuffix))
+}
+
+// mergeSegment merges records from segment file into the history file. History file is expected to be sorted by ID,
+// segment records may be in any order, records already present in history are skipped.
+func (s *JSONFilesHistorySaver) mergeSegment(messagesFPath, segmentFPath string) error {
+	type linePos struct {
+		id             int32
+		offset, length int64
+	}
+	var historyLines []linePos
+	historyIDs := make(map[int32]bool)
+	err := scanMessageIDs(messagesFPath, func(id int32, offset, length int64, isEmpty bool) {
+		historyLines = append(historyLines, linePos{id, offset, length})
+		historyIDs[id] = true
+	})
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	var segmentLines []linePos
+	err = scanMessageIDs(segmentFPath, func(id int32, offset, length int64, isEmpty bool) {
+		// segment may contain duplicates if loading was interrupted and restarted
+		if !historyIDs[id] {
+			segmentLines = append(segmentLines, linePos{id, offset, length})
+			historyIDs[id] = true
+		}
+	})
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if len(segmentLines) == 0 {
+		return merry.Wrap(removeIfExists(segmentFPath))
+	}
+	slices.SortFunc(segmentLines, func(a, b linePos) int { return int(a.id) - int(b.id) })
+
+	segmentFile, err := os.Open(segmentFPath)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer segmentFile.Close()
+	var messagesFile *os.File
+	if len(historyLines) > 0 {
+		messagesFile, err = os.Open(messagesFPath)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		defer messagesFile.Close()
+	}
+	mergingFPath := messagesFPath + chatMergingFileSuffix
+	mergingFile, err := s.openAndTruncate(mergingFPath)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer mergingFile.Close()
+
+	copyLine := func(src *os.File, line linePos) error {
+		_, err := io.Copy(mergingFile, io.NewSectionReader(src, line.offset, line.length))
+		return merry.Wrap(err)
+	}
+	hi, si := 0, 0
+	for hi < len(historyLines) || si < len(segmentLines) {
+		if si == len(segmentLines) || (hi < len(historyLines) && historyLines[hi].id < segmentLines[si].id) {
+			err = copyLine(messagesFile, historyLines[hi])
+			hi++
+		} else {
+			err = copyLine(segmentFile, segmentLines[si])
+			si++
+		}
+		if err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	if err := mergingFile.Sync(); err != nil {
+		return merry.Wrap(err)
+	}
+	if err := mergingFile.Close(); err != nil {
+		return merry.Wrap(err)
+	}
+
+	s.mutex.Lock()
+	delete(s.revisionReaders, messagesFPath) //offsets of history records are changed
+	s.mutex.Unlock()
+
+	if err := os.Rename(mergingFPath, messagesFPath); err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(removeIfExists(segmentFPath))
+}
+
+// MessageIDsGap is a range of message IDs between two adjacent saved messages (both bounds are excluded).
+type MessageIDsGap struct {
+	AfterID  int32
+	BeforeID int32
+}
+
+// FindMessageIDsGaps returns ranges of IDs between adjacent saved messages.
+// Gaps are meaningful only for channels and supergroups: other chats share message IDs sequence
+// with the whole account, so they have gaps almost everywhere.
+func (s JSONFilesHistorySaver) FindMessageIDsGaps(chat *Chat) ([]MessageIDsGap, error) {
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	var gaps []MessageIDsGap
+	prevID := int32(0)
+	err = scanMessageIDs(messagesFPath, func(id int32, offset, length int64, isEmpty bool) {
+		if prevID != 0 && id > prevID+1 {
+			gaps = append(gaps, MessageIDsGap{AfterID: prevID, BeforeID: id})
+		}
+		prevID = id
+	})
+	return gaps, merry.Wrap(err)
+}
+
+// GetGapsCheck returns range of message IDs that was already checked for gaps (empty if there were no checks).
+func (s JSONFilesHistorySaver) GetGapsCheck(chat *Chat) (GapsCheckData, error) {
+	var check GapsCheckData
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return check, merry.Wrap(err)
+	}
+	buf, err := os.ReadFile(messagesFPath + chatGapsCheckedFileSuffix)
+	if os.IsNotExist(err) {
+		return check, nil
+	}
+	if err != nil {
+		return check, merry.Wrap(err)
+	}
+	return check, merry.Wrap(json.Unmarshal(buf, &check))
+}
+
+// SaveGapsCheck replaces range of message IDs checked for gaps.
+func (s JSONFilesHistorySaver) SaveGapsCheck(chat *Chat, check GapsCheckData) error {
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	file, err := s.openAndTruncate(messagesFPath + chatGapsCheckedFileSuffix)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+	if err := json.NewEncoder(file).Encode(check); err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(file.Close())
+}
+
+func removeIfExists(fpath string) error {
+	err := os.Remove(fpath)
+	if err != nil && !os.IsNotExist(err) {
+		return merry.Wrap(err)
+	}
+	return nil
+}
+
+// readDeletedMessages reads tombstones from history/<id>_<title>.deleted file.
+func readDeletedMessages(fpath string) (map[int32]DeletedMessageData, error) {
+	file, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return map[int32]DeletedMessageData{}, nil
+	}
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	defer file.Close()
+
+	deleted := make(map[int32]DeletedMessageData)
+	scanner := bufio.NewScanner(file)
+	scanner.Split(ScanFullLines)
+	for scanner.Scan() {
+		buf := scanner.Bytes()
+		if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			break //last line is not complete
+		}
+		var item DeletedMessageData
+		if err := json.Unmarshal(buf, &item); err != nil {
+			return nil, merry.Wrap(err)
+		}
+		deleted[item.ID] = item
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	return deleted, nil
+}
+
+func (s JSONFilesHistorySaver) SaveDeletedMessages(chat *Chat, msgIDs []int32) error {
+	if len(msgIDs) == 0 {
+		return nil
+	}
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	file, err := s.openForAppend(messagesFPath + chatDeletedFileSuffix)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	now := time.Now()
+	for _, id := range msgIDs {
+		if err := encoder.Encode(DeletedMessageData{ID: id, DetectedAt: now}); err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	return merry.Wrap(file.Close())
+}
+
+func readPendingWebPages(fpath string) (map[int32]PendingWebPageData, error) {
+	file, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return map[int32]PendingWebPageData{}, nil
+	}
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	defer file.Close()
+
+	pending := make(map[int32]PendingWebPageData)
+	scanner := bufio.NewScanner(file)
+	scanner.Split(ScanFullLines)
+	for scanner.Scan() {
+		buf := scanner.Bytes()
+		if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			break //last line is not complete
+		}
+		var item PendingWebPageData
+		if err := json.Unmarshal(buf, &item); err != nil {
+			return nil, merry.Wrap(err)
+		}
+		if item.ResolvedAt == nil {
+			pending[item.ID] = item
+		} else {
+			delete(pending, item.ID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	return pending, nil
+}
+
+// findPendingWebPages returns records (messages, comments or stories) with webpage previews that are not ready yet.
+func findPendingWebPages(records []mtproto.TL, postID int32) ([]PendingWebPageData, error) {
+	var pending []PendingWebPageData
+	for _, rec := range records {
+		if tgHasPendingWebPage(rec) {
+			id, err := tgGetMessageOrStoryID(rec)
+			if err != nil {
+				return nil, merry.Wrap(err)
+			}
+			pending = append(pending, PendingWebPageData{ID: id, PostID: postID})
+		}
+	}
+	return pending, nil
+}
+
+func (s JSONFilesHistorySaver) appendPendingWebPages(fpath string, items []PendingWebPageData, resolved bool) error {
+	if len(items) == 0 {
+		return nil
+	}
+	file, err := s.openForAppend(fpath)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	now := time.Now()
+	for _, item := range items {
+		item.DetectedAt = now
+		if resolved {
+			item.ResolvedAt = &now
+		}
+		if err := encoder.Encode(item); err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	return merry.Wrap(file.Close())
+}
+
+// pendingWebPagesFPath returns path of the pending list of chat messages, comments or stories.
+func (s JSONFilesHistorySaver) pendingWebPagesFPath(chat *Chat, source MediaFileSource) (string, error) {
+	switch source {
+	case MessageMediaFile, CommentMediaFile:
+		messagesFPath, err := s.chatMessagesFPath(chat)
+		if err != nil {
+			return "", merry.Wrap(err)
+		}
+		if source == CommentMediaFile {
+			return messagesFPath + chatCommentsPendingFileSuffix, nil
+		}
+		return messagesFPath + chatPendingFileSuffix, nil
+	case StoryMediaFile:
+		storiesFPath, err := s.chatStoriesFPath(chat)
+		return storiesFPath + chatPendingFileSuffix, merry.Wrap(err)
+	default:
+		return "", merry.Errorf("unexpected media source: %d", source)
+	}
+}
+
+// GetPendingWebPages returns (sorted by ID) saved messages, comments or stories
+// with webpage previews that were pending during dump.
+func (s JSONFilesHistorySaver) GetPendingWebPages(chat *Chat, source MediaFileSource) ([]PendingWebPageData, error) {
+	fpath, err := s.pendingWebPagesFPath(chat, source)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	pending, err := readPendingWebPages(fpath)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	items := make([]PendingWebPageData, 0, len(pending))
+	for _, item := range pending {
+		items = append(items, item)
+	}
+	slices.SortFunc(items, func(a, b PendingWebPageData) int { return int(a.ID) - int(b.ID) })
+	return items, nil
+}
+
+// splitResolvedWebPages returns re-fetched records which previews are ready now (excluding deleted ones)
+// and pending list items of all records that are not pending anymore.
+func splitResolvedWebPages(records []mtproto.TL) ([]mtproto.TL, []PendingWebPageData, error) {
+	var resolved []mtproto.TL
+	var done []PendingWebPageData
+	for _, rec := range records {
+		if tgHasPendingWebPage(rec) {
+			continue
+		}
+		id, err := tgGetMessageOrStoryID(rec)
+		if err != nil {
+			return nil, nil, merry.Wrap(err)
+		}
+		switch rec.(type) {
+		case mtproto.TL_messageEmpty, mtproto.TL_storyItemDeleted:
+		default:
+			resolved = append(resolved, rec)
+		}
+		done = append(done, PendingWebPageData{ID: id})
+	}
+	return resolved, done, nil
+}
+
+// SaveResolvedWebPages handles re-fetched messages (or comments, or stories) with previously pending webpage previews.
+// Messages with ready previews are appended to the edits file (superseding the saved version)
+// and their preview images are requested. Comments and stories have no revisions, so only their preview images are requested.
+// Records that are still pending are left in the pending list, deleted ones (TL_messageEmpty, TL_storyItemDeleted)
+// are removed from it. Returns the number of resolved records.
+func (s JSONFilesHistorySaver) SaveResolvedWebPages(chat *Chat, source MediaFileSource, records []mtproto.TL) (int, error) {
+	pendingFPath, err := s.pendingWebPagesFPath(chat, source)
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+	resolved, done, err := splitResolvedWebPages(records)
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+
+	switch source {
+	case MessageMediaFile:
+		if len(resolved) > 0 {
+			messagesFPath, err := s.chatMessagesFPath(chat)
+			if err != nil {
+				return 0, merry.Wrap(err)
+			}
+			extraFields := map[string]interface{}{"_DETECTED_AT": time.Now().Unix()}
+			err = s.appendRecordsWithRelatedMedia(messagesFPath+chatEditsFileSuffix, resolved, chat,
+				MessageMediaFile, tgFindMessageMediaFileInfos, extraFields)
+			if err != nil {
+				return 0, merry.Wrap(err)
+			}
+		}
+	default:
+		if len(resolved) > 0 {
+			pending, err := s.GetPendingWebPages(chat, source)
+			if err != nil {
+				return 0, merry.Wrap(err)
+			}
+			if err := s.requestResolvedWebPagesMedia(chat, source, resolved, pending); err != nil {
+				return 0, merry.Wrap(err)
+			}
+		}
+	}
+	if err := s.appendPendingWebPages(pendingFPath, done, true); err != nil {
+		return 0, merry.Wrap(err)
+	}
+	return len(resolved), nil
+}
+
+// requestResolvedWebPagesMedia requests files of re-fetched comments or stories
+// (pending list items are used to find commented posts IDs).
+func (s JSONFilesHistorySaver) requestResolvedWebPagesMedia(
+	chat *Chat, source MediaFileSource, records []mtproto.TL, pending []PendingWebPageData,
+) error {
+	postIDs := make(map[int32]int32, len(pending))
+	for _, item := range pending {
+		postIDs[item.ID] = item.PostID
+	}
+	fileInfosFunc := tgFindMessageMediaFileInfos
+	if source == StoryMediaFile {
+		fileInfosFunc = tgFindStoryMediaFileInfos
+	}
+	for _, rec := range records {
+		recMap := tgObjToMap(rec)
+		if postID := postIDs[recMap["ID"].(int32)]; postID != 0 {
+			recMap["_POST_ID"] = postID
+		}
+		if err := s.requestRelatedMedia(rec, recMap, chat, source, fileInfosFunc); err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	return nil
+}
+
+func (s JSONFilesHistorySaver) SaveMetricsSnapshot(chat *Chat, snapshot MetricsSnapshotData) error {
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	file, err := s.openForAppend(messagesFPath + chatMetricsFileSuffix)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+	if err := json.NewEncoder(file).Encode(snapshot); err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(file.Close())
+}
+
+// readMetricsSnapshots reads snapshots from history/<id>_<title>.metrics file (from oldest to newest).
+func readMetricsSnapshots(fpath string) ([]MetricsSnapshotData, error) {
+	file, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	defer file.Close()
+
+	var snapshots []MetricsSnapshotData
+	scanner := bufio.NewScanner(file)
+	scanner.Split(ScanFullLines)
+	scanner.Buffer(make([]byte, 1024), 16*1024*1024)
+	for scanner.Scan() {
+		buf := scanner.Bytes()
+		if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			break //last line is not complete
+		}
+		var snapshot MetricsSnapshotData
+		if err := json.Unmarshal(buf, &snapshot); err != nil {
+			return nil, merry.Wrap(err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, merry.Wrap(scanner.Err())
+}
+
+func (s *JSONFilesHistorySaver) GetChannelPTS(chat *Chat) (int32, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.channelsPTS == nil {
+		s.channelsPTS = NewJSONRecordsReader[ChannelPTSData](s.channelsPTSFPath())
+	}
+	if err := s.channelsPTS.UpdateOffsets(); err != nil {
+		return 0, merry.Wrap(err)
+	}
+	item, _, err := s.channelsPTS.Read(chat.ID)
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+	return item.PTS, nil
+}
+
+func (s *JSONFilesHistorySaver) SaveChannelPTS(chat *Chat, pts int32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file, err := s.openForAppend(s.channelsPTSFPath())
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+
+	item := ChannelPTSData{ID: chat.ID, PTS: pts, UpdatedAt: time.Now()}
+	if err := json.NewEncoder(file).Encode(item); err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(file.Close())
+}
+
+// GetLastCommentIDs returns last saved comment ID for each channel post with saved comments.
+func (s JSONFilesHistorySaver) GetLastCommentIDs(chat *Chat) (map[int32]int32, error) {
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	lastIDs := make(map[int32]int32)
+
+	file, err := os.Open(messagesFPath + chatCommentsFileSuffix)
+	if os.IsNotExist(err) {
+		return lastIDs, nil
+	}
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Split(ScanFullLines)
+	scanner.Buffer(make([]byte, 1024), 4*1024*1024)
+
+	var p fastjson.Parser
+	for scanner.Scan() {
+		buf := scanner.Bytes()
+		if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			break //last line is not complete
+		}
+		v, err := p.ParseBytes(buf)
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+		postID := int32(v.GetInt("_POST_ID"))
+		if id := int32(v.GetInt("ID")); id > lastIDs[postID] {
+			lastIDs[postID] = id
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	return lastIDs, nil
+}
+
+// SaveComments appends comments (from linked discussion group) of the channel post to the comments file.
+// Each comment gets an additional "_POST_ID" field.
+func (s JSONFilesHistorySaver) SaveComments(chat *Chat, postID int32, comments []mtproto.TL) error {
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	err = s.appendRecordsWithRelatedMedia(messagesFPath+chatCommentsFileSuffix, comments, chat,
+		CommentMediaFile, tgFindMessageMediaFileInfos, map[string]interface{}{"_POST_ID": postID})
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	pending, err := findPendingWebPages(comments, postID)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(s.appendPendingWebPages(messagesFPath+chatCommentsPendingFileSuffix, pending, false))
+}
+
+// SaveForumTopics replaces forum topics list of the chat.
+func (s JSONFilesHistorySaver) SaveForumTopics(chat *Chat, topics []mtproto.TL) error {
+	messagesFPath, err := s.chatMessagesFPath(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	file, err := s.openAndTruncate(messagesFPath + chatTopicsFileSuffix)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, topic := range topics {
+		topicMap := tgObjToMap(topic)
+		topicMap["_TL_LAYER"] = mtproto.TL_Layer
+		if err := encoder.Encode(topicMap); err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	return merry.Wrap(file.Close())
+}
+
+// SaveParticipants replaces participants snapshot of the chat and (if members have changed)
+// appends a record of joined and left ones to the participants log.
+// If some of the snapshots is partial, only joins (with known join date after the previous snapshot) are reported:
+// members missing in a partial snapshot may still be there, and members missing in a previous one may have been there long ago.
+func (s JSONFilesHistorySaver) SaveParticipants(chat *Chat, snapshot *ParticipantsSnapshotData) (ParticipantsChangeData, error) {
+	change := ParticipantsChangeData{DetectedAt: snapshot.TakenAt}
+	fpath, err := s.chatParticipantsFPath(chat)
+	if err != nil {
+		return change, merry.Wrap(err)
+	}
+	prevSnapshot, err := readParticipantsSnapshot(fpath + chatSnapshotFileSuffix)
+	if err != nil {
+		return change, merry.Wrap(err)
+	}
+
+	if prevSnapshot != nil && (prevSnapshot.Partial || snapshot.Partial) {
+		change.Partial = true
+		wasMember := make(map[int64]bool, len(prevSnapshot.Participants))
+		for _, p := range prevSnapshot.Participants {
+			wasMember[p.UserID] = true
+		}
+		for _, p := range snapshot.Participants {
+			if !wasMember[p.UserID] && p.JoinedAt != 0 && int64(p.JoinedAt) > prevSnapshot.TakenAt.Unix() {
+				change.Joined = append(change.Joined, p.UserID)
+			}
+		}
+	} else if prevSnapshot != nil {
+		isMember := make(map[int64]bool, len(snapshot.Participants))
+		for _, p := range snapshot.Participants {
+			isMember[p.UserID] = true
+		}
+		wasMember := make(map[int64]bool, len(prevSnapshot.Participants))
+		for _, p := range prevSnapshot.Participants {
+			wasMember[p.UserID] = true
+			if !isMember[p.UserID] {
+				change.Left = append(change.Left, p.UserID)
+			}
+		}
+		for _, p := range snapshot.Participants {
+			if !wasMember[p.UserID] {
+				change.Joined = append(change.Joined, p.UserID)
+			}
+		}
+	}
+
+	if len(change.Joined) > 0 || len(change.Left) > 0 {
+		file, err := s.openForAppend(fpath)
+		if err != nil {
+			return change, merry.Wrap(err)
+		}
+		defer file.Close()
+		if err := json.NewEncoder(file).Encode(change); err != nil {
+			return change, merry.Wrap(err)
+		}
+		if err := file.Close(); err != nil {
+			return change, merry.Wrap(err)
+		}
+	}
+
+	// snapshot is replaced atomically, otherwise all members would look like new ones after interruption
+	file, err := s.openAndTruncate(fpath + chatSnapshotFileSuffix + ".temp")
+	if err != nil {
+		return change, merry.Wrap(err)
+	}
+	defer file.Close()
+	if err := json.NewEncoder(file).Encode(snapshot); err != nil {
+		return change, merry.Wrap(err)
+	}
+	if err := file.Close(); err != nil {
+		return change, merry.Wrap(err)
+	}
+	return change, merry.Wrap(os.Rename(fpath+chatSnapshotFileSuffix+".temp", fpath+chatSnapshotFileSuffix))
+}
+
+// readParticipantsSnapshot returns nil if there is no snapshot yet.
+func readParticipantsSnapshot(fpath string) (*ParticipantsSnapshotData, error) {
+	buf, err := os.ReadFile(fpath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	snapshot := &ParticipantsSnapshotData{}
+	if err := json.Unmarshal(buf, snapshot); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	return snapshot, nil
+}
+
+// SaveAdminLogEvents appends admin log events (expected to be sorted from newest to oldest,
+// same as in channels.getAdminLog response) to history/admin_log/<id>_<title>.
+func (s JSONFilesHistorySaver) SaveAdminLogEvents(chat *Chat, events []mtproto.TL) error {
+	fpath, err := s.chatAdminLogFPath(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	file, err := s.openForAppend(fpath)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for i := len(events) - 1; i >= 0; i-- {
+		eventMap := tgObjToMap(events[i])
+		eventMap["_TL_LAYER"] = mtproto.TL_Layer
+		if err := encoder.Encode(eventMap); err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	return merry.Wrap(file.Close())
+}
+
+func (s JSONFilesHistorySaver) SaveStories(chat *Chat, stories []mtproto.TL) error {
+	storiesFPath, err := s.chatStoriesFPath(chat)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	err = s.appendRecordsWithRelatedMedia(storiesFPath, stories, chat, StoryMediaFile, tgFindStoryMediaFileInfos, nil)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	pending, err := findPendingWebPages(stories, 0)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(s.appendPendingWebPages(storiesFPath+chatPendingFileSuffix, pending, false))
+}
+
+func (s *JSONFilesHistorySaver) SetFileRequestCallback(callback SaveFileCallbackFunc) {
+	s.requestFileFunc = callback
+}
+
+func (s *JSONFilesHistorySaver) SetStickersRequestCallback(callback SaveStickersCallbackFunc) {
+	s.requestStickersFunc = callback
+}
+
+// AppendPendingStickerRefs remembers sticker sets and custom emoji that should be saved
+// (so they are not lost if dump is interrupted before they are saved).
+func (s JSONFilesHistorySaver) AppendPendingStickerRefs(refs []StickerRefData) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	file, err := s.openForAppend(s.pendingStickersFPath())
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	for _, ref := range refs {
+		if err := encoder.Encode(ref); err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	return merry.Wrap(file.Close())
+}
+
+func (s JSONFilesHistorySaver) ReadPendingStickerRefs() ([]StickerRefData, error) {
+	file, err := os.Open(s.pendingStickersFPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	defer file.Close()
+
+	var refs []StickerRefData
+	scanner := bufio.NewScanner(file)
+	scanner.Split(ScanFullLines)
+	for scanner.Scan() {
+		buf := scanner.Bytes()
+		if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			break //last line is not complete
+		}
+		var ref StickerRefData
+		if err := json.Unmarshal(buf, &ref); err != nil {
+			return nil, merry.Wrap(err)
+		}
+		refs = append(refs, ref)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	return refs, nil
+}
+
+func (s JSONFilesHistorySaver) RemovePendingStickerRefs() error {
+	return merry.Wrap(removeIfExists(s.pendingStickersFPath()))
+}
+
+// ReadSavedStickerSets returns document IDs of completely saved sticker sets by set ID.
+func (s JSONFilesHistorySaver) ReadSavedStickerSets() (map[int64][]int64, error) {
+	entries, err := os.ReadDir(s.stickersDirpath())
+	if os.IsNotExist(err) {
+		return map[int64][]int64{}, nil
+	}
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	sets := make(map[int64][]int64)
+	for _, entry := range entries {
+		setID, _, ok := matchFNameIDPrefix(entry.Name())
+		if !ok || !entry.IsDir() {
+			continue
+		}
+		// set file is written after all stickers are downloaded
+		buf, err := os.ReadFile(s.stickersDirpath() + "/" + entry.Name() + "/set")
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+		var set struct{ Documents []struct{ ID string } }
+		if err := json.Unmarshal(buf, &set); err != nil {
+			return nil, merry.Wrap(err)
+		}
+		docIDs := make([]int64, 0, len(set.Documents))
+		for _, doc := range set.Documents {
+			docID, err := strconv.ParseInt(doc.ID, 10, 64)
+			if err != nil {
+				return nil, merry.Wrap(err)
+			}
+			docIDs = append(docIDs, docID)
+		}
+		sets[setID] = docIDs
+	}
+	return sets, nil
+}
+
+// SaveStickerSet saves sticker set info to history/stickers/<id>_<short_name>/set.
+// Should be called after all set stickers are downloaded: sets with this file are considered complete.
+func (s JSONFilesHistorySaver) SaveStickerSet(set *mtproto.TL_messages_stickerSet) error {
+	fpath, err := s.StickerFPath(set.Set, "set")
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	file, err := s.openAndTruncate(fpath + ".temp")
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+	setMap := tgObjToMap(*set)
+	setMap["_TL_LAYER"] = mtproto.TL_Layer
+	if err := json.NewEncoder(file).Encode(setMap); err != nil {
+		return merry.Wrap(err)
+	}
+	if err := file.Close(); err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(os.Rename(fpath+".temp", fpath))
+}
+
+func (s JSONFilesHistorySaver) downloadQueueFPath() string {
+	return s.Dirpath + "/.download_queue.jsonl"
+}
+
+func (s JSONFilesHistorySaver) OpenDownloadQueue() (*DownloadQueue, error) {
+	return OpenDownloadQueue(s.downloadQueueFPath())
+}
+
+// DownloadQueueFile is a serializable version of TGFileInfo.
+type DownloadQueueFile struct {
+	LocationType  string //"photo" or "document"
+	ID            int64
+	AccessHash    int64
+	FileReference []byte
+	ThumbSize     string
+	DCID          int32
+	Size          int64
+	FName         string
+	IndexInMsg    int64
+}
+
+func NewDownloadQueueFile(file *TGFileInfo) (DownloadQueueFile, error) {
+	res := DownloadQueueFile{DCID: file.DCID, Size: file.Size, FName: file.FName, IndexInMsg: file.IndexInMsg}
+	switch loc := file.InputLocation.(type) {
+	case mtproto.TL_inputPhotoFileLocation:
+		res.LocationType = "photo"
+		res.ID, res.AccessHash, res.FileReference, res.ThumbSize = loc.ID, loc.AccessHash, loc.FileReference, loc.ThumbSize
+	case mtproto.TL_inputDocumentFileLocation:
+		res.LocationType = "document"
+		res.ID, res.AccessHash, res.FileReference, res.ThumbSize = loc.ID, loc.AccessHash, loc.FileReference, loc.ThumbSize
+	default:
+		return res, merry.Wrap(mtproto.WrongRespError(file.InputLocation))
+	}
+	return res, nil
+}
+
+func (f DownloadQueueFile) FileInfo() (TGFileInfo, error) {
+	res := TGFileInfo{DCID: f.DCID, Size: f.Size, FName: f.FName, IndexInMsg: f.IndexInMsg}
+	switch f.LocationType {
+	case "photo":
+		res.InputLocation = mtproto.TL_inputPhotoFileLocation{ID: f.ID, AccessHash: f.AccessHash, FileReference: f.FileReference, ThumbSize: f.ThumbSize}
+	case "document":
+		res.InputLocation = mtproto.TL_inputDocumentFileLocation{ID: f.ID, AccessHash: f.AccessHash, FileReference: f.FileReference, ThumbSize: f.ThumbSize}
+	default:
+		return res, merry.Errorf("unexpected file location type: %s", f.LocationType)
+	}
+	return res, nil
+}
+
+type DownloadQueueItem struct {
+	ChatID      int64
+	MsgID       int32
+	PostID      int32 `json:",omitempty"` //commented post ID (for comment files)
+	MediaSource MediaFileSource
+	File        DownloadQueueFile
+	Attempts    int32
+	LastError   string `json:",omitempty"`
+	Done        bool   `json:",omitempty"`
+}
+
+func (i DownloadQueueItem) key() string {
+	return fmt.Sprintf("%d:%d:%d:%d:%s", i.ChatID, i.MediaSource, i.MsgID, i.File.IndexInMsg, i.File.FName)
+}
+
+const (
+	downloadMaxAttemptsPerRun = 5
+	downloadRetryBaseDelay    = 5 * time.Second
+)
+
+// DownloadQueue is a persistent (JSON Lines, the last record for each file wins) queue of files to download.
+// Failed downloads are retried with exponential backoff (up to downloadMaxAttemptsPerRun times per run),
+// unfinished items are loaded again on next run.
+type DownloadQueue struct {
+	fpath       string
+	mutex       *sync.Mutex
+	notify      chan struct{}
+	items       map[string]*DownloadQueueItem
+	keys        []string //to process items in order of addition
+	inProgress  map[string]bool
+	runAttempts map[string]int
+	retryAt     map[string]time.Time
+	parkedChats map[int64]bool
+	closed      bool
+	aborted     bool
+	closeChan   chan struct{}
+}
+
+func OpenDownloadQueue(fpath string) (*DownloadQueue, error) {
+	q := &DownloadQueue{
+		fpath:       fpath,
+		mutex:       &sync.Mutex{},
+		notify:      make(chan struct{}, 1),
+		items:       make(map[string]*DownloadQueueItem),
+		inProgress:  make(map[string]bool),
+		runAttempts: make(map[string]int),
+		retryAt:     make(map[string]time.Time),
+		parkedChats: make(map[int64]bool),
+		closeChan:   make(chan struct{}),
+	}
+	if err := q.load(); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	if err := q.compact(); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	return q, nil
+}
+
+func (q *DownloadQueue) load() error {
+	file, err := os.Open(q.fpath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Split(ScanFullLines)
+	for scanner.Scan() {
+		buf := scanner.Bytes()
+		if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			break //last line is not complete
+		}
+		item := &DownloadQueueItem{}
+		if err := json.Unmarshal(buf, item); err != nil {
+			return merry.Wrap(err)
+		}
+		key := item.key()
+		if item.Done {
+			delete(q.items, key)
+			continue
+		}
+		if _, exists := q.items[key]; !exists {
+			q.keys = append(q.keys, key)
+		}
+		q.items[key] = item
+	}
+	return merry.Wrap(scanner.Err())
+}
+
+// compact rewrites queue file leaving only the last records of unfinished items.
+func (q *DownloadQueue) compact() error {
+	if err := os.MkdirAll(filepath.Dir(q.fpath), 0700); err != nil {
+		return merry.Wrap(err)
+	}
+	file, err := os.OpenFile(q.fpath+".temp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	keys := q.keys[:0]
+	for _, key := range q.keys {
+		if item, ok := q.items[key]; ok {
+			keys = append(keys, key)
+			if err := encoder.Encode(item); err != nil {
+				return merry.Wrap(err)
+			}
+		}
+	}
+	q.keys = keys
+
+	if err := file.Close(); err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(os.Rename(q.fpath+".temp", q.fpath))
+}
+
+func (q *DownloadQueue) appendRecord(item *DownloadQueueItem) error {
+	if q.aborted {
+		return nil //unfinished items will be loaded again on next run
+	}
+	file, err := os.OpenFile(q.fpath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer file.Close()
+	if err := json.NewEncoder(file).Encode(item); err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(file.Close())
+}
+
+func (q *DownloadQueue) wakeUp() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Push adds file to the queue (if it is not there yet).
+func (q *DownloadQueue) Push(item DownloadQueueItem) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	key := item.key()
+	if _, exists := q.items[key]; exists {
+		return nil
+	}
+	item.Done = false
+	if err := q.appendRecord(&item); err != nil {
+		return merry.Wrap(err)
+	}
+	q.items[key] = &item
+	q.keys = append(q.keys, key)
+	q.wakeUp()
+	return nil
+}
+
+// Take waits for the next item ready for download.
+// Returns false if the queue is closed and there is nothing more to download during this run.
+func (q *DownloadQueue) Take() (DownloadQueueItem, bool) {
+	for {
+		q.mutex.Lock()
+		if q.aborted {
+			q.mutex.Unlock()
+			return DownloadQueueItem{}, false
+		}
+		now := time.Now()
+		wait := time.Second
+		hasActive := len(q.inProgress) > 0
+		for _, key := range q.keys {
+			item, ok := q.items[key]
+			if !ok || q.inProgress[key] || q.runAttempts[key] >= downloadMaxAttemptsPerRun || q.parkedChats[item.ChatID] {
+				continue
+			}
+			hasActive = true
+			if delay := q.retryAt[key].Sub(now); delay > 0 {
+				wait = min(wait, delay)
+				continue
+			}
+			q.inProgress[key] = true
+			q.mutex.Unlock()
+			return *item, true
+		}
+		closed := q.closed
+		q.mutex.Unlock()
+
+		if closed && !hasActive {
+			q.wakeUp() //letting other workers know
+			return DownloadQueueItem{}, false
+		}
+		select {
+		case <-q.notify:
+		case <-q.closeChan:
+			q.wakeUp()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (q *DownloadQueue) Done(item DownloadQueueItem) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	key := item.key()
+	item.Done = true
+	delete(q.inProgress, key)
+	delete(q.items, key)
+	delete(q.retryAt, key)
+	q.wakeUp()
+	return merry.Wrap(q.appendRecord(&item))
+}
+
+// Fail schedules item download retry with backoff.
+// Returns false if there will be no more retries during this run.
+func (q *DownloadQueue) Fail(item DownloadQueueItem, downloadErr error) (bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	key := item.key()
+	item.Attempts += 1
+	item.LastError = downloadErr.Error()
+	q.runAttempts[key] += 1
+	q.retryAt[key] = time.Now().Add(downloadRetryBaseDelay << (q.runAttempts[key] - 1))
+	q.items[key] = &item
+	delete(q.inProgress, key)
+	q.wakeUp()
+	willRetry := q.runAttempts[key] < downloadMaxAttemptsPerRun
+	return willRetry, merry.Wrap(q.appendRecord(&item))
+}
+
+// Park puts aside all items of the item chat until the end of this run (or until UnparkAll).
+// Attempts are not counted, so items of chats that can not be resolved right now
+// (for example, chat is not among dialogs anymore) do not use up their retries.
+func (q *DownloadQueue) Park(item DownloadQueueItem) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.parkedChats[item.ChatID] = true
+	delete(q.inProgress, item.key())
+	q.wakeUp()
+}
+
+// UnparkAll returns parked items back to the queue (for example, after chats list has been reloaded).
+func (q *DownloadQueue) UnparkAll() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.parkedChats = make(map[int64]bool)
+	q.wakeUp()
+}
+
+// UpdateFile replaces item file (for example, with the one with fresh file reference).
+func (q *DownloadQueue) UpdateFile(item DownloadQueueItem, file DownloadQueueFile) (DownloadQueueItem, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	item.File = file
+	if stored, ok := q.items[item.key()]; ok {
+		stored.File = file
+	}
+	return item, merry.Wrap(q.appendRecord(&item))
+}
+
+// Abort stops the queue without waiting for remaining downloads: Take returns false right away
+// and nothing is written to the queue file anymore, so in-progress items stay unfinished
+// and are downloaded on next run (partially downloaded files are resumed).
+func (q *DownloadQueue) Abort() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.aborted = true
+	if !q.closed {
+		q.closed = true
+		close(q.closeChan)
+	}
+}
+
+// PendingCount returns number of items that are not downloaded yet.
+func (q *DownloadQueue) PendingCount() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
+
+// Close marks that no more items will be pushed,
+// Take will return false once all items are downloaded (or have failed too many times).
+func (q *DownloadQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.closeChan)
+	}
+}
+
+type SavedChatEntry struct {
+	ID int64
+	// chat title which may have been modified to be filesystem-safe (i.e. "/" replaced with "_")
+	FSTitle string
+	FName   string
+	FPath   string
+}
+
+func (s *JSONFilesHistorySaver) ReadSavedChatsList() ([]SavedChatEntry, error) {
+	entries, err := os.ReadDir(s.chatsMessagesDirpath())
+	if os.IsNotExist(err) {
+		return []SavedChatEntry{}, nil
+	} else if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	items := make([]SavedChatEntry, 0, len(entries)) //there should be ~3 extra entries, seems ok
+	for _, entry := range entries {
+		if isChatSidecarFName(entry.Name()) {
+			continue
+		}
+		id, suffix, ok := matchFNameIDPrefix(entry.Name())
+		if !ok {
+			continue
+		}
+
+		fpath := s.chatsMessagesDirpath() + "/" + entry.Name()
+		items = append(items, SavedChatEntry{
+			ID:      id,
+			FSTitle: suffix,
+			FPath:   fpath,
+			FName:   entry.Name(),
+		})
+	}
+	return items, nil
+}
+
+type SavedFilesEntry struct {
+	MessageID      int64
+	IndexInMessage int64
+	// original file name which may have been modified to be filesystem-safe (i.e. "/" replaced with "_")
+	FSOriginalName string
+	FName          string
+	FPath          string
+}
+
+func (s *JSONFilesHistorySaver) ReadSavedChatFilesList(chatID int64, mediaSource MediaFileSource) ([]SavedFilesEntry, error) {
+	filesDirpath, err := findFPathForID(s.chatsFilesDirpathFor(mediaSource), chatID, "", false)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	entries, err := os.ReadDir(filesDirpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return make([]SavedFilesEntry, 0), nil
+		}
+
+		return nil, merry.Wrap(err)
+	}
+
+	items := make([]SavedFilesEntry, 0, len(entries))
+	for _, entry := range entries {
+		msgID, indexInMsg, fsName, ok := matchMessageFileName(entry.Name())
+		if !ok {
+			continue
+		}
+
+		fpath := filesDirpath + "/" + entry.Name()
+		items = append(items, SavedFilesEntry{
+			MessageID:      msgID,
+			IndexInMessage: indexInMsg,
 			FSOriginalName: fsName,
 			FPath:          fpath,
 			FName:          entry.Name(),
@@ -772,6 +2675,8 @@ func (r *JSONRecordsReader[T]) UpdateOffsets() error {
 
 	scanner := bufio.NewScanner(f)
 	scanner.Split(ScanFullLines)
+	// history message lines may be quite large, see JSONMessageReader.Read()
+	scanner.Buffer(make([]byte, 1024), 4*1024*1024)
 
 	var p fastjson.Parser
 	for scanner.Scan() {
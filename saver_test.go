@@ -3,7 +3,13 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/3bl3gamer/tgclient/mtproto"
+	"github.com/ansel1/merry/v2"
 )
 
 func TestJSONRecordsReader(t *testing.T) {
@@ -282,3 +288,896 @@ func TestJSONMessageReader(t *testing.T) {
 		estimate(3)
 	})
 }
+
+func TestJSONFilesHistorySaver__SaveMessageRevisions(t *testing.T) {
+	dirpath := t.TempDir()
+	saver := NewJSONFilesHistorySaver(dirpath)
+	chat := &Chat{ID: 123, Title: "Chat"}
+
+	save := func(t *testing.T, expectedCount int, messages ...mtproto.TL) {
+		t.Helper()
+		count, err := saver.SaveMessageRevisions(chat, messages)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expectedCount {
+			t.Errorf("expected %d revision(s), got %d", expectedCount, count)
+		}
+	}
+
+	if err := saver.SaveMessages(chat, []mtproto.TL{
+		mtproto.TL_message{ID: 2, Message: "second"},
+		mtproto.TL_message{ID: 1, Message: "first"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	editDate := int32(1700000000)
+	save(t, 0, mtproto.TL_message{ID: 1, Message: "first"}, mtproto.TL_message{ID: 2, Message: "second"})
+	save(t, 1, mtproto.TL_message{ID: 1, Message: "first (edited)", EditDate: &editDate})
+	save(t, 0, mtproto.TL_message{ID: 1, Message: "first (edited)", EditDate: &editDate})
+	save(t, 0, mtproto.TL_message{ID: 3, Message: "not saved yet"})
+	save(t, 1, mtproto.TL_message{ID: 1, Message: "first (edited twice)", EditDate: &editDate})
+
+	reader := NewJSONMessageReader(dirpath + "/123_Chat" + chatEditsFileSuffix)
+	revisions, _, err := reader.Read(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[0]["Message"] != "first (edited)" || revisions[1]["Message"] != "first (edited twice)" {
+		t.Errorf("unexpected revisions: %v", revisions)
+	}
+}
+
+func TestJSONFilesHistorySaver__SaveMessageRevisionsOfExcludedTopic(t *testing.T) {
+	log = mtproto.Logger{Hnd: mtproto.NoopLogHandler{}}
+	dirpath := t.TempDir()
+	saver := NewJSONFilesHistorySaver(dirpath)
+	chat := &Chat{ID: 123, Title: "Forum", Type: ChatChannel, Obj: mtproto.TL_channel{ID: 123, Forum: true}}
+	chatID, excludedTopicID := int64(123), int32(5)
+	config := &Config{History: ConfigChatFilterMulti{[]ConfigChatFilter{
+		ConfigChatFilterAttrs{ID: &chatID},
+		ConfigChatFilterExclude{ConfigChatFilterAttrs{ID: &chatID, Topic: &excludedTopicID}},
+	}}}
+
+	pending := mtproto.TL_messageMediaWebPage{Webpage: mtproto.TL_webPagePending{ID: 1}}
+	replyTo := mtproto.TL_messageReplyHeader{ForumTopic: true, ReplyToMsgID: &excludedTopicID}
+	messages := []mtproto.TL{
+		mtproto.TL_message{ID: 2, Message: "secret", ReplyTo: replyTo},
+		mtproto.TL_message{ID: 1, Message: "general"},
+	}
+	if err := saver.SaveMessages(chat, filterForumMessagesByTopic(chat, messages, config)); err != nil {
+		t.Fatal(err)
+	}
+
+	// re-fetched during edits re-scan
+	messages[0] = mtproto.TL_message{ID: 2, Message: "secret (edited)", ReplyTo: replyTo, Media: pending}
+	for _, msgs := range [][]mtproto.TL{filterForumMessagesByTopic(chat, messages, config), messages} {
+		count, err := saver.SaveMessageRevisions(chat, msgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, count, 0)
+	}
+
+	if _, err := os.Stat(dirpath + "/123_Forum" + chatEditsFileSuffix); !os.IsNotExist(err) {
+		t.Errorf("edits file must not be created: %v", err)
+	}
+	items, err := saver.GetPendingWebPages(chat, MessageMediaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(items), 0)
+}
+
+func TestJSONFilesHistorySaver__ChatsListSkipsSidecars(t *testing.T) {
+	for _, suffix := range chatSidecarFileSuffixes {
+		t.Run(suffix, func(t *testing.T) {
+			saver := NewJSONFilesHistorySaver(t.TempDir())
+			if err := os.MkdirAll(saver.chatsMessagesDirpath(), 0700); err != nil {
+				t.Fatal(err)
+			}
+			for _, fname := range []string{"123_Chat", "123_Chat" + suffix} {
+				if err := os.WriteFile(saver.chatsMessagesDirpath()+"/"+fname, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			chats, err := saver.ReadSavedChatsList()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chats) != 1 || chats[0].FName != "123_Chat" {
+				t.Errorf("sidecar file must not be listed as chat: %v", chats)
+			}
+		})
+	}
+}
+
+func TestJSONFilesHistorySaver__DeletedMessages(t *testing.T) {
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+	chat := &Chat{ID: 123, Title: "Chat"}
+
+	savedIDs := func(t *testing.T, expected string) {
+		t.Helper()
+		ids, err := saver.GetSavedMessageIDs(chat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(ids) != expected {
+			t.Errorf(`expected "%s", received "%v"`, expected, ids)
+		}
+	}
+
+	savedIDs(t, "[]")
+
+	if err := saver.SaveMessages(chat, []mtproto.TL{
+		mtproto.TL_message{ID: 3},
+		mtproto.TL_messageService{ID: 2},
+		mtproto.TL_messageEmpty{ID: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	savedIDs(t, "[2 3]")
+
+	if err := saver.SaveDeletedMessages(chat, []int32{3}); err != nil {
+		t.Fatal(err)
+	}
+	savedIDs(t, "[2]")
+
+	lastID, err := saver.GetLastMessageID(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != 3 {
+		t.Errorf("tombstones must not affect last message ID, got %d", lastID)
+	}
+}
+
+func TestJSONFilesHistorySaver__ConcurrentRelated(t *testing.T) {
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			chat := &Chat{ID: int64(100 + i), Title: "Chat"}
+			for j := 0; j < 10; j++ {
+				users := []mtproto.TL{mtproto.TL_user{ID: int64(j)}}
+				chats := []mtproto.TL{mtproto.TL_chat{ID: int64(j), Title: "Group"}}
+				if err := saveRelated(saver, users, chats); err != nil {
+					t.Error(err)
+				}
+				if err := saver.SaveMessages(chat, []mtproto.TL{mtproto.TL_message{ID: int32(j + 1)}}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	usersReader := NewJSONRecordsReader[UserData](saver.usersFPath())
+	if err := usersReader.UpdateOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	for j := 0; j < 10; j++ {
+		if _, exists, err := usersReader.Read(int64(j)); err != nil || !exists {
+			t.Errorf("user #%d: exists=%v, err=%v", j, exists, err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		lastID, err := saver.GetLastMessageID(&Chat{ID: int64(100 + i), Title: "Chat"})
+		if err != nil || lastID != 10 {
+			t.Errorf("chat #%d: last message ID=%d, err=%v", 100+i, lastID, err)
+		}
+	}
+}
+
+func TestDownloadQueue(t *testing.T) {
+	fpath := t.TempDir() + "/.download_queue.jsonl"
+	item := func(msgID int32) DownloadQueueItem {
+		return DownloadQueueItem{ChatID: 123, MsgID: msgID, File: DownloadQueueFile{LocationType: "photo", ID: int64(msgID), FName: "photo.jpg"}}
+	}
+	open := func(t *testing.T, expectedIDs ...int32) *DownloadQueue {
+		t.Helper()
+		queue, err := OpenDownloadQueue(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int32
+		for _, key := range queue.keys {
+			ids = append(ids, queue.items[key].MsgID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(expectedIDs) {
+			t.Fatalf("expected %v queued, got %v", expectedIDs, ids)
+		}
+		return queue
+	}
+	take := func(t *testing.T, queue *DownloadQueue, expectedID int32) DownloadQueueItem {
+		t.Helper()
+		it, ok := queue.Take()
+		if !ok || it.MsgID != expectedID {
+			t.Fatalf("expected #%d, got #%d (%v)", expectedID, it.MsgID, ok)
+		}
+		return it
+	}
+
+	queue := open(t)
+	for _, it := range []DownloadQueueItem{item(1), item(2), item(1)} {
+		if err := queue.Push(it); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := queue.Done(take(t, queue, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	queue = open(t, 2)
+	willRetry, err := queue.Fail(take(t, queue, 2), merry.New("oops"))
+	if err != nil || !willRetry {
+		t.Fatalf("willRetry=%v, err=%v", willRetry, err)
+	}
+
+	queue = open(t, 2)
+	if it := queue.items[item(2).key()]; it.Attempts != 1 || it.LastError != "oops" {
+		t.Errorf("unexpected failed item: %#v", it)
+	}
+	queue.Close()
+	if err := queue.Done(take(t, queue, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if it, ok := queue.Take(); ok {
+		t.Errorf("closed empty queue returned %#v", it)
+	}
+	queue = open(t)
+
+	for _, it := range []DownloadQueueItem{item(3), item(4)} {
+		if err := queue.Push(it); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inProgress := take(t, queue, 3)
+	queue.Abort()
+	if it, ok := queue.Take(); ok {
+		t.Errorf("aborted queue returned %#v", it)
+	}
+	if err := queue.Done(inProgress); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, queue.PendingCount(), 1)
+	queue = open(t, 3, 4)
+
+	// parked chat items are skipped without using up attempts
+	queue.Park(take(t, queue, 3))
+	queue.UnparkAll()
+	queue.Park(take(t, queue, 3))
+	queue.Close()
+	if it, ok := queue.Take(); ok {
+		t.Errorf("closed queue with parked chat returned %#v", it)
+	}
+	open(t, 3, 4)
+	assertEqual(t, queue.items[item(3).key()].Attempts, int32(0))
+}
+
+func TestJSONFilesHistorySaver__Comments(t *testing.T) {
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+	chat := &Chat{ID: 123, Title: "Channel", Type: ChatChannel}
+
+	lastIDs := func(t *testing.T, expected map[int32]int32) {
+		t.Helper()
+		ids, err := saver.GetLastCommentIDs(chat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, ids, expected)
+	}
+
+	lastIDs(t, map[int32]int32{})
+	for postID, comments := range map[int32][]mtproto.TL{
+		1: {mtproto.TL_message{ID: 12}, mtproto.TL_message{ID: 11}},
+		2: {mtproto.TL_message{ID: 15}},
+	} {
+		if err := saver.SaveComments(chat, postID, comments); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lastIDs(t, map[int32]int32{1: 12, 2: 15})
+}
+
+func TestJSONFilesHistorySaver__ForumTopics(t *testing.T) {
+	dirpath := t.TempDir()
+	saver := NewJSONFilesHistorySaver(dirpath)
+	chat := &Chat{ID: 123, Title: "Forum", Type: ChatChannel, Obj: mtproto.TL_channel{ID: 123, Forum: true}}
+
+	if err := saver.SaveForumTopics(chat, []mtproto.TL{
+		mtproto.TL_forumTopic{ID: 1, Title: "General"},
+		mtproto.TL_forumTopic{ID: 5, Title: "Five"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saver.SaveForumTopics(chat, []mtproto.TL{mtproto.TL_forumTopic{ID: 5, Title: "Five"}}); err != nil {
+		t.Fatal(err)
+	}
+	topicID := int32(5)
+	if err := saver.SaveMessages(chat, []mtproto.TL{
+		mtproto.TL_message{ID: 2, ReplyTo: mtproto.TL_messageReplyHeader{ForumTopic: true, ReplyToMsgID: &topicID}},
+		mtproto.TL_message{ID: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	topics, _, err := NewJSONMessageReader(dirpath+"/123_Forum"+chatTopicsFileSuffix).Read(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 1 || topics[0]["Title"] != "Five" {
+		t.Errorf("topics list must be replaced: %v", topics)
+	}
+
+	messages, _, err := NewJSONMessageReader(dirpath+"/123_Forum").Read(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0]["_TOPIC_ID"] != 1.0 || messages[1]["_TOPIC_ID"] != 5.0 {
+		t.Errorf("unexpected messages topics: %v", messages)
+	}
+}
+
+func TestJSONFilesHistorySaver__PendingWebPages(t *testing.T) {
+	log = mtproto.Logger{Hnd: mtproto.NoopLogHandler{}}
+	dirpath := t.TempDir()
+	saver := NewJSONFilesHistorySaver(dirpath)
+	chat := &Chat{ID: 123, Title: "Chat"}
+
+	var requestedFiles []int32
+	var requestedPostIDs []int32
+	saver.SetFileRequestCallback(func(chat *Chat, file *TGFileInfo, msgID int32, mediaSource MediaFileSource, postID int32) error {
+		requestedFiles = append(requestedFiles, msgID)
+		requestedPostIDs = append(requestedPostIDs, postID)
+		return nil
+	})
+
+	pendingItems := func(t *testing.T, source MediaFileSource) []PendingWebPageData {
+		t.Helper()
+		items, err := saver.GetPendingWebPages(chat, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+	pendingIDs := func(t *testing.T, expected []int32) {
+		t.Helper()
+		ids := []int32{}
+		for _, item := range pendingItems(t, MessageMediaFile) {
+			ids = append(ids, item.ID)
+		}
+		assertEqual(t, ids, expected)
+	}
+
+	pending := mtproto.TL_messageMediaWebPage{Webpage: mtproto.TL_webPagePending{ID: 1}}
+	ready := mtproto.TL_messageMediaWebPage{Webpage: mtproto.TL_webPage{ID: 1, Photo: mtproto.TL_photo{
+		ID: 5, Sizes: []mtproto.TL{mtproto.TL_photoSize{Type: "x", W: 10, H: 10, Size: 100}},
+	}}}
+
+	if err := saver.SaveMessages(chat, []mtproto.TL{
+		mtproto.TL_message{ID: 3, Media: pending},
+		mtproto.TL_message{ID: 2, Media: pending},
+		mtproto.TL_message{ID: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pendingIDs(t, []int32{2, 3})
+
+	count, err := saver.SaveResolvedWebPages(chat, MessageMediaFile, []mtproto.TL{
+		mtproto.TL_message{ID: 2, Media: ready},
+		mtproto.TL_message{ID: 3, Media: pending},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, count, 1)
+	assertEqual(t, requestedFiles, []int32{2})
+	pendingIDs(t, []int32{3})
+
+	count, err = saver.SaveResolvedWebPages(chat, MessageMediaFile, []mtproto.TL{mtproto.TL_messageEmpty{ID: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, count, 0)
+	pendingIDs(t, []int32{})
+
+	edits, _, err := NewJSONMessageReader(dirpath+"/123_Chat"+chatEditsFileSuffix).Read(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edits) != 1 || edits[0]["ID"] != 2.0 || edits[0]["_DETECTED_AT"] == nil {
+		t.Errorf("unexpected superseding records: %v", edits)
+	}
+
+	// edited messages with pending previews
+	n, err := saver.SaveMessageRevisions(chat, []mtproto.TL{mtproto.TL_message{ID: 1, Message: "edited", Media: pending}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, n, 1)
+	pendingIDs(t, []int32{1})
+
+	// comments are tracked separately (with their post IDs)
+	if err := saver.SaveComments(chat, 7, []mtproto.TL{mtproto.TL_message{ID: 2, Media: pending}}); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(pendingItems(t, CommentMediaFile)), 1)
+	assertEqual(t, pendingItems(t, CommentMediaFile)[0].PostID, int32(7))
+	requestedFiles, requestedPostIDs = nil, nil
+	count, err = saver.SaveResolvedWebPages(chat, CommentMediaFile, []mtproto.TL{mtproto.TL_message{ID: 2, Media: ready}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, count, 1)
+	assertEqual(t, requestedFiles, []int32{2})
+	assertEqual(t, requestedPostIDs, []int32{7})
+	assertEqual(t, len(pendingItems(t, CommentMediaFile)), 0)
+	pendingIDs(t, []int32{1})
+}
+
+func TestJSONFilesHistorySaver__OlderMessages(t *testing.T) {
+	dirpath := t.TempDir()
+	saver := NewJSONFilesHistorySaver(dirpath)
+	chat := &Chat{ID: 123, Title: "Chat"}
+
+	oldest := func(t *testing.T, expectedID int32, expectedCount int) {
+		t.Helper()
+		id, count, err := saver.GetOldestMessageID(chat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, id, expectedID)
+		assertEqual(t, count, expectedCount)
+	}
+
+	oldest(t, 0, 0)
+	if err := saver.SaveMessages(chat, []mtproto.TL{mtproto.TL_message{ID: 11}, mtproto.TL_message{ID: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	oldest(t, 10, 2)
+
+	// chunks are loaded from newest to oldest
+	for _, chunk := range [][]mtproto.TL{
+		{mtproto.TL_message{ID: 9}, mtproto.TL_message{ID: 7}},
+		{mtproto.TL_message{ID: 7}, mtproto.TL_message{ID: 5}, mtproto.TL_messageEmpty{ID: 1}},
+	} {
+		if err := saver.SaveOlderMessages(chat, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldest(t, 1, 6)
+
+	if err := saver.MergeOlderMessages(chat); err != nil {
+		t.Fatal(err)
+	}
+	oldest(t, 1, 5)
+	ids, err := saver.GetSavedMessageIDs(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, ids, []int32{5, 7, 9, 10, 11})
+	lastID, err := saver.GetLastMessageID(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, lastID, int32(11))
+
+	if _, err := os.Stat(dirpath + "/123_Chat" + chatOlderFileSuffix); !os.IsNotExist(err) {
+		t.Errorf("older messages segment must be removed after merge: %v", err)
+	}
+	if err := saver.MergeOlderMessages(chat); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONFilesHistorySaver__GapMessages(t *testing.T) {
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+	chat := &Chat{ID: 123, Title: "Chat"}
+
+	if err := saver.SaveMessages(chat, []mtproto.TL{
+		mtproto.TL_message{ID: 10}, mtproto.TL_message{ID: 6}, mtproto.TL_message{ID: 5}, mtproto.TL_message{ID: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	gaps, err := saver.FindMessageIDsGaps(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, gaps, []MessageIDsGap{{AfterID: 2, BeforeID: 5}, {AfterID: 6, BeforeID: 10}})
+
+	for _, chunk := range [][]mtproto.TL{
+		{mtproto.TL_message{ID: 9}, mtproto.TL_message{ID: 7}},
+		{mtproto.TL_message{ID: 3}, mtproto.TL_message{ID: 6}},
+	} {
+		if err := saver.SaveGapMessages(chat, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := saver.MergeGapMessages(chat); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := saver.GetSavedMessageIDs(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, ids, []int32{2, 3, 5, 6, 7, 9, 10})
+	gaps, err = saver.FindMessageIDsGaps(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, gaps, []MessageIDsGap{{AfterID: 3, BeforeID: 5}, {AfterID: 7, BeforeID: 9}})
+
+	check, err := saver.GetGapsCheck(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, check, GapsCheckData{})
+	if err := saver.SaveGapsCheck(chat, GapsCheckData{FromID: 2, ToID: 10}); err != nil {
+		t.Fatal(err)
+	}
+	check, err = saver.GetGapsCheck(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, check, GapsCheckData{FromID: 2, ToID: 10})
+}
+
+func TestJSONFilesHistorySaver__TruncatePartialLines(t *testing.T) {
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+	chat := &Chat{ID: 123, Title: "Chat"}
+
+	if err := saver.SaveMessages(chat, []mtproto.TL{mtproto.TL_message{ID: 2}, mtproto.TL_message{ID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	fpath, err := saver.chatMessagesFPath(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherFPath := saver.Dirpath + "/config.json"
+	for _, it := range []struct{ fpath, content string }{{fpath, `{"ID":3,"Mess`}, {otherFPath, `{}`}} {
+		f, err := os.OpenFile(it.fpath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(it.content)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	if _, err := saver.GetLastMessageID(chat); err == nil {
+		t.Fatal("expected partial line to fail")
+	}
+
+	truncated, err := saver.TruncatePartialLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, truncated, []string{fpath})
+	lastID, err := saver.GetLastMessageID(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, lastID, int32(2))
+	if buf, err := os.ReadFile(otherFPath); err != nil || string(buf) != `{}` {
+		t.Errorf("unrelated file must not be touched: %q, %v", buf, err)
+	}
+
+	truncated, err = saver.TruncatePartialLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(truncated), 0)
+}
+
+func TestJSONFilesHistorySaver__MetricsSnapshots(t *testing.T) {
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+	chat := &Chat{ID: 123, Title: "Channel"}
+	views := int32(10)
+
+	for _, snapshot := range []MetricsSnapshotData{
+		{Messages: []MessageMetricsData{{ID: 1, Views: &views}}},
+		{Messages: []MessageMetricsData{{ID: 1, Views: &views, Reactions: map[string]int32{"👍": 2}}, {ID: 2}}},
+	} {
+		if err := saver.SaveMetricsSnapshot(chat, snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fpath, err := saver.chatMessagesFPath(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := readMetricsSnapshots(fpath + chatMetricsFileSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(snapshots), 2)
+	assertEqual(t, snapshots[1].Messages, []MessageMetricsData{
+		{ID: 1, Views: &views, Reactions: map[string]int32{"👍": 2}}, {ID: 2},
+	})
+}
+
+func TestJSONFilesHistorySaver__ChatFullInfo(t *testing.T) {
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+	channel := mtproto.TL_channel{ID: 123, Title: "Channel"}
+	countRecords := func(t *testing.T, expected int) {
+		t.Helper()
+		buf, err := os.ReadFile(saver.chatsFPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, strings.Count(string(buf), "\n"), expected)
+	}
+
+	if err := saver.SaveRelatedChats([]mtproto.TL{channel}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saver.SaveChatFullInfo(channel, &ChatFullData{About: "about", ParticipantsCount: 10}); err != nil {
+		t.Fatal(err)
+	}
+	countRecords(t, 2)
+
+	// regular channel object (without full info) is not a change
+	if err := saver.SaveRelatedChats([]mtproto.TL{channel}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saver.SaveChatFullInfo(channel, &ChatFullData{About: "about", ParticipantsCount: 10}); err != nil {
+		t.Fatal(err)
+	}
+	countRecords(t, 2)
+
+	if err := saver.SaveChatFullInfo(channel, &ChatFullData{About: "about", ParticipantsCount: 11}); err != nil {
+		t.Fatal(err)
+	}
+	countRecords(t, 3)
+
+	reader := NewJSONRecordsReader[ChatData](saver.chatsFPath())
+	if err := reader.UpdateOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	chat, _, err := reader.Read(123)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, chat.Full, &ChatFullData{About: "about", ParticipantsCount: 11})
+}
+
+func TestJSONFilesHistorySaver__Participants(t *testing.T) {
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+	chat := &Chat{ID: 123, Title: "Group"}
+	save := func(t *testing.T, partial bool, userIDs ...int64) ParticipantsChangeData {
+		t.Helper()
+		snapshot := &ParticipantsSnapshotData{Count: int32(len(userIDs)), Partial: partial}
+		for _, id := range userIDs {
+			snapshot.Participants = append(snapshot.Participants, ParticipantData{UserID: id, Role: "member"})
+		}
+		change, err := saver.SaveParticipants(chat, snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return change
+	}
+
+	// no previous snapshot, nothing to compare with
+	change := save(t, false, 1, 2, 3)
+	assertEqual(t, change.Joined, []int64(nil))
+	assertEqual(t, change.Left, []int64(nil))
+
+	change = save(t, false, 1, 3, 4)
+	assertEqual(t, change.Joined, []int64{4})
+	assertEqual(t, change.Left, []int64{2})
+
+	change = save(t, false, 1, 3, 4, 6)
+	assertEqual(t, change.Joined, []int64{6})
+	assertEqual(t, change.Left, []int64(nil))
+
+	// missing members of a partial snapshot may still be there
+	change = save(t, true, 1, 5)
+	assertEqual(t, change.Joined, []int64(nil))
+	assertEqual(t, change.Left, []int64(nil))
+	assertEqual(t, change.Partial, true)
+
+	// previous snapshot is partial, so 7 may have been there before
+	change = save(t, false, 1, 5, 7)
+	assertEqual(t, change.Joined, []int64(nil))
+	assertEqual(t, change.Left, []int64(nil))
+	assertEqual(t, change.Partial, true)
+
+	fpath, err := saver.chatParticipantsFPath(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, strings.Count(string(buf), "\n"), 2)
+
+	snapshot, err := readParticipantsSnapshot(fpath + chatSnapshotFileSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, snapshot.Participants, []ParticipantData{{UserID: 1, Role: "member"}, {UserID: 5, Role: "member"}, {UserID: 7, Role: "member"}})
+
+	// partial snapshots of recent members: only joins after the previous snapshot are reported
+	takenAt := time.Unix(1700000000, 0)
+	for _, snapshot := range []*ParticipantsSnapshotData{
+		{TakenAt: takenAt, Count: 10000, Partial: true, Participants: []ParticipantData{
+			{UserID: 8, Role: "member", JoinedAt: 1600000000},
+		}},
+		{TakenAt: takenAt.Add(time.Hour), Count: 10000, Partial: true, Participants: []ParticipantData{
+			{UserID: 9, Role: "member", JoinedAt: 1700000100},
+			{UserID: 10, Role: "member", JoinedAt: 1600000000},
+		}},
+	} {
+		change, err = saver.SaveParticipants(chat, snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertEqual(t, change, ParticipantsChangeData{DetectedAt: takenAt.Add(time.Hour), Joined: []int64{9}, Partial: true})
+}
+
+func TestJSONFilesHistorySaver__AdminLog(t *testing.T) {
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+	chat := &Chat{ID: 123, Title: "Group"}
+
+	lastID, err := saver.GetLastAdminLogEventID(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, lastID, int64(0))
+
+	// 64-bit IDs are saved as strings, they do not fit into float64
+	events := []mtproto.TL{
+		mtproto.TL_channelAdminLogEvent{ID: 9007199254740995, Date: 2, Action: mtproto.TL_channelAdminLogEventActionChangeTitle{NewValue: "B"}},
+		mtproto.TL_channelAdminLogEvent{ID: 9007199254740993, Date: 1, Action: mtproto.TL_channelAdminLogEventActionChangeTitle{NewValue: "A"}},
+	}
+	if err := saver.SaveAdminLogEvents(chat, events); err != nil {
+		t.Fatal(err)
+	}
+	lastID, err = saver.GetLastAdminLogEventID(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, lastID, int64(9007199254740995))
+}
+
+func TestJSONFilesHistorySaver__Avatars(t *testing.T) {
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+
+	fname, err := saver.FindCurrentAvatarFName(123, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, fname, "")
+
+	if err := os.MkdirAll(saver.avatarsDirpath(123), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for i, fname := range []string{"2.jpg", "1.jpg", "3.jpg.temp"} {
+		if err := os.WriteFile(saver.AvatarFPath(123, fname), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := saver.SetAvatarDate(123, fname, time.Unix(int64(1000+i), 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for photoID, expected := range map[int64]string{
+		2: "2.jpg", //current one, even if it is not the latest downloaded
+		3: "",      //partially downloaded file is ignored
+		0: "",      //no photo
+	} {
+		fname, err = saver.FindCurrentAvatarFName(123, photoID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, fname, expected)
+	}
+}
+
+func TestJSONFilesHistorySaver__PeersPhotoID(t *testing.T) {
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+	user := mtproto.TL_user{ID: 1, Photo: mtproto.TL_userProfilePhoto{PhotoID: 10}}
+	channel := mtproto.TL_channel{ID: 2, Title: "Channel", Photo: mtproto.TL_chatPhoto{PhotoID: 20}}
+	countRecords := func(t *testing.T, fpath string, expected int) {
+		t.Helper()
+		buf, err := os.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, strings.Count(string(buf), "\n"), expected)
+	}
+
+	for _, photoID := range []int64{10, 10, 11} {
+		user.Photo = mtproto.TL_userProfilePhoto{PhotoID: photoID}
+		channel.Photo = mtproto.TL_chatPhoto{PhotoID: photoID + 10}
+		if err := saver.SaveRelatedUsers([]mtproto.TL{user}); err != nil {
+			t.Fatal(err)
+		}
+		if err := saver.SaveRelatedChats([]mtproto.TL{channel}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	countRecords(t, saver.usersFPath(), 2)
+	countRecords(t, saver.chatsFPath(), 2)
+
+	usersReader := NewJSONRecordsReader[UserData](saver.usersFPath())
+	if err := usersReader.UpdateOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	userData, _, err := usersReader.Read(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, userData.PhotoID, int64(11))
+
+	chatsReader := NewJSONRecordsReader[ChatData](saver.chatsFPath())
+	if err := chatsReader.UpdateOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	chatData, _, err := chatsReader.Read(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, chatData.PhotoID, int64(21))
+}
+
+func TestJSONFilesHistorySaver__StickerSets(t *testing.T) {
+	saver := NewJSONFilesHistorySaver(t.TempDir())
+
+	refs := []StickerRefData{{SetID: 10, AccessHash: 20}, {EmojiID: 9007199254740993}}
+	if err := saver.AppendPendingStickerRefs(refs); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := saver.ReadPendingStickerRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, pending, refs)
+
+	set := &mtproto.TL_messages_stickerSet{
+		Set:       mtproto.TL_stickerSet{ID: 10, ShortName: "Cats"},
+		Documents: []mtproto.TL{mtproto.TL_document{ID: 9007199254740993}, mtproto.TL_document{ID: 2}},
+	}
+	fpath, err := saver.StickerFPath(set.Set, "2.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, fpath, saver.Dirpath+"/stickers/10_Cats/2.webp")
+
+	// set without info file is not complete
+	if err := os.MkdirAll(saver.Dirpath+"/stickers/10_Cats", 0700); err != nil {
+		t.Fatal(err)
+	}
+	sets, err := saver.ReadSavedStickerSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, sets, map[int64][]int64{})
+
+	if err := saver.SaveStickerSet(set); err != nil {
+		t.Fatal(err)
+	}
+	sets, err = saver.ReadSavedStickerSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, sets, map[int64][]int64{10: {9007199254740993, 2}})
+
+	if err := saver.RemovePendingStickerRefs(); err != nil {
+		t.Fatal(err)
+	}
+	pending, err = saver.ReadPendingStickerRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(pending), 0)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/3bl3gamer/tgclient/mtproto"
+	"github.com/ansel1/merry/v2"
+	"golang.org/x/term"
+)
+
+const sessionEncryption = "aes-256-gcm+pbkdf2-sha256"
+const sessionKDFIterations = 600_000
+
+// prefix of portable session strings (for -export-session and -import-session)
+const sessionStringPrefix = "tghd1:"
+
+// EncryptedSessFileStore is same as mtproto.SessFileStore but the session (including auth key)
+// is encrypted with a key derived from passphrase.
+type EncryptedSessFileStore struct {
+	FPath      string
+	Passphrase string
+	mutex      *sync.Mutex
+	salt       []byte
+	iterations int
+	key        []byte
+}
+
+type encryptedSessionFile struct {
+	Encryption string `json:"encryption"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+func NewEncryptedSessFileStore(fpath, passphrase string) *EncryptedSessFileStore {
+	return &EncryptedSessFileStore{FPath: fpath, Passphrase: passphrase, mutex: &sync.Mutex{}}
+}
+
+func (s *EncryptedSessFileStore) Load(sess *mtproto.SessionInfo) error {
+	s.mutex.Lock()
+	buf, err := os.ReadFile(s.FPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.mutex.Unlock()
+		return merry.Wrap(mtproto.ErrNoSessionData, merry.WithCause(err))
+	}
+	if err != nil {
+		s.mutex.Unlock()
+		return merry.Wrap(err)
+	}
+
+	var file encryptedSessionFile
+	if err := json.Unmarshal(buf, &file); err != nil {
+		s.mutex.Unlock()
+		return merry.Wrap(err)
+	}
+	if file.Encryption == "" {
+		// plaintext session (saved by mtproto.SessFileStore), encrypting it right away
+		s.mutex.Unlock()
+		if err := json.Unmarshal(buf, sess); err != nil {
+			return merry.Wrap(err)
+		}
+		log.Info("encrypting session file %s", s.FPath)
+		return merry.Wrap(s.Save(sess))
+	}
+	defer s.mutex.Unlock()
+	if file.Encryption != sessionEncryption {
+		return merry.Errorf("unsupported session encryption '%s'", file.Encryption)
+	}
+
+	key, err := pbkdf2.Key(sha256.New, s.Passphrase, file.Salt, file.Iterations, 32)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	gcm, err := newSessionGCM(key)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	data, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return merry.Errorf("can not decrypt session file %s: wrong passphrase or damaged file", s.FPath)
+	}
+	if err := json.Unmarshal(data, sess); err != nil {
+		return merry.Wrap(err)
+	}
+	s.salt = file.Salt
+	s.iterations = file.Iterations
+	s.key = key
+	return nil
+}
+
+func (s *EncryptedSessFileStore) Save(sess *mtproto.SessionInfo) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// key derivation is slow, so it is done once per salt (session is saved several times during connection);
+	// key loaded from existing file is reused along with its salt and iterations count
+	if s.key == nil {
+		s.salt = make([]byte, 16)
+		if _, err := rand.Read(s.salt); err != nil {
+			return merry.Wrap(err)
+		}
+		if s.iterations == 0 {
+			s.iterations = sessionKDFIterations
+		}
+		var err error
+		s.key, err = pbkdf2.Key(sha256.New, s.Passphrase, s.salt, s.iterations, 32)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	gcm, err := newSessionGCM(s.key)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return merry.Wrap(err)
+	}
+	file := encryptedSessionFile{
+		Encryption: sessionEncryption,
+		Iterations: s.iterations,
+		Salt:       s.salt,
+		Nonce:      nonce,
+		Data:       gcm.Seal(nil, nonce, data, nil),
+	}
+	buf, err := json.MarshalIndent(file, "", "\t")
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	if err := os.WriteFile(s.FPath+".temp", buf, 0600); err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(os.Rename(s.FPath+".temp", s.FPath))
+}
+
+func newSessionGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	return gcm, merry.Wrap(err)
+}
+
+// tgMakeSessionStore returns encrypted session store if config.session_passphrase is set
+// (asking passphrase if needed) or plaintext one otherwise.
+func tgMakeSessionStore(config *Config) (mtproto.SessionStore, error) {
+	if config.SessionPassphrase == "" {
+		// otherwise SessFileStore will silently load an empty session
+		if buf, err := os.ReadFile(config.SessionFilePath); err == nil {
+			var file encryptedSessionFile
+			if json.Unmarshal(buf, &file) == nil && file.Encryption != "" {
+				return nil, merry.Errorf("session file %s is encrypted, session_passphrase is required", config.SessionFilePath)
+			}
+		}
+		return &mtproto.SessFileStore{FPath: config.SessionFilePath}, nil
+	}
+	passphrase, err := readSessionPassphrase(config)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	if passphrase == "" {
+		return nil, merry.New("session passphrase is empty")
+	}
+	return NewEncryptedSessFileStore(config.SessionFilePath, passphrase), nil
+}
+
+// "prompt" -> asked in terminal, otherwise same sources as for login data ("env:NAME", "file:path")
+func readSessionPassphrase(config *Config) (string, error) {
+	if config.SessionPassphrase != "prompt" {
+		return readSecretSource(config.SessionPassphrase, "session_passphrase")
+	}
+
+	// accounts may be connecting simultaneously, prompts must not mix
+	tgAuthMutex.Lock()
+	defer tgAuthMutex.Unlock()
+	fmt.Fprintf(os.Stderr, "Enter passphrase for session %s: ", config.SessionFilePath)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		buf, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(buf), merry.Wrap(err)
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), merry.Wrap(err)
+}
+
+// exportSessionString returns the session as a portable string (it grants full access to the account!).
+func exportSessionString(store mtproto.SessionStore) (string, error) {
+	sess := &mtproto.SessionInfo{}
+	if err := store.Load(sess); err != nil {
+		return "", merry.Wrap(err)
+	}
+	buf, err := json.Marshal(sess)
+	if err != nil {
+		return "", merry.Wrap(err)
+	}
+	return sessionStringPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// importSessionString saves session from a string made by exportSessionString.
+// Existing session file is not overwritten.
+func importSessionString(store mtproto.SessionStore, fpath, str string) error {
+	if _, err := os.Stat(fpath); err == nil {
+		return merry.Errorf("session file %s already exists, remove it (or logout with -logout) first", fpath)
+	} else if !os.IsNotExist(err) {
+		return merry.Wrap(err)
+	}
+
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(str), sessionStringPrefix)
+	if !ok {
+		return merry.Errorf("wrong session string: expected it to start with '%s'", sessionStringPrefix)
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return merry.Prepend(err, "wrong session string")
+	}
+	sess := &mtproto.SessionInfo{}
+	if err := json.Unmarshal(buf, sess); err != nil {
+		return merry.Prepend(err, "wrong session string")
+	}
+	if len(sess.AuthKey) == 0 || sess.Addr == "" {
+		return merry.New("wrong session string: auth key or DC address is missing")
+	}
+	return merry.Wrap(store.Save(sess))
+}
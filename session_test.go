@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/3bl3gamer/tgclient/mtproto"
+)
+
+// key derivation with default iterations count is too slow for tests
+const testSessionKDFIterations = 1000
+
+func newTestSessFileStore(fpath, passphrase string) *EncryptedSessFileStore {
+	store := NewEncryptedSessFileStore(fpath, passphrase)
+	store.iterations = testSessionKDFIterations
+	return store
+}
+
+func readTestSessionFile(t *testing.T, fpath string) encryptedSessionFile {
+	t.Helper()
+	buf, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file encryptedSessionFile
+	if err := json.Unmarshal(buf, &file); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+var testSession = mtproto.SessionInfo{
+	DCID:        2,
+	AuthKey:     []byte("auth key auth key auth key"),
+	AuthKeyHash: []byte("hash"),
+	ServerSalt:  123,
+	Addr:        "149.154.167.51:443",
+}
+
+func TestEncryptedSessFileStore(t *testing.T) {
+	fpath := t.TempDir() + "/tg.session"
+
+	sess := testSession
+	if err := newTestSessFileStore(fpath, "secret").Save(&sess); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf, []byte(`"addr"`)) {
+		t.Errorf("session file is not encrypted: %s", buf)
+	}
+	file := readTestSessionFile(t, fpath)
+	assertEqual(t, file.Encryption, sessionEncryption)
+	assertEqual(t, file.Iterations, testSessionKDFIterations)
+
+	// loaded with another store (iterations count is taken from the file)
+	store := NewEncryptedSessFileStore(fpath, "secret")
+	loaded := mtproto.SessionInfo{}
+	if err := store.Load(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, loaded, testSession)
+
+	// re-saved with the same key, so the file must keep its iterations count
+	loaded.ServerSalt = 456
+	if err := store.Save(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, readTestSessionFile(t, fpath).Iterations, testSessionKDFIterations)
+	reloaded := mtproto.SessionInfo{}
+	if err := NewEncryptedSessFileStore(fpath, "secret").Load(&reloaded); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, reloaded.ServerSalt, int64(456))
+
+	// wrong passphrase
+	if err := NewEncryptedSessFileStore(fpath, "wrong").Load(&mtproto.SessionInfo{}); err == nil {
+		t.Error("expected error for wrong passphrase")
+	}
+}
+
+func TestEncryptedSessFileStore__PlaintextMigration(t *testing.T) {
+	prevLog := log
+	log = mtproto.Logger{Hnd: mtproto.NoopLogHandler{}}
+	t.Cleanup(func() { log = prevLog })
+	fpath := t.TempDir() + "/tg.session"
+
+	sess := testSession
+	if err := (&mtproto.SessFileStore{FPath: fpath}).Save(&sess); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := mtproto.SessionInfo{}
+	if err := newTestSessFileStore(fpath, "secret").Load(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, loaded, testSession)
+	assertEqual(t, readTestSessionFile(t, fpath).Encryption, sessionEncryption)
+
+	// plaintext store must not silently ignore encrypted file
+	_, err := tgMakeSessionStore(&Config{SessionFilePath: fpath})
+	if err == nil {
+		t.Error("expected error for encrypted session without passphrase")
+	}
+}
+
+func TestSessionString(t *testing.T) {
+	dirpath := t.TempDir()
+
+	sess := testSession
+	src := &mtproto.SessFileStore{FPath: dirpath + "/src.session"}
+	if err := src.Save(&sess); err != nil {
+		t.Fatal(err)
+	}
+	str, err := exportSessionString(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dstFPath := dirpath + "/dst.session"
+	dst := newTestSessFileStore(dstFPath, "secret")
+	if err := importSessionString(dst, dstFPath, " "+str+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	loaded := mtproto.SessionInfo{}
+	if err := NewEncryptedSessFileStore(dstFPath, "secret").Load(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, loaded, testSession)
+
+	// existing session is not overwritten
+	if err := importSessionString(dst, dstFPath, str); err == nil {
+		t.Error("expected error for existing session file")
+	}
+
+	for _, wrongStr := range []string{"", str[len(sessionStringPrefix):], sessionStringPrefix + "!!!", sessionStringPrefix + "e30"} {
+		fpath := dirpath + "/wrong.session"
+		if err := importSessionString(&mtproto.SessFileStore{FPath: fpath}, fpath, wrongStr); err == nil {
+			t.Errorf("expected error for session string '%s'", wrongStr)
+		}
+	}
+}
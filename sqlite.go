@@ -0,0 +1,869 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/3bl3gamer/tgclient/mtproto"
+	"github.com/ansel1/merry/v2"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteDBFName = "history.sqlite"
+
+// Records have same "data" as lines of JSON files (history/<id>_<title>, stories/<id>_<title>, etc.),
+// other columns are extracted from it for querying.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	chat_id    INTEGER NOT NULL,
+	id         INTEGER NOT NULL,
+	type       TEXT NOT NULL,
+	date       INTEGER,
+	from_id    INTEGER,
+	text       TEXT,
+	media_type TEXT,
+	edit_date  INTEGER,
+	topic_id   INTEGER,
+	data       TEXT NOT NULL,
+	PRIMARY KEY (chat_id, id)
+);
+CREATE INDEX IF NOT EXISTS messages_date ON messages (chat_id, date);
+CREATE INDEX IF NOT EXISTS messages_from_id ON messages (from_id);
+
+CREATE TABLE IF NOT EXISTS message_edits (
+	chat_id     INTEGER NOT NULL,
+	id          INTEGER NOT NULL,
+	detected_at INTEGER NOT NULL,
+	type        TEXT NOT NULL,
+	date        INTEGER,
+	from_id     INTEGER,
+	text        TEXT,
+	media_type  TEXT,
+	edit_date   INTEGER,
+	topic_id    INTEGER,
+	data        TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS message_edits_id ON message_edits (chat_id, id);
+
+CREATE TABLE IF NOT EXISTS deleted_messages (
+	chat_id     INTEGER NOT NULL,
+	id          INTEGER NOT NULL,
+	detected_at INTEGER NOT NULL,
+	PRIMARY KEY (chat_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS pending_webpages (
+	chat_id     INTEGER NOT NULL,
+	source      INTEGER NOT NULL,
+	id          INTEGER NOT NULL,
+	post_id     INTEGER NOT NULL,
+	detected_at INTEGER NOT NULL,
+	resolved_at INTEGER,
+	PRIMARY KEY (chat_id, source, id)
+);
+
+CREATE TABLE IF NOT EXISTS comments (
+	chat_id    INTEGER NOT NULL,
+	post_id    INTEGER NOT NULL,
+	id         INTEGER NOT NULL,
+	type       TEXT NOT NULL,
+	date       INTEGER,
+	from_id    INTEGER,
+	text       TEXT,
+	media_type TEXT,
+	data       TEXT NOT NULL,
+	PRIMARY KEY (chat_id, id)
+);
+CREATE INDEX IF NOT EXISTS comments_post_id ON comments (chat_id, post_id);
+
+CREATE TABLE IF NOT EXISTS forum_topics (
+	chat_id INTEGER NOT NULL,
+	id      INTEGER NOT NULL,
+	title   TEXT,
+	data    TEXT NOT NULL,
+	PRIMARY KEY (chat_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS stories (
+	chat_id    INTEGER NOT NULL,
+	id         INTEGER NOT NULL,
+	type       TEXT NOT NULL,
+	date       INTEGER,
+	text       TEXT,
+	media_type TEXT,
+	data       TEXT NOT NULL,
+	PRIMARY KEY (chat_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS users (
+	id         INTEGER PRIMARY KEY,
+	username   TEXT,
+	first_name TEXT,
+	last_name  TEXT,
+	phone      TEXT,
+	is_bot     INTEGER NOT NULL,
+	is_deleted INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL,
+	data       TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS chats (
+	id         INTEGER PRIMARY KEY,
+	username   TEXT,
+	title      TEXT NOT NULL,
+	is_channel INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL,
+	data       TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS contacts (
+	user_id INTEGER PRIMARY KEY,
+	data    TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS auths (
+	hash INTEGER PRIMARY KEY,
+	data TEXT NOT NULL
+);
+`
+
+// SQLiteHistorySaver saves messages, stories, users, chats, contacts and sessions to SQLite database
+// (<out_dir_path>/history.sqlite). Everything else (media files, participants, admin log, metrics, etc.)
+// is saved by the embedded JSONFilesHistorySaver as usual.
+//
+// Messages are inserted right into the messages table, so older and gap messages need no merging.
+type SQLiteHistorySaver struct {
+	*JSONFilesHistorySaver
+	db           *sql.DB
+	relatedMutex *sync.Mutex
+	savedUsers   map[int64]*UserData
+	savedChats   map[int64]*ChatData
+}
+
+func NewSQLiteHistorySaver(files *JSONFilesHistorySaver) (*SQLiteHistorySaver, error) {
+	if err := os.MkdirAll(files.Dirpath, 0700); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	fpath := filepath.Join(files.Dirpath, sqliteDBFName)
+
+	// storage is not converted: new database would make everything to be dumped again from the beginning
+	if _, err := os.Stat(fpath); os.IsNotExist(err) {
+		chats, err := files.ReadSavedChatsList()
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+		if len(chats) > 0 {
+			return nil, merry.Errorf("%s already contains JSON dump of %d chat(s), SQLite storage can not continue it: "+
+				"use 'json' storage or another out_dir_path", files.Dirpath, len(chats))
+		}
+	} else if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+fpath+"?_journal_mode=WAL&_busy_timeout=10000")
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	// chat workers write concurrently, but SQLite allows only one writer at a time anyway
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, merry.Prependf(err, "opening %s", fpath)
+	}
+	return &SQLiteHistorySaver{JSONFilesHistorySaver: files, db: db, relatedMutex: &sync.Mutex{}}, nil
+}
+
+func (s *SQLiteHistorySaver) Close() error {
+	return merry.Wrap(s.db.Close())
+}
+
+func (s *SQLiteHistorySaver) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(tx.Commit())
+}
+
+func (s *SQLiteHistorySaver) queryInt32s(query string, args ...interface{}) ([]int32, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	defer rows.Close()
+	var ids []int32
+	for rows.Next() {
+		var id int32
+		if err := rows.Scan(&id); err != nil {
+			return nil, merry.Wrap(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, merry.Wrap(rows.Err())
+}
+
+// sqliteRecordRow is a message or story record with columns extracted from it.
+type sqliteRecordRow struct {
+	ID        int32
+	Type      string
+	Date      *int32
+	FromID    *int64
+	Text      *string
+	MediaType *string
+	EditDate  *int32
+	TopicID   *int32
+	Data      string
+}
+
+// makeRecordRows requests related media (same as JSONFilesHistorySaver does before appending records)
+// and converts records to rows. Records are expected to be sorted from newest to oldest,
+// rows are returned from oldest to newest.
+func (s *SQLiteHistorySaver) makeRecordRows(
+	records []mtproto.TL, chat *Chat, mediaSource MediaFileSource, fileInfosFunc FileInfosExtractorFunc,
+	extraFields map[string]interface{},
+) ([]sqliteRecordRow, error) {
+	rows := make([]sqliteRecordRow, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := records[i]
+		recMap := tgObjToMap(rec)
+		recMap["_TL_LAYER"] = mtproto.TL_Layer
+		for k, v := range extraFields {
+			recMap[k] = v
+		}
+		if err := s.requestRelatedMedia(rec, recMap, chat, mediaSource, fileInfosFunc); err != nil {
+			return nil, merry.Wrap(err)
+		}
+		row, err := newSQLiteRecordRow(rec, recMap)
+		if err != nil {
+			return nil, merry.Wrap(err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func newSQLiteRecordRow(rec mtproto.TL, recMap map[string]interface{}) (sqliteRecordRow, error) {
+	buf, err := json.Marshal(recMap)
+	if err != nil {
+		return sqliteRecordRow{}, merry.Wrap(err)
+	}
+	row := sqliteRecordRow{ID: recMap["ID"].(int32), Type: recMap["_"].(string), Data: string(buf)}
+	if date, ok := recMap["Date"].(int32); ok {
+		row.Date = &date
+	}
+	if fromID, ok := tgGetMessageSenderID(rec); ok {
+		row.FromID = &fromID
+	}
+	if text, ok := recMap["Message"].(string); ok {
+		row.Text = &text
+	} else if caption, ok := recMap["Caption"].(*string); ok {
+		row.Text = caption //stories
+	}
+	if media, ok := recMap["Media"].(map[string]interface{}); ok {
+		if mediaType, ok := media["_"].(string); ok {
+			row.MediaType = &mediaType
+		}
+	}
+	if editDate, ok := recMap["EditDate"].(*int32); ok {
+		row.EditDate = editDate
+	}
+	if topicID, ok := recMap["_TOPIC_ID"].(int32); ok {
+		row.TopicID = &topicID
+	}
+	return row, nil
+}
+
+func (s *SQLiteHistorySaver) GetLastMessageID(chat *Chat) (int32, error) {
+	var id int32
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM messages WHERE chat_id = ?`, chat.ID).Scan(&id)
+	return id, merry.Wrap(err)
+}
+
+func (s *SQLiteHistorySaver) GetLastStoryID(chat *Chat) (int32, error) {
+	var id int32
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM stories WHERE chat_id = ?`, chat.ID).Scan(&id)
+	return id, merry.Wrap(err)
+}
+
+func (s *SQLiteHistorySaver) SaveMessages(chat *Chat, messages []mtproto.TL) error {
+	rows, err := s.makeRecordRows(messages, chat, MessageMediaFile, tgFindMessageMediaFileInfos, nil)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	pending, err := findPendingWebPages(messages, 0)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	return s.inTx(func(tx *sql.Tx) error {
+		for _, row := range rows {
+			_, err := tx.Exec(`
+				INSERT OR IGNORE INTO messages
+				(chat_id, id, type, date, from_id, text, media_type, edit_date, topic_id, data)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				chat.ID, row.ID, row.Type, row.Date, row.FromID, row.Text, row.MediaType, row.EditDate, row.TopicID, row.Data)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+		return merry.Wrap(s.savePendingWebPages(tx, chat, MessageMediaFile, pending, false))
+	})
+}
+
+// SaveOlderMessages is same as SaveMessages: messages are sorted by ID in the table anyway.
+func (s *SQLiteHistorySaver) SaveOlderMessages(chat *Chat, messages []mtproto.TL) error {
+	return merry.Wrap(s.SaveMessages(chat, messages))
+}
+
+func (s *SQLiteHistorySaver) MergeOlderMessages(chat *Chat) error {
+	return nil
+}
+
+// SaveGapMessages is same as SaveMessages: messages are sorted by ID in the table anyway.
+func (s *SQLiteHistorySaver) SaveGapMessages(chat *Chat, messages []mtproto.TL) error {
+	return merry.Wrap(s.SaveMessages(chat, messages))
+}
+
+func (s *SQLiteHistorySaver) MergeGapMessages(chat *Chat) error {
+	return nil
+}
+
+// GetOldestMessageID returns the lowest ID of saved messages and the number of saved (non-empty) messages.
+func (s *SQLiteHistorySaver) GetOldestMessageID(chat *Chat) (int32, int, error) {
+	var oldestID int32
+	var count int
+	err := s.db.QueryRow(`
+		SELECT COALESCE(MIN(id), 0), COUNT(CASE WHEN type != 'TL_messageEmpty' THEN 1 END)
+		FROM messages WHERE chat_id = ?`, chat.ID).Scan(&oldestID, &count)
+	return oldestID, count, merry.Wrap(err)
+}
+
+// FindMessageIDsGaps returns ranges of IDs between adjacent saved messages
+// (see [JSONFilesHistorySaver.FindMessageIDsGaps]).
+func (s *SQLiteHistorySaver) FindMessageIDsGaps(chat *Chat) ([]MessageIDsGap, error) {
+	ids, err := s.queryInt32s(`SELECT id FROM messages WHERE chat_id = ? ORDER BY id`, chat.ID)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	var gaps []MessageIDsGap
+	for i := 1; i < len(ids); i++ {
+		if ids[i] > ids[i-1]+1 {
+			gaps = append(gaps, MessageIDsGap{AfterID: ids[i-1], BeforeID: ids[i]})
+		}
+	}
+	return gaps, nil
+}
+
+// GetSavedMessageIDs returns (sorted) IDs of saved messages
+// excluding empty messages and messages that are already marked as deleted.
+func (s *SQLiteHistorySaver) GetSavedMessageIDs(chat *Chat) ([]int32, error) {
+	return s.queryInt32s(`
+		SELECT id FROM messages
+		WHERE chat_id = ? AND type != 'TL_messageEmpty'
+		  AND id NOT IN (SELECT id FROM deleted_messages WHERE chat_id = ?)
+		ORDER BY id`, chat.ID, chat.ID)
+}
+
+func (s *SQLiteHistorySaver) SaveDeletedMessages(chat *Chat, msgIDs []int32) error {
+	now := time.Now().Unix()
+	return s.inTx(func(tx *sql.Tx) error {
+		for _, id := range msgIDs {
+			_, err := tx.Exec(`INSERT OR IGNORE INTO deleted_messages (chat_id, id, detected_at) VALUES (?, ?, ?)`,
+				chat.ID, id, now)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+		return nil
+	})
+}
+
+// lastMessageRevision returns the last saved version of the message (from edits or messages table).
+func (s *SQLiteHistorySaver) lastMessageRevision(chat *Chat, msgID int32) (SavedMessageRevision, bool, error) {
+	rev := SavedMessageRevision{ID: int64(msgID)}
+	var text sql.NullString
+	err := s.db.QueryRow(`
+		SELECT type, edit_date, text FROM message_edits WHERE chat_id = ? AND id = ? ORDER BY rowid DESC LIMIT 1`,
+		chat.ID, msgID).Scan(&rev.Type, &rev.EditDate, &text)
+	if err == sql.ErrNoRows {
+		err = s.db.QueryRow(`SELECT type, edit_date, text FROM messages WHERE chat_id = ? AND id = ?`,
+			chat.ID, msgID).Scan(&rev.Type, &rev.EditDate, &text)
+	}
+	if err == sql.ErrNoRows {
+		return rev, false, nil
+	}
+	if err != nil {
+		return rev, false, merry.Wrap(err)
+	}
+	rev.Message = text.String
+	return rev, true, nil
+}
+
+func (s *SQLiteHistorySaver) insertMessageEdits(chat *Chat, rows []sqliteRecordRow, detectedAt int64) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		for _, row := range rows {
+			_, err := tx.Exec(`
+				INSERT INTO message_edits
+				(chat_id, id, detected_at, type, date, from_id, text, media_type, edit_date, topic_id, data)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				chat.ID, row.ID, detectedAt, row.Type, row.Date, row.FromID, row.Text, row.MediaType,
+				row.EditDate, row.TopicID, row.Data)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+		return nil
+	})
+}
+
+// SaveMessageRevisions compares messages with their last saved versions (from messages or edits table)
+// and inserts changed ones to the edits table. Messages that were not saved yet
+// (or were saved as empty placeholders) are ignored.
+// Revisions with pending link previews are added to the pending list (as new messages).
+// Returns the number of inserted revisions.
+func (s *SQLiteHistorySaver) SaveMessageRevisions(chat *Chat, messages []mtproto.TL) (int, error) {
+	var changed []mtproto.TL
+	for _, msgTL := range messages {
+		msg, ok := msgTL.(mtproto.TL_message)
+		if !ok {
+			continue //only regular messages can be edited
+		}
+		prev, found, err := s.lastMessageRevision(chat, msg.ID)
+		if err != nil {
+			return 0, merry.Wrap(err)
+		}
+		if found && !prev.IsPlaceholder() && prev.IsUpdatedBy(&msg) {
+			changed = append(changed, msg)
+		}
+	}
+	if len(changed) == 0 {
+		return 0, nil
+	}
+
+	// edited messages media is not requested (same as in JSON files)
+	now := time.Now().Unix()
+	rows := make([]sqliteRecordRow, 0, len(changed))
+	for _, msg := range changed {
+		msgMap := tgObjToMap(msg)
+		msgMap["_TL_LAYER"] = mtproto.TL_Layer
+		msgMap["_DETECTED_AT"] = now
+		if topicID, ok := tgGetForumMessageTopicID(chat.Obj, msg); ok {
+			msgMap["_TOPIC_ID"] = topicID
+		}
+		row, err := newSQLiteRecordRow(msg, msgMap)
+		if err != nil {
+			return 0, merry.Wrap(err)
+		}
+		rows = append(rows, row)
+	}
+	if err := s.insertMessageEdits(chat, rows, now); err != nil {
+		return 0, merry.Wrap(err)
+	}
+	pending, err := findPendingWebPages(changed, 0)
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+	err = s.inTx(func(tx *sql.Tx) error {
+		return merry.Wrap(s.savePendingWebPages(tx, chat, MessageMediaFile, pending, false))
+	})
+	return len(rows), merry.Wrap(err)
+}
+
+func (s *SQLiteHistorySaver) savePendingWebPages(
+	tx *sql.Tx, chat *Chat, source MediaFileSource, items []PendingWebPageData, resolved bool,
+) error {
+	now := time.Now().Unix()
+	for _, item := range items {
+		var err error
+		if resolved {
+			_, err = tx.Exec(`UPDATE pending_webpages SET resolved_at = ? WHERE chat_id = ? AND source = ? AND id = ?`,
+				now, chat.ID, source, item.ID)
+		} else {
+			_, err = tx.Exec(`
+				INSERT OR REPLACE INTO pending_webpages (chat_id, source, id, post_id, detected_at, resolved_at)
+				VALUES (?, ?, ?, ?, ?, NULL)`, chat.ID, source, item.ID, item.PostID, now)
+		}
+		if err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// GetPendingWebPages returns (sorted by ID) saved messages, comments or stories
+// with webpage previews that were pending during dump.
+func (s *SQLiteHistorySaver) GetPendingWebPages(chat *Chat, source MediaFileSource) ([]PendingWebPageData, error) {
+	rows, err := s.db.Query(`
+		SELECT id, post_id, detected_at FROM pending_webpages
+		WHERE chat_id = ? AND source = ? AND resolved_at IS NULL ORDER BY id`, chat.ID, source)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	defer rows.Close()
+	var items []PendingWebPageData
+	for rows.Next() {
+		var item PendingWebPageData
+		var detectedAt int64
+		if err := rows.Scan(&item.ID, &item.PostID, &detectedAt); err != nil {
+			return nil, merry.Wrap(err)
+		}
+		item.DetectedAt = time.Unix(detectedAt, 0)
+		items = append(items, item)
+	}
+	return items, merry.Wrap(rows.Err())
+}
+
+// SaveResolvedWebPages handles re-fetched messages (or comments, or stories) with previously pending webpage previews
+// (see [JSONFilesHistorySaver.SaveResolvedWebPages]). Messages with ready previews are inserted
+// to the edits table. Returns the number of resolved records.
+func (s *SQLiteHistorySaver) SaveResolvedWebPages(chat *Chat, source MediaFileSource, records []mtproto.TL) (int, error) {
+	resolved, done, err := splitResolvedWebPages(records)
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+
+	if source == MessageMediaFile {
+		now := time.Now().Unix()
+		rows, err := s.makeRecordRows(resolved, chat, MessageMediaFile, tgFindMessageMediaFileInfos,
+			map[string]interface{}{"_DETECTED_AT": now})
+		if err != nil {
+			return 0, merry.Wrap(err)
+		}
+		if err := s.insertMessageEdits(chat, rows, now); err != nil {
+			return 0, merry.Wrap(err)
+		}
+	} else if len(resolved) > 0 {
+		pending, err := s.GetPendingWebPages(chat, source)
+		if err != nil {
+			return 0, merry.Wrap(err)
+		}
+		if err := s.requestResolvedWebPagesMedia(chat, source, resolved, pending); err != nil {
+			return 0, merry.Wrap(err)
+		}
+	}
+	err = s.inTx(func(tx *sql.Tx) error {
+		return merry.Wrap(s.savePendingWebPages(tx, chat, source, done, true))
+	})
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+	return len(resolved), nil
+}
+
+// GetLastCommentIDs returns last saved comment ID for each channel post with saved comments.
+func (s *SQLiteHistorySaver) GetLastCommentIDs(chat *Chat) (map[int32]int32, error) {
+	rows, err := s.db.Query(`SELECT post_id, MAX(id) FROM comments WHERE chat_id = ? GROUP BY post_id`, chat.ID)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	defer rows.Close()
+	lastIDs := make(map[int32]int32)
+	for rows.Next() {
+		var postID, id int32
+		if err := rows.Scan(&postID, &id); err != nil {
+			return nil, merry.Wrap(err)
+		}
+		lastIDs[postID] = id
+	}
+	return lastIDs, merry.Wrap(rows.Err())
+}
+
+// SaveComments inserts comments (from linked discussion group) of the channel post.
+func (s *SQLiteHistorySaver) SaveComments(chat *Chat, postID int32, comments []mtproto.TL) error {
+	rows, err := s.makeRecordRows(comments, chat, CommentMediaFile, tgFindMessageMediaFileInfos,
+		map[string]interface{}{"_POST_ID": postID})
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	pending, err := findPendingWebPages(comments, postID)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		for _, row := range rows {
+			_, err := tx.Exec(`
+				INSERT OR IGNORE INTO comments
+				(chat_id, post_id, id, type, date, from_id, text, media_type, data)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				chat.ID, postID, row.ID, row.Type, row.Date, row.FromID, row.Text, row.MediaType, row.Data)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+		return merry.Wrap(s.savePendingWebPages(tx, chat, CommentMediaFile, pending, false))
+	})
+}
+
+// SaveForumTopics replaces forum topics list of the chat.
+func (s *SQLiteHistorySaver) SaveForumTopics(chat *Chat, topics []mtproto.TL) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM forum_topics WHERE chat_id = ?`, chat.ID); err != nil {
+			return merry.Wrap(err)
+		}
+		for _, topic := range topics {
+			topicMap := tgObjToMap(topic)
+			topicMap["_TL_LAYER"] = mtproto.TL_Layer
+			buf, err := json.Marshal(topicMap)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			var title *string
+			if t, ok := topicMap["Title"].(string); ok {
+				title = &t
+			}
+			_, err = tx.Exec(`INSERT OR REPLACE INTO forum_topics (chat_id, id, title, data) VALUES (?, ?, ?, ?)`,
+				chat.ID, topicMap["ID"], title, string(buf))
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteHistorySaver) SaveStories(chat *Chat, stories []mtproto.TL) error {
+	rows, err := s.makeRecordRows(stories, chat, StoryMediaFile, tgFindStoryMediaFileInfos, nil)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	pending, err := findPendingWebPages(stories, 0)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		for _, row := range rows {
+			_, err := tx.Exec(`
+				INSERT OR IGNORE INTO stories (chat_id, id, type, date, text, media_type, data)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				chat.ID, row.ID, row.Type, row.Date, row.Text, row.MediaType, row.Data)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+		return merry.Wrap(s.savePendingWebPages(tx, chat, StoryMediaFile, pending, false))
+	})
+}
+
+// readSavedRelated loads all saved users or chats (called once, they are cached in memory).
+func readSavedRelated[T UserData | ChatData](db *sql.DB, table string, getID func(*T) int64) (map[int64]*T, error) {
+	rows, err := db.Query(`SELECT data FROM ` + table)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	defer rows.Close()
+	items := make(map[int64]*T)
+	for rows.Next() {
+		var buf []byte
+		if err := rows.Scan(&buf); err != nil {
+			return nil, merry.Wrap(err)
+		}
+		item := new(T)
+		if err := json.Unmarshal(buf, item); err != nil {
+			return nil, merry.Wrap(err)
+		}
+		items[getID(item)] = item
+	}
+	return items, merry.Wrap(rows.Err())
+}
+
+func (s *SQLiteHistorySaver) SaveRelatedUsers(users []mtproto.TL) error {
+	s.relatedMutex.Lock()
+	defer s.relatedMutex.Unlock()
+
+	if s.savedUsers == nil {
+		var err error
+		s.savedUsers, err = readSavedRelated(s.db, "users", func(u *UserData) int64 { return u.ID })
+		if err != nil {
+			return merry.Wrap(err)
+		}
+	}
+
+	var newUsers []*UserData
+	for _, userTL := range users {
+		tgUser, ok := userTL.(mtproto.TL_user)
+		if !ok {
+			return merry.Errorf(mtproto.UnexpectedTL("user", userTL))
+		}
+		user, exists := s.savedUsers[tgUser.ID]
+		if !exists || user.IsUpdatedBy(&tgUser) {
+			newUsers = append(newUsers, NewUserDataFromTG(tgUser))
+		}
+	}
+	if len(newUsers) == 0 {
+		return nil
+	}
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		for _, user := range newUsers {
+			buf, err := json.Marshal(user)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			_, err = tx.Exec(`
+				INSERT OR REPLACE INTO users
+				(id, username, first_name, last_name, phone, is_bot, is_deleted, updated_at, data)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				user.ID, user.Username, user.FirstName, user.LastName, user.PhoneNumber,
+				user.IsBot, user.IsDeleted, user.UpdatedAt.Unix(), string(buf))
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	for _, user := range newUsers {
+		s.savedUsers[user.ID] = user
+	}
+	return nil
+}
+
+func (s *SQLiteHistorySaver) SaveRelatedChats(chats []mtproto.TL) error {
+	return merry.Wrap(s.saveRelatedChats(chats, nil))
+}
+
+// SaveChatFullInfo saves chat with its full info (if something has changed).
+func (s *SQLiteHistorySaver) SaveChatFullInfo(chatTL mtproto.TL, full *ChatFullData) error {
+	return merry.Wrap(s.saveRelatedChats([]mtproto.TL{chatTL}, full))
+}
+
+func (s *SQLiteHistorySaver) saveRelatedChats(chats []mtproto.TL, full *ChatFullData) error {
+	s.relatedMutex.Lock()
+	defer s.relatedMutex.Unlock()
+
+	if s.savedChats == nil {
+		var err error
+		s.savedChats, err = readSavedRelated(s.db, "chats", func(c *ChatData) int64 { return c.ID })
+		if err != nil {
+			return merry.Wrap(err)
+		}
+	}
+
+	var newChats []*ChatData
+	for _, chatTL := range chats {
+		var newChat *ChatData
+		chatIsMin := false
+		switch c := chatTL.(type) {
+		case mtproto.TL_chat:
+			newChat = &ChatData{ID: c.ID, Title: c.Title, PhotoID: peerPhotoIDFromTG(c.Photo)}
+		case mtproto.TL_chatForbidden:
+			newChat = &ChatData{ID: c.ID, Title: c.Title}
+		case mtproto.TL_channel:
+			chatIsMin = c.Min
+			newChat = &ChatData{ID: c.ID, Title: c.Title, Username: c.Username, IsChannel: !c.Megagroup, PhotoID: peerPhotoIDFromTG(c.Photo)}
+		case mtproto.TL_channelForbidden:
+			newChat = &ChatData{ID: c.ID, Title: c.Title, IsChannel: !c.Megagroup}
+		default:
+			return merry.Wrap(mtproto.WrongRespError(chatTL))
+		}
+
+		chat, exists := s.savedChats[newChat.ID]
+		if full != nil {
+			newChat.Full = full
+		} else if exists {
+			newChat.Full = chat.Full //regular chat objects have no full info, keeping the saved one
+		}
+		if !exists || chat.IsUpdatedBy(newChat, chatIsMin) {
+			newChat.UpdatedAt = time.Now()
+			newChats = append(newChats, newChat)
+		}
+	}
+	if len(newChats) == 0 {
+		return nil
+	}
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		for _, chat := range newChats {
+			buf, err := json.Marshal(chat)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			_, err = tx.Exec(`
+				INSERT OR REPLACE INTO chats (id, username, title, is_channel, updated_at, data)
+				VALUES (?, ?, ?, ?, ?, ?)`,
+				chat.ID, chat.Username, chat.Title, chat.IsChannel, chat.UpdatedAt.Unix(), string(buf))
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	for _, chat := range newChats {
+		s.savedChats[chat.ID] = chat
+	}
+	return nil
+}
+
+// SaveContacts replaces saved contacts (users).
+func (s *SQLiteHistorySaver) SaveContacts(contacts []mtproto.TL) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM contacts`); err != nil {
+			return merry.Wrap(err)
+		}
+		for _, contactTL := range contacts {
+			user, ok := contactTL.(mtproto.TL_user)
+			if !ok {
+				return merry.Errorf(mtproto.UnexpectedTL("user", contactTL))
+			}
+			contactMap := tgObjToMap(user)
+			contactMap["_TL_LAYER"] = mtproto.TL_Layer
+			buf, err := json.Marshal(contactMap)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			_, err = tx.Exec(`INSERT OR REPLACE INTO contacts (user_id, data) VALUES (?, ?)`, user.ID, string(buf))
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+		return nil
+	})
+}
+
+// SaveAuths replaces saved active sessions.
+func (s *SQLiteHistorySaver) SaveAuths(auths []mtproto.TL_authorization) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM auths`); err != nil {
+			return merry.Wrap(err)
+		}
+		for _, auth := range auths {
+			authMap := tgObjToMap(auth)
+			authMap["_TL_LAYER"] = mtproto.TL_Layer
+			buf, err := json.Marshal(authMap)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			_, err = tx.Exec(`INSERT OR REPLACE INTO auths (hash, data) VALUES (?, ?)`, auth.Hash, string(buf))
+			if err != nil {
+				return merry.Wrap(err)
+			}
+		}
+		return nil
+	})
+}
+
+// openSQLiteHistorySaver is used by makeHistorySaver
+// (SQLite support is optional since the driver requires cgo, see sqlite_disabled.go).
+func openSQLiteHistorySaver(files *JSONFilesHistorySaver) (HistorySaver, func() error, error) {
+	saver, err := NewSQLiteHistorySaver(files)
+	if err != nil {
+		return nil, nil, merry.Wrap(err)
+	}
+	return saver, saver.Close, nil
+}
@@ -0,0 +1,10 @@
+//go:build !sqlite
+
+package main
+
+import "github.com/ansel1/merry/v2"
+
+// SQLite driver requires cgo, so SQLite storage is available only in builds with `-tags sqlite`.
+func openSQLiteHistorySaver(files *JSONFilesHistorySaver) (HistorySaver, func() error, error) {
+	return nil, nil, merry.New("SQLite storage is not available in this build, rebuild with `-tags sqlite` (requires cgo)")
+}
@@ -0,0 +1,145 @@
+//go:build sqlite
+
+package main
+
+import (
+	"testing"
+
+	"github.com/3bl3gamer/tgclient/mtproto"
+)
+
+func TestSQLiteHistorySaver(t *testing.T) {
+	files := NewJSONFilesHistorySaver(t.TempDir())
+	saver, err := NewSQLiteHistorySaver(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saver.Close()
+	chat := &Chat{ID: 123, Title: "Chat"}
+
+	var requestedFiles []int32
+	saver.SetFileRequestCallback(func(chat *Chat, file *TGFileInfo, msgID int32, mediaSource MediaFileSource, postID int32) error {
+		requestedFiles = append(requestedFiles, msgID)
+		return nil
+	})
+
+	lastID, err := saver.GetLastMessageID(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, lastID, int32(0))
+
+	photo := mtproto.TL_messageMediaPhoto{Photo: mtproto.TL_photo{ID: 1, DCID: 2, Sizes: []mtproto.TL{
+		mtproto.TL_photoSize{Type: "x", W: 10, H: 10, Size: 100},
+	}}}
+	if err := saver.SaveMessages(chat, []mtproto.TL{
+		mtproto.TL_message{ID: 10, Date: 1700000010, Message: "with photo", Media: photo},
+		mtproto.TL_message{ID: 6, Date: 1700000006, Message: "six", FromID: mtproto.TL_peerUser{UserID: 42}},
+		mtproto.TL_messageService{ID: 5, Date: 1700000005},
+		mtproto.TL_messageEmpty{ID: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, requestedFiles, []int32{10})
+
+	lastID, err = saver.GetLastMessageID(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, lastID, int32(10))
+
+	var text, mediaType string
+	var fromID int64
+	row := saver.db.QueryRow(`SELECT text, media_type FROM messages WHERE chat_id = 123 AND id = 10`)
+	if err := row.Scan(&text, &mediaType); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, text, "with photo")
+	assertEqual(t, mediaType, "TL_messageMediaPhoto")
+	if err := saver.db.QueryRow(`SELECT from_id FROM messages WHERE chat_id = 123 AND id = 6`).Scan(&fromID); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, fromID, int64(42))
+
+	// older and gap messages are saved right away
+	if err := saver.SaveOlderMessages(chat, []mtproto.TL{mtproto.TL_message{ID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saver.SaveGapMessages(chat, []mtproto.TL{mtproto.TL_message{ID: 8}, mtproto.TL_message{ID: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	oldestID, count, err := saver.GetOldestMessageID(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, oldestID, int32(1))
+	assertEqual(t, count, 6)
+	gaps, err := saver.FindMessageIDsGaps(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, gaps, []MessageIDsGap{{AfterID: 3, BeforeID: 5}, {AfterID: 6, BeforeID: 8}, {AfterID: 8, BeforeID: 10}})
+
+	if err := saver.SaveDeletedMessages(chat, []int32{3}); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := saver.GetSavedMessageIDs(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, ids, []int32{1, 5, 6, 8, 10})
+
+	editDate := int32(1700000100)
+	for _, expectedCount := range []int{1, 0} {
+		count, err := saver.SaveMessageRevisions(chat, []mtproto.TL{
+			mtproto.TL_message{ID: 6, Message: "six (edited)", EditDate: &editDate},
+			mtproto.TL_message{ID: 7, Message: "not saved yet"},
+			mtproto.TL_message{ID: 2, Message: "saved as placeholder"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, count, expectedCount)
+	}
+
+	// related users are saved only if changed
+	name := "User"
+	for i := 0; i < 2; i++ {
+		if err := saver.SaveRelatedUsers([]mtproto.TL{mtproto.TL_user{ID: 42, FirstName: &name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var firstName string
+	if err := saver.db.QueryRow(`SELECT first_name FROM users WHERE id = 42`).Scan(&firstName); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, firstName, "User")
+}
+
+func TestSQLiteHistorySaver__ExistingJSONDump(t *testing.T) {
+	files := NewJSONFilesHistorySaver(t.TempDir())
+	if err := files.SaveMessages(&Chat{ID: 123, Title: "Chat"}, []mtproto.TL{mtproto.TL_message{ID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSQLiteHistorySaver(files); err == nil {
+		t.Fatal("expected error for directory with JSON dump")
+	}
+
+	// existing database is opened as usual
+	files = NewJSONFilesHistorySaver(t.TempDir())
+	saver, err := NewSQLiteHistorySaver(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saver.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.SaveMessages(&Chat{ID: 123, Title: "Chat"}, []mtproto.TL{mtproto.TL_message{ID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	saver, err = NewSQLiteHistorySaver(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saver.Close()
+}
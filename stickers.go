@@ -0,0 +1,190 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/3bl3gamer/tgclient"
+	"github.com/3bl3gamer/tgclient/mtproto"
+	"github.com/ansel1/merry/v2"
+)
+
+// StickersCollector remembers sticker sets and custom emoji used in saved messages of chats matched
+// by config.sticker_sets. Each set is saved once (sets are shared by all chats) after chats are dumped.
+type StickersCollector struct {
+	saver  *JSONFilesHistorySaver
+	config *Config
+	mutex  *sync.Mutex
+	// sets and emoji that are already saved or pending
+	knownSets  map[int64]bool
+	knownEmoji map[int64]bool
+}
+
+func NewStickersCollector(saver *JSONFilesHistorySaver, config *Config) (*StickersCollector, error) {
+	c := &StickersCollector{
+		saver:      saver,
+		config:     config,
+		mutex:      &sync.Mutex{},
+		knownSets:  make(map[int64]bool),
+		knownEmoji: make(map[int64]bool),
+	}
+	savedSets, err := saver.ReadSavedStickerSets()
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	for setID, docIDs := range savedSets {
+		c.knownSets[setID] = true
+		for _, docID := range docIDs {
+			c.knownEmoji[docID] = true
+		}
+	}
+	pending, err := saver.ReadPendingStickerRefs()
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	for _, ref := range pending {
+		if ref.EmojiID != 0 {
+			c.knownEmoji[ref.EmojiID] = true
+		} else {
+			c.knownSets[ref.SetID] = true
+		}
+	}
+	return c, nil
+}
+
+// Collect is called by saver for each saved message.
+func (c *StickersCollector) Collect(chat *Chat, msg mtproto.TL) error {
+	if c.config.StickerSets.Match(chat, nil) != MatchTrue {
+		return nil
+	}
+	sets, emojiIDs := tgFindMessageStickerRefs(msg)
+	if len(sets) == 0 && len(emojiIDs) == 0 {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var refs []StickerRefData
+	for _, set := range sets {
+		if !c.knownSets[set.ID] {
+			c.knownSets[set.ID] = true
+			refs = append(refs, StickerRefData{SetID: set.ID, AccessHash: set.AccessHash})
+		}
+	}
+	for _, emojiID := range emojiIDs {
+		if !c.knownEmoji[emojiID] {
+			c.knownEmoji[emojiID] = true
+			refs = append(refs, StickerRefData{EmojiID: emojiID})
+		}
+	}
+	return merry.Wrap(c.saver.AppendPendingStickerRefs(refs))
+}
+
+// SavePending loads and saves all collected sticker sets (custom emoji are saved as parts of their sets).
+func (c *StickersCollector) SavePending(tg *tgclient.TGClient) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	refs, err := c.saver.ReadPendingStickerRefs()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	savedSets, err := c.saver.ReadSavedStickerSets()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+
+	var sets []mtproto.TL_inputStickerSetID
+	var emojiIDs []int64
+	for _, ref := range refs {
+		if ref.EmojiID != 0 {
+			emojiIDs = append(emojiIDs, ref.EmojiID)
+		} else if _, ok := savedSets[ref.SetID]; !ok {
+			sets = append(sets, mtproto.TL_inputStickerSetID{ID: ref.SetID, AccessHash: ref.AccessHash})
+		}
+	}
+
+	// custom emoji documents contain references to their sets
+	for i := 0; i < len(emojiIDs); i += 100 {
+		if err := checkInterrupted(); err != nil {
+			return merry.Wrap(err)
+		}
+		chunk := emojiIDs[i:min(i+100, len(emojiIDs))]
+		tgLimiterFor(tg).Wait()
+		docs, err := tgLoadCustomEmojiDocuments(tg, chunk)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		for _, doc := range docs {
+			if set, ok := tgFindDocumentStickerSet(doc); ok {
+				if _, ok := savedSets[set.ID]; !ok {
+					sets = append(sets, set)
+				}
+			}
+		}
+	}
+
+	seenSetIDs := make(map[int64]bool)
+	for _, set := range sets {
+		if seenSetIDs[set.ID] {
+			continue
+		}
+		seenSetIDs[set.ID] = true
+		if err := checkInterrupted(); err != nil {
+			return merry.Wrap(err)
+		}
+		if err := c.saveSet(tg, set); err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	return merry.Wrap(c.saver.RemovePendingStickerRefs())
+}
+
+func (c *StickersCollector) saveSet(tg *tgclient.TGClient, inputSet mtproto.TL_inputStickerSetID) error {
+	tgLimiterFor(tg).Wait()
+	set, err := tgLoadStickerSet(tg, inputSet)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if set == nil {
+		log.Warn("sticker set #%d does not exist anymore, skipping", inputSet.ID)
+		return nil
+	}
+
+	log.Info("saving sticker set %s (%s), %d sticker(s)", set.Set.Title, set.Set.ShortName, len(set.Documents))
+	for _, docTL := range set.Documents {
+		doc, ok := docTL.(mtproto.TL_document)
+		if !ok {
+			continue
+		}
+		file := tgFindStickerFileInfo(doc)
+		fpath, err := c.saver.StickerFPath(set.Set, file.FName)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		if _, err := os.Stat(fpath); err == nil {
+			continue //already downloaded (previous attempt was interrupted)
+		} else if !os.IsNotExist(err) {
+			return merry.Wrap(err)
+		}
+		tgLimiterFor(tg).WaitPause()
+		_, err = tg.DownloadFileToPath(fpath, file.InputLocation, file.DCID, file.Size, NewFileProgressLogger())
+		if isBrokenFileError(err) {
+			log.Error(nil, "in sticker set %s: wrong file: %s", set.Set.ShortName, fpath)
+			continue
+		}
+		if err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	for _, docTL := range set.Documents {
+		if doc, ok := docTL.(mtproto.TL_document); ok {
+			c.knownEmoji[doc.ID] = true
+		}
+	}
+	c.knownSets[set.Set.ID] = true
+	return merry.Wrap(c.saver.SaveStickerSet(set))
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"os"
 	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/3bl3gamer/tgclient"
@@ -17,17 +20,6 @@ import (
 
 type FileInfosExtractorFunc = func(item mtproto.TL) ([]TGFileInfo, error)
 
-var skipPendingWebpagePhotos bool = false
-
-const skipPendingWebpagePhotosHelp = "Sometimes there are preview images for links in chats.\n" +
-	"Sometimes (rarely) these previews have status 'pending'.\n" +
-	"This status means that preview will be ready soon.\n" +
-	"But the dumper can not (yet) re-fetch same messages again.\n" +
-	"So, as a temporary workaround, the dumper will abort with error\n" +
-	"and expect you or outer script to restart with a short delay.\n" +
-	"But, if you prefer to skip some link previews (instead of aborting with error),\n" +
-	"add -skip-pending-webpage-photos flag."
-
 const videoCoverFileSuffix = "video_cover.jpg"
 
 type ChatType int8
@@ -76,9 +68,166 @@ type Chat struct {
 	LastMessageID int32
 	Type          ChatType
 	Obj           mtproto.TL
+	TopicID       *int32 //set only when matching messages of a specific forum topic
+	Folders       []string
+	Archived      bool
+}
+
+// WithTopic returns chat copy for matching messages of the forum topic.
+func (c *Chat) WithTopic(topicID int32) *Chat {
+	topicChat := *c
+	topicChat.TopicID = &topicID
+	return &topicChat
+}
+
+// RequestLimiter is shared by all chat workers of an account: it spaces out chunk requests
+// and pauses every worker when some request gets FLOOD_WAIT.
+type RequestLimiter struct {
+	mutex       *sync.Mutex
+	interval    time.Duration
+	nextSlotAt  time.Time
+	pausedUntil time.Time
+}
+
+func NewRequestLimiter(interval time.Duration) *RequestLimiter {
+	return &RequestLimiter{mutex: &sync.Mutex{}, interval: interval}
+}
+
+// Wait blocks until the next request slot (at least `interval` after the previous one)
+// and until flood-wait pause (if any) is over.
+func (l *RequestLimiter) Wait() {
+	l.mutex.Lock()
+	slotAt := time.Now()
+	if l.nextSlotAt.After(slotAt) {
+		slotAt = l.nextSlotAt
+	}
+	l.nextSlotAt = slotAt.Add(l.interval)
+	l.mutex.Unlock()
+
+	time.Sleep(time.Until(slotAt))
+	l.WaitPause()
+}
+
+// WaitPause blocks until flood-wait pause (if any) is over.
+func (l *RequestLimiter) WaitPause() {
+	for {
+		l.mutex.Lock()
+		pausedUntil := l.pausedUntil
+		l.mutex.Unlock()
+
+		delay := time.Until(pausedUntil)
+		if delay <= 0 {
+			return
+		}
+		time.Sleep(delay)
+	}
+}
+
+func (l *RequestLimiter) Pause(duration time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if until := time.Now().Add(duration); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// Each account (TGClient) has its own limiter: request intervals and flood-waits are per account.
+var tgLimiters = make(map[*tgclient.TGClient]*RequestLimiter)
+var tgLimitersMutex = &sync.Mutex{}
+
+func tgSetLimiter(tg *tgclient.TGClient, limiter *RequestLimiter) {
+	tgLimitersMutex.Lock()
+	defer tgLimitersMutex.Unlock()
+	tgLimiters[tg] = limiter
+}
+
+// tgRemoveLimiter forgets limiter of the client that is not used anymore.
+func tgRemoveLimiter(tg *tgclient.TGClient) {
+	tgLimitersMutex.Lock()
+	defer tgLimitersMutex.Unlock()
+	delete(tgLimiters, tg)
+}
+
+func tgLimiterFor(tg *tgclient.TGClient) *RequestLimiter {
+	tgLimitersMutex.Lock()
+	defer tgLimitersMutex.Unlock()
+	limiter, ok := tgLimiters[tg]
+	if !ok {
+		limiter = NewRequestLimiter(0)
+		tgLimiters[tg] = limiter
+	}
+	return limiter
+}
+
+// Same as TGClient.SendSyncRetry but FLOOD_WAIT (if it is not longer than floodMaxWait)
+// pauses all requests made via account limiter, not only the current one.
+func tgSendSyncRetry(tg *tgclient.TGClient, msg mtproto.TLReq, floodMaxWait time.Duration) mtproto.TL {
+	for {
+		tgLimiterFor(tg).WaitPause()
+		res := tg.SendSyncRetry(msg, time.Second, 0, 0) //returns any flood error as is
+		floodWait, ok := mtproto.IsFloodError(res)
+		if !ok || floodWait > floodMaxWait {
+			return res
+		}
+		log.Warn("got flood-wait, pausing all requests for %s", floodWait)
+		tgLimiterFor(tg).Pause(floodWait)
+	}
+}
+
+var tgAuthMutex = &sync.Mutex{}
+
+// reconnectionDialer reports reconnections of the main client connection (the first one dialed):
+// TGClient reconnects by closing its connection and dialing the same address again.
+// Connections to file DCs made by downloader also pass through it, but are not reported.
+type reconnectionDialer struct {
+	proxy.Dialer
+	onReconnected func()
+	mutex         sync.Mutex
+	mainConn      net.Conn
+	mainAddr      string
+	mainClosed    bool
+}
+
+type reconnectionDialerConn struct {
+	net.Conn
+	dialer *reconnectionDialer
+}
+
+func (c *reconnectionDialerConn) Close() error {
+	c.dialer.mutex.Lock()
+	if c.dialer.mainConn == c {
+		c.dialer.mainClosed = true
+	}
+	c.dialer.mutex.Unlock()
+	return c.Conn.Close()
+}
+
+func (d *reconnectionDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := &reconnectionDialerConn{Conn: conn, dialer: d}
+
+	d.mutex.Lock()
+	isFirst := d.mainConn == nil
+	isReconnection := d.mainClosed && addr == d.mainAddr
+	if isFirst || isReconnection {
+		d.mainConn = wrapped
+		d.mainAddr = addr
+		d.mainClosed = false
+	}
+	d.mutex.Unlock()
+
+	if isReconnection && d.onReconnected != nil {
+		d.onReconnected()
+	}
+	return wrapped, nil
 }
 
-func tgConnect(config *Config, logHandler *LogHandler) (*tgclient.TGClient, *mtproto.TL_user, error) {
+// tgConnect connects and authorizes the client.
+// `onReconnected` (if not nil) is called each time the client reconnects after a connection loss.
+func tgConnect(config *Config, logHandler *LogHandler, onReconnected func()) (*tgclient.TGClient, *mtproto.TL_user, error) {
 	cfg := &mtproto.AppConfig{
 		AppID:          config.AppID,
 		AppHash:        config.AppHash,
@@ -90,7 +239,10 @@ func tgConnect(config *Config, logHandler *LogHandler) (*tgclient.TGClient, *mtp
 		LangCode:       "en",
 	}
 
-	sessStore := &mtproto.SessFileStore{FPath: config.SessionFilePath}
+	sessStore, err := tgMakeSessionStore(config)
+	if err != nil {
+		return nil, nil, merry.Wrap(err)
+	}
 
 	var dialer proxy.Dialer
 	if config.Socks5ProxyAddr != "" {
@@ -108,13 +260,50 @@ func tgConnect(config *Config, logHandler *LogHandler) (*tgclient.TGClient, *mtp
 		}
 	}
 
-	tg := tgclient.NewTGClientExt(cfg, sessStore, logHandler, dialer)
+	baseDialer := dialer
+	if baseDialer == nil {
+		baseDialer = proxy.Direct
+	}
+	tg := tgclient.NewTGClientExt(cfg, sessStore, logHandler,
+		&reconnectionDialer{Dialer: baseDialer, onReconnected: onReconnected})
 
 	if err := tg.InitAndConnect(); err != nil {
 		return nil, nil, merry.Wrap(err)
 	}
 
-	res, err := tg.AuthExt(mtproto.ScanfAuthDataProvider{}, mtproto.TL_users_getUsers{ID: []mtproto.TL{mtproto.TL_inputUserSelf{}}})
+	authData, err := tgMakeAuthDataProvider(config)
+	if err != nil {
+		return nil, nil, merry.Wrap(err)
+	}
+
+	// accounts may be connecting simultaneously, but their auth prompts (if any) must not mix
+	tgAuthMutex.Lock()
+	if config.LoginMethod == LoginQR {
+		// unauthorized session is replaced with a new one connected to account DC
+		reconnect := func(dcID int32, addr string) (*tgclient.TGClient, error) {
+			if err := tg.Disconnect(); err != nil {
+				return nil, merry.Wrap(err)
+			}
+			tgRemoveLimiter(tg)
+			if err := os.Remove(config.SessionFilePath); err != nil && !os.IsNotExist(err) {
+				return nil, merry.Wrap(err)
+			}
+			newTG := tgclient.NewTGClientExt(cfg,
+				migrationSessionStore{SessionStore: sessStore, addr: addr},
+				logHandler, &reconnectionDialer{
+					Dialer:        migrationDialer{Dialer: baseDialer, addr: addr},
+					onReconnected: onReconnected,
+				})
+			return newTG, merry.Wrap(newTG.InitAndConnect())
+		}
+		tg, err = tgLoginQR(tg, config, reconnect)
+		if err != nil {
+			tgAuthMutex.Unlock()
+			return nil, nil, merry.Wrap(err)
+		}
+	}
+	res, err := tg.AuthExt(authData, mtproto.TL_users_getUsers{ID: []mtproto.TL{mtproto.TL_inputUserSelf{}}})
+	tgAuthMutex.Unlock()
 	if err != nil {
 		return nil, nil, merry.Wrap(err)
 	}
@@ -167,7 +356,16 @@ func tgGetStoryID(storyTL mtproto.TL) (int32, error) {
 	}
 }
 
-func tgExtractDialogsData(dialogs []mtproto.TL, chats []mtproto.TL, users []mtproto.TL) ([]*Chat, error) {
+func tgGetMessageOrStoryID(recordTL mtproto.TL) (int32, error) {
+	switch recordTL.(type) {
+	case mtproto.TL_storyItemDeleted, mtproto.TL_storyItemSkipped, mtproto.TL_storyItem:
+		return tgGetStoryID(recordTL)
+	default:
+		return tgGetMessageID(recordTL)
+	}
+}
+
+func tgExtractDialogsData(dialogs []mtproto.TL, chats []mtproto.TL, users []mtproto.TL, folders []mtproto.TL) ([]*Chat, error) {
 	chatsByID := make(map[int64]mtproto.TL_chat)
 	channelsByID := make(map[int64]mtproto.TL_channel)
 	for _, chatTL := range chats {
@@ -202,9 +400,105 @@ func tgExtractDialogsData(dialogs []mtproto.TL, chats []mtproto.TL, users []mtpr
 		default:
 			return nil, merry.Wrap(mtproto.WrongRespError(dialog.Peer))
 		}
+		chat := extractedChats[i]
+		chat.Archived = mtproto.DerefOr(dialog.FolderID, 0) == tgArchiveFolderID
+		for _, folderTL := range folders {
+			if title, ok := tgDialogInFolder(folderTL, dialog, chat.Obj); ok {
+				chat.Folders = append(chat.Folders, title)
+			}
+		}
 	}
 	return extractedChats, nil
 }
+
+// Peer folder of archived chats (https://core.telegram.org/api/folders#peer-folders).
+const tgArchiveFolderID = 1
+
+// Loads chat folders (https://core.telegram.org/api/folders#dialog-filters), the default "All chats" one is skipped.
+func tgLoadDialogFilters(tg *tgclient.TGClient) ([]mtproto.TL, error) {
+	res := tgSendSyncRetry(tg, mtproto.TL_messages_getDialogFilters{}, 30*time.Second)
+	filters, ok := res.(mtproto.TL_messages_dialogFilters)
+	if !ok {
+		return nil, merry.Wrap(mtproto.WrongRespError(res))
+	}
+	var folders []mtproto.TL
+	for _, filterTL := range filters.Filters {
+		if _, ok := filterTL.(mtproto.TL_dialogFilterDefault); !ok {
+			folders = append(folders, filterTL)
+		}
+	}
+	return folders, nil
+}
+
+func tgInputPeerIs(inputPeerTL mtproto.TL, peerTL mtproto.TL) bool {
+	switch inputPeer := inputPeerTL.(type) {
+	case mtproto.TL_inputPeerSelf:
+		user, ok := peerTL.(mtproto.TL_user)
+		return ok && user.Self
+	case mtproto.TL_inputPeerUser:
+		user, ok := peerTL.(mtproto.TL_user)
+		return ok && user.ID == inputPeer.UserID
+	case mtproto.TL_inputPeerChat:
+		chat, ok := peerTL.(mtproto.TL_chat)
+		return ok && chat.ID == inputPeer.ChatID
+	case mtproto.TL_inputPeerChannel:
+		channel, ok := peerTL.(mtproto.TL_channel)
+		return ok && channel.ID == inputPeer.ChannelID
+	}
+	return false
+}
+
+// Checks whether the dialog is in the chat folder, returns folder title.
+// Folder contains explicitly included chats and (for regular folders) chats of included types,
+// except explicitly excluded ones and the ones filtered out by muted/read/archived flags.
+func tgDialogInFolder(folderTL mtproto.TL, dialog mtproto.TL_dialog, peerTL mtproto.TL) (string, bool) {
+	inPeers := func(peers []mtproto.TL) bool {
+		for _, inputPeer := range peers {
+			if tgInputPeerIs(inputPeer, peerTL) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch folder := folderTL.(type) {
+	case mtproto.TL_dialogFilterChatlist:
+		return folder.Title.Text, inPeers(folder.PinnedPeers) || inPeers(folder.IncludePeers)
+	case mtproto.TL_dialogFilter:
+		if inPeers(folder.PinnedPeers) || inPeers(folder.IncludePeers) {
+			return folder.Title.Text, true
+		}
+		if inPeers(folder.ExcludePeers) {
+			return folder.Title.Text, false
+		}
+		typeMatches := false
+		switch peer := peerTL.(type) {
+		case mtproto.TL_user:
+			typeMatches = (peer.Bot && folder.Bots) ||
+				(!peer.Bot && peer.Contact && folder.Contacts) ||
+				(!peer.Bot && !peer.Contact && folder.NonContacts)
+		case mtproto.TL_chat:
+			typeMatches = folder.Groups
+		case mtproto.TL_channel:
+			typeMatches = (peer.Megagroup && folder.Groups) || (!peer.Megagroup && folder.Broadcasts)
+		}
+		if !typeMatches {
+			return folder.Title.Text, false
+		}
+		if folder.ExcludeMuted && mtproto.DerefOr(dialog.NotifySettings.MuteUntil, 0) > int32(time.Now().Unix()) {
+			return folder.Title.Text, false
+		}
+		if folder.ExcludeRead && dialog.UnreadCount == 0 && !dialog.UnreadMark {
+			return folder.Title.Text, false
+		}
+		if folder.ExcludeArchived && mtproto.DerefOr(dialog.FolderID, 0) == tgArchiveFolderID {
+			return folder.Title.Text, false
+		}
+		return folder.Title.Text, true
+	}
+	return "", false
+}
+
 func tgExtractUserData(user mtproto.TL_user, lastMessageID int32) *Chat {
 	return &Chat{
 		ID:            user.ID,
@@ -240,6 +534,11 @@ func tgExtractChannelData(channel mtproto.TL_channel, lastMessageID int32) *Chat
 }
 
 func tgLoadChats(tg *tgclient.TGClient) ([]*Chat, error) {
+	folders, err := tgLoadDialogFilters(tg)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
 	chats := make([]*Chat, 0)
 	// For deduplication. Chat duplicated may be encountered not only on second and subsequent iterations,
 	// but also when user has pinned chats: these chats will be send in the beginning of the first chunk (i.e. on "top")
@@ -261,12 +560,12 @@ func tgLoadChats(tg *tgclient.TGClient) ([]*Chat, error) {
 	offsetPeer := mtproto.TL(mtproto.TL_inputPeerEmpty{})
 
 	for {
-		resTL := tg.SendSyncRetry(mtproto.TL_messages_getDialogs{
+		resTL := tgSendSyncRetry(tg, mtproto.TL_messages_getDialogs{
 			OffsetDate: offsetMessageDate,
 			OffsetID:   offsetMessageID,
 			OffsetPeer: offsetPeer,
 			Limit:      minChatsPerSlice,
-		}, time.Second, 0, 30*time.Second)
+		}, 30*time.Second)
 
 		var res mtproto.TL_messages_dialogs
 		switch d := resTL.(type) {
@@ -284,7 +583,7 @@ func tgLoadChats(tg *tgclient.TGClient) ([]*Chat, error) {
 				len(res.Dialogs), s.Count, len(res.Messages), iteration)
 		}
 
-		slice, err := tgExtractDialogsData(res.Dialogs, res.Chats, res.Users)
+		slice, err := tgExtractDialogsData(res.Dialogs, res.Chats, res.Users, folders)
 		if err != nil {
 			return nil, merry.Wrap(err)
 		}
@@ -399,7 +698,7 @@ func tgFindMessageByChat(messages []mtproto.TL, chatTL mtproto.TL) (mtproto.TL,
 }
 
 func tgLoadContacts(tg *tgclient.TGClient) (*mtproto.TL_contacts_contacts, error) {
-	res := tg.SendSyncRetry(mtproto.TL_contacts_getContacts{}, time.Second, 0, 30*time.Second)
+	res := tgSendSyncRetry(tg, mtproto.TL_contacts_getContacts{}, 30*time.Second)
 
 	contacts, ok := res.(mtproto.TL_contacts_contacts)
 	if !ok {
@@ -409,7 +708,7 @@ func tgLoadContacts(tg *tgclient.TGClient) (*mtproto.TL_contacts_contacts, error
 }
 
 func tgLogout(tg *tgclient.TGClient) error {
-	res := tg.SendSyncRetry(mtproto.TL_auth_logOut{}, time.Second, 0, 30*time.Second)
+	res := tgSendSyncRetry(tg, mtproto.TL_auth_logOut{}, 30*time.Second)
 	if _, ok := res.(mtproto.TL_auth_loggedOut); !ok {
 		return merry.New(mtproto.UnexpectedTL("logout", res))
 	}
@@ -417,7 +716,7 @@ func tgLogout(tg *tgclient.TGClient) error {
 }
 
 func tgLoadAuths(tg *tgclient.TGClient) ([]mtproto.TL_authorization, error) {
-	res := tg.SendSyncRetry(mtproto.TL_account_getAuthorizations{}, time.Second, 0, 30*time.Second)
+	res := tgSendSyncRetry(tg, mtproto.TL_account_getAuthorizations{}, 30*time.Second)
 
 	auths, ok := res.(mtproto.TL_account_authorizations)
 	if !ok {
@@ -468,7 +767,64 @@ func tgLoadMessages(
 	} else {
 		params.AddOffset = recentOffset - limit
 	}
-	res := tg.SendSyncRetry(params, time.Second, 0, 30*time.Second)
+	res := tgSendSyncRetry(tg, params, 30*time.Second)
+
+	switch messages := res.(type) {
+	case mtproto.TL_messages_messages:
+		return messages.Messages, messages.Users, messages.Chats, nil
+	case mtproto.TL_messages_messagesSlice:
+		return messages.Messages, messages.Users, messages.Chats, nil
+	case mtproto.TL_messages_channelMessages:
+		return messages.Messages, messages.Users, messages.Chats, nil
+	default:
+		return nil, nil, nil, merry.Wrap(mtproto.WrongRespError(res))
+	}
+}
+
+// Requests `limit` messages older than `offsetID` (or `limit` most recent messages if `offsetID` is 0),
+// messages are sorted by ID from highest to lowest.
+func tgLoadMessagesBefore(
+	tg *tgclient.TGClient, peerTL mtproto.TL, limit, offsetID int32,
+) ([]mtproto.TL, []mtproto.TL, []mtproto.TL, error) {
+	inputPeer, err := tgMakeInputPeer(peerTL)
+	if err != nil {
+		return nil, nil, nil, merry.Wrap(err)
+	}
+
+	res := tgSendSyncRetry(tg, mtproto.TL_messages_getHistory{
+		Peer:     inputPeer,
+		OffsetID: offsetID,
+		Limit:    limit,
+	}, 30*time.Second)
+
+	switch messages := res.(type) {
+	case mtproto.TL_messages_messages:
+		return messages.Messages, messages.Users, messages.Chats, nil
+	case mtproto.TL_messages_messagesSlice:
+		return messages.Messages, messages.Users, messages.Chats, nil
+	case mtproto.TL_messages_channelMessages:
+		return messages.Messages, messages.Users, messages.Chats, nil
+	default:
+		return nil, nil, nil, merry.Wrap(mtproto.WrongRespError(res))
+	}
+}
+
+// Requests up to `limit` messages with afterID < ID < beforeID,
+// messages are sorted by ID from highest to lowest.
+func tgLoadMessagesBetween(
+	tg *tgclient.TGClient, peerTL mtproto.TL, afterID, beforeID, limit int32,
+) ([]mtproto.TL, []mtproto.TL, []mtproto.TL, error) {
+	inputPeer, err := tgMakeInputPeer(peerTL)
+	if err != nil {
+		return nil, nil, nil, merry.Wrap(err)
+	}
+
+	res := tgSendSyncRetry(tg, mtproto.TL_messages_getHistory{
+		Peer:     inputPeer,
+		OffsetID: beforeID,
+		MinID:    afterID,
+		Limit:    limit,
+	}, 30*time.Second)
 
 	switch messages := res.(type) {
 	case mtproto.TL_messages_messages:
@@ -482,6 +838,610 @@ func tgLoadMessages(
 	}
 }
 
+// Returns ID of the last message sent before `date` (or 0 if there are no such messages).
+func tgFindLastMessageIDBeforeDate(tg *tgclient.TGClient, peerTL mtproto.TL, date int32) (int32, error) {
+	inputPeer, err := tgMakeInputPeer(peerTL)
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+
+	res := tgSendSyncRetry(tg, mtproto.TL_messages_getHistory{
+		Peer:       inputPeer,
+		OffsetDate: date,
+		Limit:      1,
+	}, 30*time.Second)
+
+	var messages []mtproto.TL
+	switch res := res.(type) {
+	case mtproto.TL_messages_messages:
+		messages = res.Messages
+	case mtproto.TL_messages_messagesSlice:
+		messages = res.Messages
+	case mtproto.TL_messages_channelMessages:
+		messages = res.Messages
+	default:
+		return 0, merry.Wrap(mtproto.WrongRespError(res))
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+	return tgGetMessageID(messages[0])
+}
+
+// Requests up to `limit` comments (replies in linked discussion group) of channel post `msgID`
+// older than `offsetID` (or most recent ones if `offsetID` is 0) and newer than `minID`,
+// comments are sorted by ID from highest to lowest.
+func tgLoadReplies(
+	tg *tgclient.TGClient, peerTL mtproto.TL, msgID, offsetID, minID, limit int32,
+) ([]mtproto.TL, []mtproto.TL, []mtproto.TL, error) {
+	inputPeer, err := tgMakeInputPeer(peerTL)
+	if err != nil {
+		return nil, nil, nil, merry.Wrap(err)
+	}
+
+	res := tgSendSyncRetry(tg, mtproto.TL_messages_getReplies{
+		Peer:     inputPeer,
+		MsgID:    msgID,
+		OffsetID: offsetID,
+		MinID:    minID,
+		Limit:    limit,
+	}, 30*time.Second)
+
+	if mtproto.IsError(res, "CHANNEL_PRIVATE") || mtproto.IsError(res, "MSG_ID_INVALID") {
+		log.Debug("comments of post #%d are not accessible: %v", msgID, res)
+		return nil, nil, nil, nil //discussion group is private or post has no discussion thread anymore
+	}
+
+	switch messages := res.(type) {
+	case mtproto.TL_messages_messages:
+		return messages.Messages, messages.Users, messages.Chats, nil
+	case mtproto.TL_messages_messagesSlice:
+		return messages.Messages, messages.Users, messages.Chats, nil
+	case mtproto.TL_messages_channelMessages:
+		return messages.Messages, messages.Users, messages.Chats, nil
+	default:
+		return nil, nil, nil, merry.Wrap(mtproto.WrongRespError(res))
+	}
+}
+
+func tgIsForum(peerTL mtproto.TL) bool {
+	channel, ok := peerTL.(mtproto.TL_channel)
+	return ok && channel.Forum
+}
+
+// Returns topic ID of forum supergroup message (https://core.telegram.org/api/forum#forum-topics).
+// Messages without topic reply header belong to the "General" topic with ID=1.
+func tgGetForumMessageTopicID(peerTL mtproto.TL, msgTL mtproto.TL) (int32, bool) {
+	if !tgIsForum(peerTL) {
+		return 0, false
+	}
+	var replyTo mtproto.TL
+	switch msg := msgTL.(type) {
+	case mtproto.TL_message:
+		replyTo = msg.ReplyTo
+	case mtproto.TL_messageService:
+		if _, ok := msg.Action.(mtproto.TL_messageActionTopicCreate); ok {
+			return msg.ID, true //topic ID is the ID of its creation message
+		}
+		replyTo = msg.ReplyTo
+	default:
+		return 0, false
+	}
+	if header, ok := replyTo.(mtproto.TL_messageReplyHeader); ok && header.ForumTopic {
+		if header.ReplyToTopID != nil {
+			return *header.ReplyToTopID, true
+		}
+		if header.ReplyToMsgID != nil {
+			return *header.ReplyToMsgID, true
+		}
+	}
+	return 1, true
+}
+
+// Checks whether message has a link preview which is not ready yet.
+// Such messages should be re-fetched a bit later (https://core.telegram.org/constructor/webPagePending).
+func tgHasPendingWebPage(msgTL mtproto.TL) bool {
+	var mediaTL mtproto.TL
+	switch msg := msgTL.(type) {
+	case mtproto.TL_message:
+		mediaTL = msg.Media
+	case mtproto.TL_storyItem:
+		mediaTL = msg.Media
+	default:
+		return false
+	}
+	media, ok := mediaTL.(mtproto.TL_messageMediaWebPage)
+	if !ok {
+		return false
+	}
+	_, ok = media.Webpage.(mtproto.TL_webPagePending)
+	return ok
+}
+
+// Requests all topics of forum supergroup.
+// Uses messages.getForumTopics (channels.getForumTopics was moved there in recent layers).
+func tgLoadForumTopics(tg *tgclient.TGClient, peerTL mtproto.TL) ([]mtproto.TL, []mtproto.TL, []mtproto.TL, error) {
+	inputPeer, err := tgMakeInputPeer(peerTL)
+	if err != nil {
+		return nil, nil, nil, merry.Wrap(err)
+	}
+
+	limit := int32(100)
+	params := mtproto.TL_messages_getForumTopics{Peer: inputPeer, Limit: limit}
+	var allTopics, allUsers, allChats []mtproto.TL
+	for {
+		tgLimiterFor(tg).Wait()
+		res := tgSendSyncRetry(tg, params, 30*time.Second)
+		topics, ok := res.(mtproto.TL_messages_forumTopics)
+		if !ok {
+			return nil, nil, nil, merry.Wrap(mtproto.WrongRespError(res))
+		}
+		allTopics = append(allTopics, topics.Topics...)
+		allUsers = append(allUsers, topics.Users...)
+		allChats = append(allChats, topics.Chats...)
+
+		if len(topics.Topics) < int(limit) || len(allTopics) >= int(topics.Count) {
+			break
+		}
+		last, ok := topics.Topics[len(topics.Topics)-1].(mtproto.TL_forumTopic)
+		if !ok {
+			break //should not happen: deleted topics are not returned in lists
+		}
+		params.OffsetTopic = last.ID
+		params.OffsetID = last.TopMessage
+		params.OffsetDate = last.Date
+		for _, msgTL := range topics.Messages {
+			if id, date, _, err := tgGetMessageIDStampPeer(msgTL); err == nil && id == last.TopMessage {
+				params.OffsetDate = date
+			}
+		}
+	}
+	return allTopics, allUsers, allChats, nil
+}
+
+func tgMakeInputChannel(peerTL mtproto.TL) (mtproto.TL, error) {
+	channel, ok := peerTL.(mtproto.TL_channel)
+	if !ok {
+		return nil, merry.Wrap(mtproto.WrongRespError(peerTL))
+	}
+	if channel.AccessHash == nil {
+		return nil, merry.Errorf("channel #%d has no access_hash", channel.ID)
+	}
+	return mtproto.TL_inputChannel{ChannelID: channel.ID, AccessHash: *channel.AccessHash}, nil
+}
+
+// Requests messages by their IDs. Non-existent (i.e. deleted) messages are returned as TL_messageEmpty.
+// For channels also returns current channel PTS.
+func tgLoadMessagesByIDs(
+	tg *tgclient.TGClient, peerTL mtproto.TL, ids []int32,
+) ([]mtproto.TL, []mtproto.TL, []mtproto.TL, int32, error) {
+	inputIDs := make([]mtproto.TL, len(ids))
+	for i, id := range ids {
+		inputIDs[i] = mtproto.TL_inputMessageID{ID: id}
+	}
+
+	var params mtproto.TLReq
+	if _, ok := peerTL.(mtproto.TL_channel); ok {
+		inputChannel, err := tgMakeInputChannel(peerTL)
+		if err != nil {
+			return nil, nil, nil, 0, merry.Wrap(err)
+		}
+		params = mtproto.TL_channels_getMessages{Channel: inputChannel, ID: inputIDs}
+	} else {
+		params = mtproto.TL_messages_getMessages{ID: inputIDs}
+	}
+	res := tgSendSyncRetry(tg, params, 30*time.Second)
+
+	switch messages := res.(type) {
+	case mtproto.TL_messages_messages:
+		return messages.Messages, messages.Users, messages.Chats, 0, nil
+	case mtproto.TL_messages_messagesSlice:
+		return messages.Messages, messages.Users, messages.Chats, 0, nil
+	case mtproto.TL_messages_channelMessages:
+		return messages.Messages, messages.Users, messages.Chats, messages.PTS, nil
+	default:
+		return nil, nil, nil, 0, merry.Wrap(mtproto.WrongRespError(res))
+	}
+}
+
+// Requests IDs of channel messages deleted since `pts`.
+// If there are too many updates since `pts` returns tooLong=true,
+// in this case all messages should be re-checked (https://core.telegram.org/api/updates#recovering-gaps).
+func tgLoadChannelDeletedMessageIDs(
+	tg *tgclient.TGClient, peerTL mtproto.TL, pts int32,
+) (deletedIDs []int32, newPTS int32, tooLong bool, err error) {
+	inputChannel, err := tgMakeInputChannel(peerTL)
+	if err != nil {
+		return nil, 0, false, merry.Wrap(err)
+	}
+
+	for {
+		res := tgSendSyncRetry(tg, mtproto.TL_updates_getChannelDifference{
+			Channel: inputChannel,
+			Filter:  mtproto.TL_channelMessagesFilterEmpty{},
+			PTS:     pts,
+			Limit:   100,
+		}, 30*time.Second)
+
+		switch diff := res.(type) {
+		case mtproto.TL_updates_channelDifferenceEmpty:
+			return deletedIDs, diff.PTS, false, nil
+		case mtproto.TL_updates_channelDifferenceTooLong:
+			return nil, 0, true, nil
+		case mtproto.TL_updates_channelDifference:
+			for _, updTL := range diff.OtherUpdates {
+				if upd, ok := updTL.(mtproto.TL_updateDeleteChannelMessages); ok {
+					deletedIDs = append(deletedIDs, upd.Messages...)
+				}
+			}
+			pts = diff.PTS
+			if diff.Final {
+				return deletedIDs, pts, false, nil
+			}
+		default:
+			return nil, 0, false, merry.Wrap(mtproto.WrongRespError(res))
+		}
+	}
+}
+
+func tgGetUpdatesState(tg *tgclient.TGClient) (mtproto.TL_updates_state, error) {
+	res := tgSendSyncRetry(tg, mtproto.TL_updates_getState{}, 30*time.Second)
+	state, ok := res.(mtproto.TL_updates_state)
+	if !ok {
+		return state, merry.Wrap(mtproto.WrongRespError(res))
+	}
+	return state, nil
+}
+
+// Requests new messages (of users and basic groups) since `state`
+// (https://core.telegram.org/api/updates#recovering-gaps).
+// If there are too many updates since `state` returns tooLong=true, in this case state should be re-requested
+// and new messages should be loaded from chats history.
+func tgLoadDifference(
+	tg *tgclient.TGClient, state mtproto.TL_updates_state,
+) (messages, otherUpdates, users, chats []mtproto.TL, newState mtproto.TL_updates_state, tooLong bool, err error) {
+	for {
+		res := tgSendSyncRetry(tg, mtproto.TL_updates_getDifference{
+			PTS:  state.PTS,
+			Date: state.Date,
+			QTS:  state.QTS,
+		}, 30*time.Second)
+
+		switch diff := res.(type) {
+		case mtproto.TL_updates_differenceEmpty:
+			state.Date = diff.Date
+			state.Seq = diff.Seq
+			return messages, otherUpdates, users, chats, state, false, nil
+		case mtproto.TL_updates_differenceTooLong:
+			return nil, nil, nil, nil, state, true, nil
+		case mtproto.TL_updates_difference:
+			messages = append(messages, diff.NewMessages...)
+			otherUpdates = append(otherUpdates, diff.OtherUpdates...)
+			users = append(users, diff.Users...)
+			chats = append(chats, diff.Chats...)
+			return messages, otherUpdates, users, chats, diff.State, false, nil
+		case mtproto.TL_updates_differenceSlice:
+			messages = append(messages, diff.NewMessages...)
+			otherUpdates = append(otherUpdates, diff.OtherUpdates...)
+			users = append(users, diff.Users...)
+			chats = append(chats, diff.Chats...)
+			state = diff.IntermediateState
+		default:
+			return nil, nil, nil, nil, state, false, merry.Wrap(mtproto.WrongRespError(res))
+		}
+	}
+}
+
+// Requests new messages of the channel since `pts`.
+// If there are too many updates since `pts` returns tooLong=true and channel's dialog
+// (with TopMessage and current PTS), in this case new messages should be loaded from channel history.
+func tgLoadChannelDifference(
+	tg *tgclient.TGClient, peerTL mtproto.TL, pts int32,
+) (messages, users, chats []mtproto.TL, newPTS int32, tooLongDialog *mtproto.TL_dialog, err error) {
+	inputChannel, err := tgMakeInputChannel(peerTL)
+	if err != nil {
+		return nil, nil, nil, 0, nil, merry.Wrap(err)
+	}
+
+	for {
+		res := tgSendSyncRetry(tg, mtproto.TL_updates_getChannelDifference{
+			Channel: inputChannel,
+			Filter:  mtproto.TL_channelMessagesFilterEmpty{},
+			PTS:     pts,
+			Limit:   100,
+		}, 30*time.Second)
+
+		switch diff := res.(type) {
+		case mtproto.TL_updates_channelDifferenceEmpty:
+			return messages, users, chats, diff.PTS, nil, nil
+		case mtproto.TL_updates_channelDifferenceTooLong:
+			dialog, ok := diff.Dialog.(mtproto.TL_dialog)
+			if !ok || dialog.PTS == nil {
+				return nil, nil, nil, 0, nil, merry.Wrap(mtproto.WrongRespError(diff.Dialog))
+			}
+			return nil, diff.Users, diff.Chats, *dialog.PTS, &dialog, nil
+		case mtproto.TL_updates_channelDifference:
+			messages = append(messages, diff.NewMessages...)
+			users = append(users, diff.Users...)
+			chats = append(chats, diff.Chats...)
+			pts = diff.PTS
+			if diff.Final {
+				return messages, users, chats, pts, nil, nil
+			}
+		default:
+			return nil, nil, nil, 0, nil, merry.Wrap(mtproto.WrongRespError(res))
+		}
+	}
+}
+
+// Requests current PTS of the channel (https://core.telegram.org/api/updates#event-sequences).
+func tgGetChannelPTS(tg *tgclient.TGClient, peerTL mtproto.TL) (int32, error) {
+	inputPeer, err := tgMakeInputPeer(peerTL)
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+	res := tgSendSyncRetry(tg, mtproto.TL_messages_getHistory{Peer: inputPeer, Limit: 1}, 30*time.Second)
+	messages, ok := res.(mtproto.TL_messages_channelMessages)
+	if !ok {
+		return 0, merry.Wrap(mtproto.WrongRespError(res))
+	}
+	return messages.PTS, nil
+}
+
+// Returns ID of the chat (user, group or channel) the message belongs to.
+func tgGetMessagePeerID(msgTL mtproto.TL) (int64, bool) {
+	var peerTL mtproto.TL
+	switch msg := msgTL.(type) {
+	case mtproto.TL_message:
+		peerTL = msg.PeerID
+	case mtproto.TL_messageService:
+		peerTL = msg.PeerID
+	default:
+		return 0, false
+	}
+	switch peer := peerTL.(type) {
+	case mtproto.TL_peerUser:
+		return peer.UserID, true
+	case mtproto.TL_peerChat:
+		return peer.ChatID, true
+	case mtproto.TL_peerChannel:
+		return peer.ChannelID, true
+	default:
+		return 0, false
+	}
+}
+
+// Returns ID of the message sender (user or channel). Channel posts may have no sender.
+func tgGetMessageSenderID(msgTL mtproto.TL) (int64, bool) {
+	var peerTL mtproto.TL
+	switch msg := msgTL.(type) {
+	case mtproto.TL_message:
+		peerTL = msg.FromID
+	case mtproto.TL_messageService:
+		peerTL = msg.FromID
+	default:
+		return 0, false
+	}
+	switch peer := peerTL.(type) {
+	case mtproto.TL_peerUser:
+		return peer.UserID, true
+	case mtproto.TL_peerChat:
+		return peer.ChatID, true
+	case mtproto.TL_peerChannel:
+		return peer.ChannelID, true
+	default:
+		return 0, false
+	}
+}
+
+// Requests full info of group or channel: TL_chatFull or TL_channelFull.
+func tgLoadFullChat(tg *tgclient.TGClient, peerTL mtproto.TL) (mtproto.TL, []mtproto.TL, []mtproto.TL, error) {
+	var params mtproto.TLReq
+	switch peer := peerTL.(type) {
+	case mtproto.TL_chat:
+		params = mtproto.TL_messages_getFullChat{ChatID: peer.ID}
+	case mtproto.TL_channel:
+		inputChannel, err := tgMakeInputChannel(peerTL)
+		if err != nil {
+			return nil, nil, nil, merry.Wrap(err)
+		}
+		params = mtproto.TL_channels_getFullChannel{Channel: inputChannel}
+	default:
+		return nil, nil, nil, merry.Wrap(mtproto.WrongRespError(peerTL))
+	}
+	res := tgSendSyncRetry(tg, params, 30*time.Second)
+	full, ok := res.(mtproto.TL_messages_chatFull)
+	if !ok {
+		return nil, nil, nil, merry.Wrap(mtproto.WrongRespError(res))
+	}
+	return full.FullChat, full.Users, full.Chats, nil
+}
+
+func tgExtractChatFullData(fullTL mtproto.TL) (*ChatFullData, error) {
+	var full ChatFullData
+	var photoTL mtproto.TL
+	switch f := fullTL.(type) {
+	case mtproto.TL_channelFull:
+		full.About = f.About
+		full.ParticipantsCount = mtproto.DerefOr(f.ParticipantsCount, 0)
+		full.LinkedChatID = mtproto.DerefOr(f.LinkedChatID, 0)
+		full.SlowModeSeconds = mtproto.DerefOr(f.SlowmodeSeconds, 0)
+		full.PinnedMsgID = mtproto.DerefOr(f.PinnedMsgID, 0)
+		photoTL = f.ChatPhoto
+	case mtproto.TL_chatFull:
+		full.About = f.About
+		if participants, ok := f.Participants.(mtproto.TL_chatParticipants); ok {
+			full.ParticipantsCount = int32(len(participants.Participants))
+		}
+		full.PinnedMsgID = mtproto.DerefOr(f.PinnedMsgID, 0)
+		photoTL = f.ChatPhoto
+	default:
+		return nil, merry.Wrap(mtproto.WrongRespError(fullTL))
+	}
+	if photo, ok := photoTL.(mtproto.TL_photo); ok {
+		full.PhotoID = photo.ID
+	}
+	return &full, nil
+}
+
+var errChatAdminRequired = merry.New("chat admin required")
+
+// Loads chat members: pages through channels.getParticipants for channels and supergroups
+// or takes them from full chat info for basic groups.
+// Telegram returns at most ~10k members of a big channel (and none if members list is hidden),
+// so the returned count may be greater than the number of participants.
+func tgLoadParticipants(tg *tgclient.TGClient, peerTL mtproto.TL) ([]mtproto.TL, int32, []mtproto.TL, []mtproto.TL, error) {
+	if _, ok := peerTL.(mtproto.TL_chat); ok {
+		tgLimiterFor(tg).Wait()
+		fullTL, users, chats, err := tgLoadFullChat(tg, peerTL)
+		if err != nil {
+			return nil, 0, nil, nil, merry.Wrap(err)
+		}
+		full, ok := fullTL.(mtproto.TL_chatFull)
+		if !ok {
+			return nil, 0, nil, nil, merry.Wrap(mtproto.WrongRespError(fullTL))
+		}
+		participants, ok := full.Participants.(mtproto.TL_chatParticipants)
+		if !ok {
+			// TL_chatParticipantsForbidden: not a member anymore
+			return nil, 0, users, chats, nil
+		}
+		return participants.Participants, int32(len(participants.Participants)), users, chats, nil
+	}
+
+	inputChannel, err := tgMakeInputChannel(peerTL)
+	if err != nil {
+		return nil, 0, nil, nil, merry.Wrap(err)
+	}
+	var allParticipants, allUsers, allChats []mtproto.TL
+	var count int32
+	for {
+		tgLimiterFor(tg).Wait()
+		params := mtproto.TL_channels_getParticipants{
+			Channel: inputChannel,
+			Filter:  mtproto.TL_channelParticipantsRecent{},
+			Offset:  int32(len(allParticipants)),
+			Limit:   200,
+		}
+		res := tgSendSyncRetry(tg, params, 30*time.Second)
+		if mtproto.IsError(res, "CHAT_ADMIN_REQUIRED") {
+			return nil, 0, nil, nil, merry.Wrap(errChatAdminRequired)
+		}
+		page, ok := res.(mtproto.TL_channels_channelParticipants)
+		if !ok {
+			return nil, 0, nil, nil, merry.Wrap(mtproto.WrongRespError(res))
+		}
+		count = page.Count
+		allParticipants = append(allParticipants, page.Participants...)
+		allUsers = append(allUsers, page.Users...)
+		allChats = append(allChats, page.Chats...)
+		if len(page.Participants) == 0 || int32(len(allParticipants)) >= count {
+			break
+		}
+	}
+	return allParticipants, count, allUsers, allChats, nil
+}
+
+// Checks whether current account may read admin log of the channel/supergroup.
+func tgCanReadAdminLog(peerTL mtproto.TL) bool {
+	channel, ok := peerTL.(mtproto.TL_channel)
+	return ok && (channel.Creator || channel.AdminRights != nil)
+}
+
+// Loads admin log events with IDs between minID and maxID (both exclusive, 0 means no limit).
+// Events are returned from newest to oldest.
+func tgLoadAdminLog(tg *tgclient.TGClient, peerTL mtproto.TL, minID, maxID int64, limit int32) ([]mtproto.TL, []mtproto.TL, []mtproto.TL, error) {
+	inputChannel, err := tgMakeInputChannel(peerTL)
+	if err != nil {
+		return nil, nil, nil, merry.Wrap(err)
+	}
+	params := mtproto.TL_channels_getAdminLog{Channel: inputChannel, MinID: minID, MaxID: maxID, Limit: limit}
+	res := tgSendSyncRetry(tg, params, 30*time.Second)
+	results, ok := res.(mtproto.TL_channels_adminLogResults)
+	if !ok {
+		return nil, nil, nil, merry.Wrap(mtproto.WrongRespError(res))
+	}
+	events := make([]mtproto.TL, len(results.Events))
+	for i, event := range results.Events {
+		events[i] = event
+	}
+	return events, results.Users, results.Chats, nil
+}
+
+// Returns false for banned and left channel members (and for non-user ones).
+func tgExtractParticipantData(participantTL mtproto.TL) (ParticipantData, bool) {
+	switch p := participantTL.(type) {
+	case mtproto.TL_channelParticipant:
+		return ParticipantData{UserID: p.UserID, Role: "member", JoinedAt: p.Date}, true
+	case mtproto.TL_channelParticipantSelf:
+		return ParticipantData{UserID: p.UserID, Role: "member", InviterID: p.InviterID, JoinedAt: p.Date}, true
+	case mtproto.TL_channelParticipantCreator:
+		return ParticipantData{UserID: p.UserID, Role: "creator"}, true
+	case mtproto.TL_channelParticipantAdmin:
+		return ParticipantData{UserID: p.UserID, Role: "admin", InviterID: mtproto.DerefOr(p.InviterID, 0), JoinedAt: p.Date}, true
+	case mtproto.TL_chatParticipant:
+		return ParticipantData{UserID: p.UserID, Role: "member", InviterID: p.InviterID, JoinedAt: p.Date}, true
+	case mtproto.TL_chatParticipantCreator:
+		return ParticipantData{UserID: p.UserID, Role: "creator"}, true
+	case mtproto.TL_chatParticipantAdmin:
+		return ParticipantData{UserID: p.UserID, Role: "admin", InviterID: p.InviterID, JoinedAt: p.Date}, true
+	}
+	return ParticipantData{}, false
+}
+
+// Requests current views, forwards and replies counters of channel posts (without incrementing views).
+// Counters are returned in the same order as IDs.
+func tgLoadMessagesViews(tg *tgclient.TGClient, peerTL mtproto.TL, ids []int32) ([]mtproto.TL_messageViews, []mtproto.TL, []mtproto.TL, error) {
+	inputPeer, err := tgMakeInputPeer(peerTL)
+	if err != nil {
+		return nil, nil, nil, merry.Wrap(err)
+	}
+	res := tgSendSyncRetry(tg, mtproto.TL_messages_getMessagesViews{Peer: inputPeer, ID: ids}, 30*time.Second)
+	views, ok := res.(mtproto.TL_messages_messageViews)
+	if !ok {
+		return nil, nil, nil, merry.Wrap(mtproto.WrongRespError(res))
+	}
+	if len(views.Views) != len(ids) {
+		return nil, nil, nil, merry.Errorf("expected %d message views, got %d", len(ids), len(views.Views))
+	}
+	return views.Views, views.Users, views.Chats, nil
+}
+
+// Requests current reactions of messages. Returns reactions by message ID
+// (messages without reactions may be missing).
+func tgLoadMessagesReactions(tg *tgclient.TGClient, peerTL mtproto.TL, ids []int32) (map[int32]mtproto.TL_messageReactions, error) {
+	inputPeer, err := tgMakeInputPeer(peerTL)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	res := tgSendSyncRetry(tg, mtproto.TL_messages_getMessagesReactions{Peer: inputPeer, ID: ids}, 30*time.Second)
+	updates, ok := res.(mtproto.TL_updates)
+	if !ok {
+		return nil, merry.Wrap(mtproto.WrongRespError(res))
+	}
+	reactions := make(map[int32]mtproto.TL_messageReactions, len(ids))
+	for _, updTL := range updates.Updates {
+		if upd, ok := updTL.(mtproto.TL_updateMessageReactions); ok {
+			reactions[upd.MsgID] = upd.Reactions
+		}
+	}
+	return reactions, nil
+}
+
+// Returns reaction as a short string: emoji itself, "custom:<document_id>" or "paid".
+func tgReactionKey(reactionTL mtproto.TL) string {
+	switch reaction := reactionTL.(type) {
+	case mtproto.TL_reactionEmoji:
+		return reaction.Emoticon
+	case mtproto.TL_reactionCustomEmoji:
+		return "custom:" + strconv.FormatInt(reaction.DocumentID, 10)
+	case mtproto.TL_reactionPaid:
+		return "paid"
+	default:
+		return fmt.Sprintf("%T", reactionTL)
+	}
+}
+
 func tgLoadMissingMessageMediaStory(tg *tgclient.TGClient, chat mtproto.TL, msgTL mtproto.TL, relatedChats []mtproto.TL) (mtproto.TL, error) {
 	if msg, ok := msgTL.(mtproto.TL_message); ok {
 		if media, ok := msg.Media.(mtproto.TL_messageMediaStory); ok {
@@ -512,10 +1472,10 @@ func tgLoadMissingMessageMediaStory(tg *tgclient.TGClient, chat mtproto.TL, msgT
 					return nil, merry.Wrap(mtproto.WrongRespError(media.Peer))
 				}
 
-				res := tg.SendSyncRetry(mtproto.TL_stories_getStoriesByID{
+				res := tgSendSyncRetry(tg, mtproto.TL_stories_getStoriesByID{
 					Peer: inputPeer,
 					ID:   []int32{media.ID},
-				}, time.Second, 0, 5*60*time.Second) //need more time here: once got FLOOD_WAIT_54
+				}, 5*60*time.Second) //need more time here: once got FLOOD_WAIT_54
 
 				if mtproto.IsError(res, "CHANNEL_PRIVATE") {
 					return msgTL, nil //UI shows such message as "This story has expired."
@@ -550,11 +1510,11 @@ func tgLoadPinnedStories(tg *tgclient.TGClient, peerTL mtproto.TL, limit, offset
 		return nil, nil, nil, merry.Wrap(err)
 	}
 
-	res := tg.SendSyncRetry(mtproto.TL_stories_getPinnedStories{
+	res := tgSendSyncRetry(tg, mtproto.TL_stories_getPinnedStories{
 		Peer:     inputPeer,
 		OffsetID: offsetID,
 		Limit:    limit,
-	}, time.Second, 0, 5*60*time.Second)
+	}, 5*60*time.Second)
 	stories, ok := res.(mtproto.TL_stories_stories)
 	if !ok {
 		return nil, nil, nil, merry.Wrap(mtproto.WrongRespError(res))
@@ -568,11 +1528,28 @@ func tgLoadArchivedStories(tg *tgclient.TGClient, peerTL mtproto.TL, limit, offs
 		return nil, nil, nil, merry.Wrap(err)
 	}
 
-	res := tg.SendSyncRetry(mtproto.TL_stories_getStoriesArchive{
+	res := tgSendSyncRetry(tg, mtproto.TL_stories_getStoriesArchive{
 		Peer:     inputPeer,
 		OffsetID: offsetID,
 		Limit:    limit,
-	}, time.Second, 0, 30*time.Second)
+	}, 30*time.Second)
+	stories, ok := res.(mtproto.TL_stories_stories)
+	if !ok {
+		return nil, nil, nil, merry.Wrap(mtproto.WrongRespError(res))
+	}
+	return stories.Stories, stories.Users, stories.Chats, nil
+}
+
+func tgLoadStoriesByIDs(tg *tgclient.TGClient, peerTL mtproto.TL, ids []int32) ([]mtproto.TL, []mtproto.TL, []mtproto.TL, error) {
+	inputPeer, err := tgMakeInputPeer(peerTL)
+	if err != nil {
+		return nil, nil, nil, merry.Wrap(err)
+	}
+
+	res := tgSendSyncRetry(tg, mtproto.TL_stories_getStoriesByID{
+		Peer: inputPeer,
+		ID:   ids,
+	}, 30*time.Second)
 	stories, ok := res.(mtproto.TL_stories_stories)
 	if !ok {
 		return nil, nil, nil, merry.Wrap(mtproto.WrongRespError(res))
@@ -682,6 +1659,198 @@ func tgFindPhotoFileInfo(photoTL mtproto.TL, fname string, indexInMsg int64, ctx
 	}, true, nil
 }
 
+// Loads all profile photos of the user (from newest to oldest) or photos that were set in the group/channel
+// (found by chat photo change service messages, so photos changed before the history was cleared are not available).
+func tgLoadProfilePhotos(tg *tgclient.TGClient, peerTL mtproto.TL) ([]mtproto.TL_photo, error) {
+	inputPeer, err := tgMakeInputPeer(peerTL)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+
+	var photos []mtproto.TL_photo
+	if inputUser, ok := inputPeer.(mtproto.TL_inputPeerUser); ok {
+		for {
+			tgLimiterFor(tg).Wait()
+			params := mtproto.TL_photos_getUserPhotos{
+				UserID: mtproto.TL_inputUser{UserID: inputUser.UserID, AccessHash: inputUser.AccessHash},
+				Offset: int32(len(photos)),
+				Limit:  100,
+			}
+			res := tgSendSyncRetry(tg, params, 30*time.Second)
+			var chunk []mtproto.TL
+			switch r := res.(type) {
+			case mtproto.TL_photos_photos:
+				chunk = r.Photos
+			case mtproto.TL_photos_photosSlice:
+				chunk = r.Photos
+			default:
+				return nil, merry.Wrap(mtproto.WrongRespError(res))
+			}
+			for _, photoTL := range chunk {
+				if photo, ok := photoTL.(mtproto.TL_photo); ok {
+					photos = append(photos, photo)
+				}
+			}
+			if _, ok := res.(mtproto.TL_photos_photos); ok || len(chunk) == 0 {
+				break //TL_photos_photos contains the full list
+			}
+		}
+		return photos, nil
+	}
+
+	offsetID := int32(0)
+	for {
+		tgLimiterFor(tg).Wait()
+		params := mtproto.TL_messages_search{
+			Peer:     inputPeer,
+			Filter:   mtproto.TL_inputMessagesFilterChatPhotos{},
+			OffsetID: offsetID,
+			Limit:    100,
+		}
+		res := tgSendSyncRetry(tg, params, 30*time.Second)
+		var messages []mtproto.TL
+		switch r := res.(type) {
+		case mtproto.TL_messages_messages:
+			messages = r.Messages
+		case mtproto.TL_messages_messagesSlice:
+			messages = r.Messages
+		case mtproto.TL_messages_channelMessages:
+			messages = r.Messages
+		default:
+			return nil, merry.Wrap(mtproto.WrongRespError(res))
+		}
+		if len(messages) == 0 {
+			break
+		}
+		for _, msgTL := range messages {
+			if msg, ok := msgTL.(mtproto.TL_messageService); ok {
+				if action, ok := msg.Action.(mtproto.TL_messageActionChatEditPhoto); ok {
+					if photo, ok := action.Photo.(mtproto.TL_photo); ok {
+						photos = append(photos, photo)
+					}
+				}
+			}
+			if msgID, err := tgGetMessageID(msgTL); err == nil {
+				offsetID = msgID
+			}
+		}
+		if _, ok := res.(mtproto.TL_messages_messages); ok {
+			break //TL_messages_messages contains all found messages
+		}
+	}
+	return photos, nil
+}
+
+func tgFindProfilePhotoFileInfo(photo mtproto.TL_photo) (TGFileInfo, error) {
+	sizeType, sizeBytes, err := getBestPhotoSize(photo)
+	if err != nil {
+		return TGFileInfo{}, merry.Prependf(err, "image size of profile photo #%d", photo.ID)
+	}
+	return TGFileInfo{
+		InputLocation: mtproto.TL_inputPhotoFileLocation{
+			ID:            photo.ID,
+			AccessHash:    photo.AccessHash,
+			FileReference: photo.FileReference,
+			ThumbSize:     sizeType,
+		},
+		Size:  int64(sizeBytes),
+		DCID:  photo.DCID,
+		FName: strconv.FormatInt(photo.ID, 10) + ".jpg",
+	}, nil
+}
+
+// Returns sticker set of the sticker or custom emoji document.
+func tgFindDocumentStickerSet(doc mtproto.TL_document) (mtproto.TL_inputStickerSetID, bool) {
+	for _, attrTL := range doc.Attributes {
+		var setTL mtproto.TL
+		switch attr := attrTL.(type) {
+		case mtproto.TL_documentAttributeSticker:
+			setTL = attr.Stickerset
+		case mtproto.TL_documentAttributeCustomEmoji:
+			setTL = attr.Stickerset
+		}
+		if set, ok := setTL.(mtproto.TL_inputStickerSetID); ok {
+			return set, true
+		}
+	}
+	return mtproto.TL_inputStickerSetID{}, false
+}
+
+// Returns sticker sets of message stickers and IDs of custom emoji documents used in message text.
+func tgFindMessageStickerRefs(msgTL mtproto.TL) ([]mtproto.TL_inputStickerSetID, []int64) {
+	msg, ok := msgTL.(mtproto.TL_message)
+	if !ok {
+		return nil, nil
+	}
+	var sets []mtproto.TL_inputStickerSetID
+	if media, ok := msg.Media.(mtproto.TL_messageMediaDocument); ok {
+		if doc, ok := media.Document.(mtproto.TL_document); ok {
+			if set, ok := tgFindDocumentStickerSet(doc); ok {
+				sets = append(sets, set)
+			}
+		}
+	}
+	var emojiIDs []int64
+	for _, entityTL := range msg.Entities {
+		if entity, ok := entityTL.(mtproto.TL_messageEntityCustomEmoji); ok {
+			emojiIDs = append(emojiIDs, entity.DocumentID)
+		}
+	}
+	return sets, emojiIDs
+}
+
+// Returns nil if sticker set does not exist anymore.
+func tgLoadStickerSet(tg *tgclient.TGClient, set mtproto.TL_inputStickerSetID) (*mtproto.TL_messages_stickerSet, error) {
+	res := tgSendSyncRetry(tg, mtproto.TL_messages_getStickerSet{Stickerset: set}, 30*time.Second)
+	if mtproto.IsError(res, "STICKERSET_INVALID") {
+		return nil, nil
+	}
+	stickerSet, ok := res.(mtproto.TL_messages_stickerSet)
+	if !ok {
+		return nil, merry.Wrap(mtproto.WrongRespError(res))
+	}
+	return &stickerSet, nil
+}
+
+func tgLoadCustomEmojiDocuments(tg *tgclient.TGClient, ids []int64) ([]mtproto.TL_document, error) {
+	res := tgSendSyncRetry(tg, mtproto.TL_messages_getCustomEmojiDocuments{DocumentID: ids}, 30*time.Second)
+	docTLs, ok := res.(mtproto.VectorObject)
+	if !ok {
+		return nil, merry.Wrap(mtproto.WrongRespError(res))
+	}
+	var docs []mtproto.TL_document
+	for _, docTL := range docTLs {
+		if doc, ok := docTL.(mtproto.TL_document); ok {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+func tgFindStickerFileInfo(doc mtproto.TL_document) TGFileInfo {
+	ext := ""
+	switch doc.MIMEType {
+	case "image/webp":
+		ext = ".webp"
+	case "video/webm":
+		ext = ".webm"
+	case "application/x-tgsticker":
+		ext = ".tgs"
+	case "image/png":
+		ext = ".png"
+	}
+	return TGFileInfo{
+		InputLocation: mtproto.TL_inputDocumentFileLocation{
+			ID:            doc.ID,
+			AccessHash:    doc.AccessHash,
+			FileReference: doc.FileReference,
+		},
+		Size:  doc.Size,
+		DCID:  doc.DCID,
+		FName: strconv.FormatInt(doc.ID, 10) + ext,
+	}
+}
+
 func tgFindMediaFileInfos(mediaTL mtproto.TL, indexInMsg int64, ctxObjName string, ctxObjID int32) ([]TGFileInfo, error) {
 	switch media := mediaTL.(type) {
 	case mtproto.TL_messageMediaPhoto:
@@ -768,19 +1937,9 @@ func tgFindMediaFileInfos(mediaTL mtproto.TL, indexInMsg int64, ctxObjName strin
 		case mtproto.TL_webPageEmpty:
 			return nil, nil //no URL preview
 		case mtproto.TL_webPagePending:
-			// TODO: re-fetch the message somehow
-			if skipPendingWebpagePhotos {
-				log.Warn("webpage preview image in %s #%d is pending, skipping", ctxObjName, ctxObjID)
-				return nil, nil
-			} else {
-				return nil, merry.Wrap(
-					fmt.Errorf(
-						"tl;dr: webPage preview image in %s #%d is pending, run with -skip-pending-webpage-photos to skip such images."+
-							"\n\nMore details:\n%s",
-						ctxObjName, ctxObjID, skipPendingWebpagePhotosHelp),
-					merry.NoCaptureStack(),
-				)
-			}
+			// preview is not ready yet, the message will be re-fetched later (see tgHasPendingWebPage)
+			log.Debug("webpage preview in %s #%d is pending, will re-fetch it later", ctxObjName, ctxObjID)
+			return nil, nil
 		case mtproto.TL_webPage:
 			if webPage.Photo != nil {
 				fileInfo, found, err := tgFindPhotoFileInfo(webPage.Photo, "webpage_photo.jpg", indexInMsg, "media.webPage", ctxObjName, ctxObjID)
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/3bl3gamer/tgclient"
+	"github.com/3bl3gamer/tgclient/mtproto"
+	"github.com/ansel1/merry/v2"
+)
+
+// Updates are pushed by Telegram only for some time after the last request (and sometimes stop after reconnection),
+// so differences are also requested periodically.
+const watchPollInterval = time.Minute
+
+// Channel differences are requested for each channel separately, so (without pushed updates)
+// they are requested less often.
+const watchChannelsPollInterval = 10 * time.Minute
+
+// UpdatesWatcher follows updates stream (https://core.telegram.org/api/updates)
+// and saves new messages of chats matched by config.History.
+type UpdatesWatcher struct {
+	tg          *tgclient.TGClient
+	saver       HistorySaver
+	config      *Config
+	reconnected <-chan struct{}
+
+	chats      map[int64]*Chat
+	state      mtproto.TL_updates_state
+	channelPTS map[int64]int32
+
+	wake          chan struct{}
+	dirtyMutex    *sync.Mutex
+	dirtyChannels map[int64]bool
+}
+
+func NewUpdatesWatcher(tg *tgclient.TGClient, saver HistorySaver, config *Config, reconnected <-chan struct{}) *UpdatesWatcher {
+	w := &UpdatesWatcher{
+		tg:            tg,
+		saver:         saver,
+		config:        config,
+		reconnected:   reconnected,
+		wake:          make(chan struct{}, 1),
+		dirtyMutex:    &sync.Mutex{},
+		dirtyChannels: make(map[int64]bool),
+	}
+	tg.SetUpdateHandler(w.handleUpdate)
+	return w
+}
+
+// handleUpdate is called by TGClient for pushed updates. Updates are used only as hints:
+// new messages are then requested via updates.getDifference and updates.getChannelDifference.
+func (w *UpdatesWatcher) handleUpdate(updTL mtproto.TL) {
+	w.dirtyMutex.Lock()
+	switch upd := updTL.(type) {
+	case mtproto.TL_updateNewChannelMessage:
+		if peerID, ok := tgGetMessagePeerID(upd.Message); ok {
+			w.dirtyChannels[peerID] = true
+		}
+	case mtproto.TL_updateChannelTooLong:
+		w.dirtyChannels[upd.ChannelID] = true
+	case mtproto.TL_updateNewMessage, mtproto.TL_updateShortMessage, mtproto.TL_updateShortChatMessage:
+		// common updates sequence is checked on every wake-up
+	default:
+		w.dirtyMutex.Unlock()
+		return
+	}
+	w.dirtyMutex.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Reset remembers current updates state of the account and of the channels.
+// Must be called before catching up with chats history, so no messages are missed in between
+// (already saved messages are skipped later).
+func (w *UpdatesWatcher) Reset(chats []*Chat) error {
+	// chats are going to be dumped anyway, so earlier reconnections no longer matter
+	select {
+	case <-w.reconnected:
+	default:
+	}
+
+	state, err := tgGetUpdatesState(w.tg)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	w.state = state
+
+	w.chats = make(map[int64]*Chat)
+	w.channelPTS = make(map[int64]int32)
+	for _, chat := range chats {
+		if w.config.History.Match(chat, nil) != MatchTrue {
+			continue
+		}
+		w.chats[chat.ID] = chat
+		if _, ok := chat.Obj.(mtproto.TL_channel); ok {
+			tgLimiterFor(w.tg).Wait()
+			pts, err := tgGetChannelPTS(w.tg, chat.Obj)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			w.channelPTS[chat.ID] = pts
+		}
+	}
+	return nil
+}
+
+// Run follows updates until error. Chats list is reloaded and all chats are dumped as usual
+// (with loadChats and dumpChats) after reconnection or if there are too many missed updates.
+func (w *UpdatesWatcher) Run(loadChats func() ([]*Chat, error), dumpChats func([]*Chat) error) error {
+	for {
+		err := w.follow()
+		if err != errWatchCatchUpNeeded {
+			return merry.Wrap(err)
+		}
+		log.Info("catching up with chats history")
+		chats, err := loadChats()
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		if err := w.Reset(chats); err != nil {
+			return merry.Wrap(err)
+		}
+		if err := dumpChats(chats); err != nil {
+			return merry.Wrap(err)
+		}
+	}
+}
+
+var errWatchCatchUpNeeded = merry.New("catch-up needed")
+
+func (w *UpdatesWatcher) follow() error {
+	log.Info("watching %d chat(s) for new messages", len(w.chats))
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	lastChannelsPollAt := time.Now()
+
+	for {
+		select {
+		case <-w.wake:
+		case <-ticker.C:
+		case <-w.reconnected:
+			log.Info("reconnected, updates may have been missed")
+			return errWatchCatchUpNeeded
+		case <-interrupter.Done():
+			return errInterrupted
+		}
+
+		w.dirtyMutex.Lock()
+		dirtyChannels := w.dirtyChannels
+		w.dirtyChannels = make(map[int64]bool)
+		w.dirtyMutex.Unlock()
+
+		pollAllChannels := time.Since(lastChannelsPollAt) >= watchChannelsPollInterval
+		if pollAllChannels {
+			lastChannelsPollAt = time.Now()
+		}
+
+		tgLimiterFor(w.tg).Wait()
+		messages, otherUpdates, users, chats, newState, tooLong, err := tgLoadDifference(w.tg, w.state)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		if tooLong {
+			log.Info("too many updates since last check")
+			return errWatchCatchUpNeeded
+		}
+		w.state = newState
+		for _, updTL := range otherUpdates {
+			switch upd := updTL.(type) {
+			case mtproto.TL_updateNewMessage:
+				messages = append(messages, upd.Message)
+			case mtproto.TL_updateChannelTooLong:
+				dirtyChannels[upd.ChannelID] = true
+			}
+		}
+		if err := w.saveNewMessages(messages, users, chats); err != nil {
+			return merry.Wrap(err)
+		}
+
+		for chatID, pts := range w.channelPTS {
+			if !pollAllChannels && !dirtyChannels[chatID] {
+				continue
+			}
+			if err := w.followChannel(w.chats[chatID], pts); err != nil {
+				return merry.Wrap(err)
+			}
+		}
+	}
+}
+
+func (w *UpdatesWatcher) followChannel(chat *Chat, pts int32) error {
+	tgLimiterFor(w.tg).Wait()
+	messages, users, chats, newPTS, tooLongDialog, err := tgLoadChannelDifference(w.tg, chat.Obj, pts)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if tooLongDialog != nil {
+		log.Info("too many updates in %s since last check, loading history", chat.Title)
+		if err := saveRelated(w.saver, users, chats); err != nil {
+			return merry.Wrap(err)
+		}
+		chat.LastMessageID = tooLongDialog.TopMessage
+		if err := loadAndSaveMessages(w.tg, chat, w.saver, w.config); err != nil {
+			return merry.Wrap(err)
+		}
+	} else if err := w.saveNewMessages(messages, users, chats); err != nil {
+		return merry.Wrap(err)
+	}
+	w.channelPTS[chat.ID] = newPTS
+	return nil
+}
+
+// saveNewMessages saves messages of watched chats that are newer than the last saved ones.
+func (w *UpdatesWatcher) saveNewMessages(messages, users, chats []mtproto.TL) error {
+	messagesByChatID := make(map[int64][]mtproto.TL)
+	for _, msg := range messages {
+		peerID, ok := tgGetMessagePeerID(msg)
+		if !ok {
+			continue
+		}
+		if _, ok := w.chats[peerID]; ok {
+			messagesByChatID[peerID] = append(messagesByChatID[peerID], msg)
+		}
+	}
+	if len(messagesByChatID) == 0 {
+		return nil
+	}
+	if err := saveRelated(w.saver, users, chats); err != nil {
+		return merry.Wrap(err)
+	}
+
+	for chatID, chatMessages := range messagesByChatID {
+		chat := w.chats[chatID]
+		lastID, err := w.saver.GetLastMessageID(chat)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+
+		var newMessages []mtproto.TL
+		seenIDs := make(map[int32]bool)
+		for _, msg := range chatMessages {
+			msgID, err := tgGetMessageID(msg)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			if msgID <= lastID || seenIDs[msgID] {
+				continue
+			}
+			seenIDs[msgID] = true
+			newMsg, err := tgLoadMissingMessageMediaStory(w.tg, chat.Obj, msg, chats)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			newMessages = append(newMessages, newMsg)
+			if msgID > chat.LastMessageID {
+				chat.LastMessageID = msgID
+			}
+		}
+		if len(newMessages) == 0 {
+			continue
+		}
+		// saver expects messages sorted from newest to oldest (same as in history responses)
+		slices.SortFunc(newMessages, func(a, b mtproto.TL) int {
+			idA, _ := tgGetMessageID(a)
+			idB, _ := tgGetMessageID(b)
+			return int(idB) - int(idA)
+		})
+
+		messagesToSave := newMessages
+		if tgIsForum(chat.Obj) {
+			messagesToSave = filterForumMessagesByTopic(chat, newMessages, w.config)
+		}
+		if err := w.saver.SaveMessages(chat, messagesToSave); err != nil {
+			return merry.Wrap(err)
+		}
+		log.Info("saved %d new message(s) from %s", len(messagesToSave), chat.Title)
+	}
+	return nil
+}